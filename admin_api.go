@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
+	"github.com/pivotal-golang/lager"
+)
+
+// newAdminHandler serves the operator API under /admin, with the broker credentials:
+//   - GET /admin/service_instances
+//   - GET /admin/service_instances/:id
+//   - GET /admin/unexpected_users
+//   - POST /admin/service_instances/:id/service_bindings/:id/rotate
+//   - GET /admin/stale_bindings?older_than_days=N
+//   - GET /admin/quota_violations
+//   - POST /admin/reconcile?action=report|delete|soft-delete&dry_run=false
+func newAdminHandler(serviceBroker *mssqlServiceBroker, logger lager.Logger, credentials brokerapi.BrokerCredentials) http.Handler {
+	router := mux.NewRouter()
+
+	router.HandleFunc("/admin/service_instances", listInstances(serviceBroker, logger)).
+		Methods("GET")
+	router.HandleFunc("/admin/service_instances/{instance_id}", getInstance(serviceBroker, logger)).
+		Methods("GET")
+	router.HandleFunc("/admin/unexpected_users", unexpectedUsers(serviceBroker, logger)).
+		Methods("GET")
+
+	router.HandleFunc("/admin/service_instances/{instance_id}/service_bindings/{binding_id}/rotate", rotateBinding(serviceBroker, logger)).
+		Methods("POST")
+	router.HandleFunc("/admin/stale_bindings", staleBindings(serviceBroker, logger)).
+		Methods("GET")
+	router.HandleFunc("/admin/quota_violations", quotaViolations(serviceBroker, logger)).
+		Methods("GET")
+	router.HandleFunc("/admin/reconcile", reconcile(serviceBroker, newKnownResourcesSource(brokerConfig.Reconcile), logger)).
+		Methods("POST")
+
+	return auth.NewWrapper(credentials.Username, credentials.Password).Wrap(router)
+}
+
+type InstancesResponse struct {
+	Instances []InstanceInfo `json:"instances"`
+}
+
+func listInstances(serviceBroker *mssqlServiceBroker, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		logger := logger.Session("list-instances")
+
+		instances, err := serviceBroker.ListInstances()
+		if err != nil {
+			logger.Error("unknown-error", err)
+			respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+				Description: err.Error(),
+			})
+			return
+		}
+
+		respond(w, http.StatusOK, InstancesResponse{Instances: instances})
+	}
+}
+
+func getInstance(serviceBroker *mssqlServiceBroker, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		instanceID := mux.Vars(req)["instance_id"]
+
+		logger := logger.Session("get-instance", lager.Data{"instance-id": instanceID})
+
+		instance, err := serviceBroker.GetInstance(instanceID)
+		if err != nil {
+			switch err {
+			case brokerapi.ErrInstanceDoesNotExist:
+				logger.Error("instance-missing", err)
+				respond(w, http.StatusNotFound, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			default:
+				logger.Error("unknown-error", err)
+				respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			}
+			return
+		}
+
+		respond(w, http.StatusOK, instance)
+	}
+}
+
+type UnexpectedUsersResponse struct {
+	Users []UnexpectedUser `json:"users"`
+}
+
+func unexpectedUsers(serviceBroker *mssqlServiceBroker, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		logger := logger.Session("unexpected-users")
+
+		users, err := serviceBroker.UnexpectedUsers()
+		if err != nil {
+			logger.Error("unknown-error", err)
+			respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+				Description: err.Error(),
+			})
+			return
+		}
+
+		respond(w, http.StatusOK, UnexpectedUsersResponse{Users: users})
+	}
+}
+
+func rotateBinding(serviceBroker *mssqlServiceBroker, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		instanceID := vars["instance_id"]
+		bindingID := vars["binding_id"]
+
+		logger := logger.Session("rotate-binding", lager.Data{"instance-id": instanceID, "binding-id": bindingID})
+
+		details := RotateDetails{
+			PlanID: req.URL.Query().Get("plan_id"),
+		}
+
+		credentials, err := serviceBroker.RotateBinding(instanceID, bindingID, details)
+		if err != nil {
+			switch err.(type) {
+			case concurrencyError:
+				logger.Error("concurrency-error", err)
+				respondConcurrencyError(w, err)
+				return
+			case quotaExceededError:
+				logger.Error("quota-exceeded", err)
+				respond(w, statusUnprocessableEntity, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+				return
+			}
+
+			switch err {
+			case brokerapi.ErrInstanceDoesNotExist:
+				logger.Error("instance-missing", err)
+				respond(w, http.StatusNotFound, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			case brokerapi.ErrBindingDoesNotExist:
+				logger.Error("binding-missing", err)
+				respond(w, http.StatusNotFound, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			default:
+				logger.Error("unknown-error", err)
+				respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			}
+			return
+		}
+
+		respond(w, http.StatusOK, brokerapi.BindingResponse{
+			Credentials: credentials,
+		})
+	}
+}
+
+type StaleBindingsResponse struct {
+	OlderThanDays int            `json:"olderThanDays"`
+	Bindings      []StaleBinding `json:"bindings"`
+	// The databases whose bindings were not checked
+	SkippedDatabases []SkippedDatabase `json:"skippedDatabases"`
+}
+
+func staleBindings(serviceBroker *mssqlServiceBroker, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		logger := logger.Session("stale-bindings")
+
+		olderThanDays := brokerConfig.CredentialRotation.MaxPasswordAgeDays
+		if olderThanDays == 0 {
+			olderThanDays = defaultMaxPasswordAgeDays
+		}
+
+		if value := req.URL.Query().Get("older_than_days"); value != "" {
+			days, err := strconv.Atoi(value)
+			if err != nil || days < 0 {
+				err = fmt.Errorf("invalid older_than_days %q", value)
+				logger.Error("invalid-older-than-days", err)
+				respond(w, http.StatusBadRequest, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+				return
+			}
+			olderThanDays = days
+		}
+
+		bindings, skipped, err := serviceBroker.StaleBindings(olderThanDays)
+		if err != nil {
+			logger.Error("unknown-error", err)
+			respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+				Description: err.Error(),
+			})
+			return
+		}
+
+		respond(w, http.StatusOK, StaleBindingsResponse{
+			OlderThanDays:    olderThanDays,
+			Bindings:         bindings,
+			SkippedDatabases: skipped,
+		})
+	}
+}
+
+type QuotaViolationsResponse struct {
+	Databases []QuotaViolation `json:"databases"`
+}
+
+func quotaViolations(serviceBroker *mssqlServiceBroker, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		logger := logger.Session("quota-violations")
+
+		violations, err := serviceBroker.QuotaViolations()
+		if err != nil {
+			logger.Error("unknown-error", err)
+			respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+				Description: err.Error(),
+			})
+			return
+		}
+
+		respond(w, http.StatusOK, QuotaViolationsResponse{Databases: violations})
+	}
+}
+
+// reconcile compares the managed databases and users with the known instances and bindings
+// from the request body, or from the configured source if the body is empty.
+// Without dry_run=false the changes are only reported.
+func reconcile(serviceBroker *mssqlServiceBroker, source knownResourcesSource, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		options := ReconcileOptions{
+			Action: query.Get("action"),
+			DryRun: query.Get("dry_run") != "false",
+		}
+		if options.Action == "" {
+			options.Action = reconcileReport
+		}
+
+		logger := logger.Session("reconcile", lager.Data{"action": options.Action, "dry-run": options.DryRun})
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			logger.Error("invalid-known-resources", err)
+			respond(w, statusUnprocessableEntity, brokerapi.ErrorResponse{
+				Description: err.Error(),
+			})
+			return
+		}
+
+		var known KnownResources
+		if len(strings.TrimSpace(string(body))) != 0 {
+			err = json.Unmarshal(body, &known)
+			if err != nil {
+				logger.Error("invalid-known-resources", err)
+				respond(w, statusUnprocessableEntity, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+				return
+			}
+		} else if source != nil {
+			known, err = source.KnownResources()
+			if err != nil {
+				logger.Error("known-resources-source-failed", err)
+				respond(w, http.StatusBadGateway, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+				return
+			}
+		} else {
+			err = fmt.Errorf("send the known instances and bindings, or configure the reconcile source")
+			logger.Error("no-known-resources", err)
+			respond(w, http.StatusBadRequest, brokerapi.ErrorResponse{
+				Description: err.Error(),
+			})
+			return
+		}
+
+		// The configured source checks each orphan again before it is deleted, also when the body has the known resources
+		if checker, ok := source.(knownResourceChecker); ok {
+			options.Recheck = checker
+		}
+
+		report, err := serviceBroker.Reconcile(known, options)
+		if err != nil {
+			switch err.(type) {
+			case invalidParametersError:
+				logger.Error("invalid-parameters", err)
+				respond(w, http.StatusBadRequest, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			default:
+				logger.Error("unknown-error", err)
+				respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			}
+			return
+		}
+
+		respond(w, http.StatusOK, report)
+	}
+}
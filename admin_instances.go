@@ -0,0 +1,196 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-golang/lager"
+)
+
+// InstanceInfo is a managed database as reported by the admin API
+type InstanceInfo struct {
+	InstanceID    string            `json:"instanceId"`
+	Server        string            `json:"server"`
+	Database      string            `json:"database"`
+	State         string            `json:"state"`
+	UserAccess    string            `json:"userAccess"`
+	RecoveryModel string            `json:"recoveryModel"`
+	Collation     string            `json:"collation"`
+	CreatedAt     time.Time         `json:"createdAt"`
+	DataSizeMB    int64             `json:"dataSizeMB"`
+	LogSizeMB     int64             `json:"logSizeMB"`
+	Metadata      map[string]string `json:"metadata"`
+	Bindings      []BindingUserInfo `json:"bindings"`
+	// The metadata and the users of the offline databases, or after a sql error, are not reported
+	Error string `json:"error,omitempty"`
+}
+
+// BindingUserInfo is a binding user of a managed database
+type BindingUserInfo struct {
+	User              string    `json:"user"`
+	BindingID         string    `json:"bindingId"`
+	CreatedAt         time.Time `json:"createdAt"`
+	PasswordChangedAt time.Time `json:"passwordChangedAt"`
+}
+
+// UnexpectedUser is a user of a managed database that is not named <database>-<binding id>
+type UnexpectedUser struct {
+	Server     string    `json:"server"`
+	Database   string    `json:"database"`
+	InstanceID string    `json:"instanceId"`
+	User       string    `json:"user"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// isBindingUser checks that the user is named as the primary or dual user of a binding
+func isBindingUser(databaseName, username string) (string, bool) {
+	bindingID, ok := bindingIDOfUser(databaseName, username)
+	if !ok || validateIdentifier("binding", bindingID) != nil {
+		return "", false
+	}
+	return bindingID, true
+}
+
+func newInstanceInfo(server *mssqlServer, info provisioner.DatabaseInfo) InstanceInfo {
+	instance := InstanceInfo{
+		InstanceID:    strings.TrimPrefix(info.Name, brokerConfig.DbIdentifierPrefix),
+		Server:        server.Name,
+		Database:      info.Name,
+		State:         info.State,
+		UserAccess:    info.UserAccess,
+		RecoveryModel: info.RecoveryModel,
+		Collation:     info.Collation,
+		CreatedAt:     info.CreatedAt,
+		DataSizeMB:    info.DataSizeMB,
+		LogSizeMB:     info.LogSizeMB,
+		Metadata:      map[string]string{},
+		Bindings:      []BindingUserInfo{},
+	}
+
+	if info.State != "ONLINE" {
+		instance.Error = "the database is " + strings.ToLower(info.State)
+		return instance
+	}
+
+	metadata, err := server.provisioner.GetDatabaseProperties(info.Name)
+	if err != nil {
+		logger.Error("get-database-properties-failed", err, lager.Data{"database": info.Name})
+		instance.Error = err.Error()
+		return instance
+	}
+	instance.Metadata = metadata
+
+	users, err := server.provisioner.ListUsers(info.Name)
+	if err != nil {
+		logger.Error("list-users-failed", err, lager.Data{"database": info.Name})
+		instance.Error = err.Error()
+		return instance
+	}
+
+	for _, user := range users {
+		if bindingID, ok := isBindingUser(info.Name, user.Name); ok {
+			instance.Bindings = append(instance.Bindings, BindingUserInfo{
+				User:              user.Name,
+				BindingID:         bindingID,
+				CreatedAt:         user.CreatedAt,
+				PasswordChangedAt: user.ModifiedAt,
+			})
+		}
+	}
+
+	return instance
+}
+
+// ListInstances reports the managed databases of all servers
+func (*mssqlServiceBroker) ListInstances() ([]InstanceInfo, error) {
+	logger.Info("list-instances-called")
+
+	instances := []InstanceInfo{}
+	for _, server := range mssqlServers.servers {
+		databases, err := server.provisioner.ListDatabaseInfo(brokerConfig.DbIdentifierPrefix)
+		if err != nil {
+			return nil, brokerError(err, nil, nil)
+		}
+
+		for _, info := range databases {
+			instances = append(instances, newInstanceInfo(server, info))
+		}
+	}
+
+	return instances, nil
+}
+
+// GetInstance reports the database of an instance
+func (*mssqlServiceBroker) GetInstance(instanceID string) (InstanceInfo, error) {
+	logger.Info("get-instance-called", lager.Data{"instanceId": instanceID})
+
+	if validateIdentifier("instance", instanceID) != nil {
+		return InstanceInfo{}, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	databaseName := brokerConfig.DbIdentifierPrefix + instanceID
+
+	server, err := mssqlServers.Locate(databaseName)
+	if err != nil {
+		return InstanceInfo{}, brokerError(err, nil, nil)
+	}
+
+	if server == nil {
+		return InstanceInfo{}, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	info, found, err := server.provisioner.GetDatabaseInfo(databaseName)
+	if err != nil {
+		return InstanceInfo{}, brokerError(err, nil, brokerapi.ErrInstanceDoesNotExist)
+	}
+
+	if !found {
+		return InstanceInfo{}, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	return newInstanceInfo(server, info), nil
+}
+
+// UnexpectedUsers reports the users with a password of the managed databases
+// that were not created by the bind operation, e.g. by the applications or by hand
+func (*mssqlServiceBroker) UnexpectedUsers() ([]UnexpectedUser, error) {
+	logger.Info("unexpected-users-called")
+
+	unexpected := []UnexpectedUser{}
+	for _, server := range mssqlServers.servers {
+		databases, err := server.provisioner.ListDatabaseInfo(brokerConfig.DbIdentifierPrefix)
+		if err != nil {
+			return nil, brokerError(err, nil, nil)
+		}
+
+		for _, info := range databases {
+			if info.State != "ONLINE" {
+				continue
+			}
+
+			databaseName := info.Name
+			users, err := server.provisioner.ListUsers(databaseName)
+			if err != nil {
+				return nil, brokerError(err, nil, nil)
+			}
+
+			for _, user := range users {
+				if _, ok := isBindingUser(databaseName, user.Name); ok {
+					continue
+				}
+
+				unexpected = append(unexpected, UnexpectedUser{
+					Server:     server.Name,
+					Database:   databaseName,
+					InstanceID: strings.TrimPrefix(databaseName, brokerConfig.DbIdentifierPrefix),
+					User:       user.Name,
+					CreatedAt:  user.CreatedAt,
+				})
+			}
+		}
+	}
+
+	return unexpected, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-golang/lager"
+)
+
+func TestIsBindingUser(t *testing.T) {
+	for _, user := range []string{"cf-instance1-binding1", "cf-instance1-binding1~2"} {
+		if _, ok := isBindingUser("cf-instance1", user); !ok {
+			t.Errorf("%q should be a binding user", user)
+		}
+	}
+	for _, user := range []string{"app_user", "cf-instance1-binding 1", "cf-instance1-binding1~3", "cf-instance1-~2"} {
+		if _, ok := isBindingUser("cf-instance1", user); ok {
+			t.Errorf("%q should not be a binding user", user)
+		}
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	previousConfig, previousServers := brokerConfig, mssqlServers
+	defer func() { brokerConfig, mssqlServers = previousConfig, previousServers }()
+	brokerConfig = &config.Config{DbIdentifierPrefix: "cf-"}
+	// without servers, no instance exists
+	mssqlServers = &mssqlServerPool{}
+
+	credentials := brokerapi.BrokerCredentials{Username: "admin", Password: "secret"}
+	handler := newAdminHandler(newMssqlServiceBroker(), lager.NewLogger("admin-test"), credentials)
+
+	cases := []struct {
+		method, path, body string
+		username, password string
+		status             int
+		response           string
+	}{
+		{"GET", "/admin/service_instances", "", "admin", "secret", http.StatusOK, `{"instances":[]}`},
+		{"GET", "/admin/service_instances", "", "admin", "wrong", http.StatusUnauthorized, ""},
+		{"GET", "/admin/service_instances", "", "", "", http.StatusUnauthorized, ""},
+		{"GET", "/admin/service_instances/instance1", "", "admin", "secret", http.StatusNotFound, "instance does not exist"},
+		{"GET", "/admin/service_instances/instance1", "", "admin", "wrong", http.StatusUnauthorized, ""},
+		{"GET", "/admin/service_instances/instance%5D1", "", "admin", "secret", http.StatusNotFound, "instance does not exist"},
+		{"POST", "/admin/service_instances/instance1/service_bindings/binding1/rotate", "", "admin", "secret", http.StatusNotFound, "instance does not exist"},
+		{"GET", "/admin/unexpected_users", "", "admin", "secret", http.StatusOK, `{"users":[]}`},
+		{"GET", "/admin/stale_bindings?older_than_days=30", "", "admin", "secret", http.StatusOK, `"olderThanDays":30`},
+		{"GET", "/admin/stale_bindings?older_than_days=soon", "", "admin", "secret", http.StatusBadRequest, "invalid older_than_days"},
+		{"GET", "/admin/quota_violations", "", "admin", "secret", http.StatusOK, `{"databases":[]}`},
+		{"POST", "/admin/reconcile", "", "admin", "secret", http.StatusBadRequest, "configure the reconcile source"},
+		{"POST", "/admin/reconcile?action=drop", `{"instances": ["instance1"]}`, "admin", "secret", http.StatusBadRequest, "invalid reconcile action"},
+		{"POST", "/admin/reconcile", `{"instances": ["instance1"]}`, "admin", "secret", http.StatusOK, `"knownInstances":1`},
+		{"GET", "/admin/unknown", "", "admin", "secret", http.StatusNotFound, ""},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		if c.username != "" {
+			req.SetBasicAuth(c.username, c.password)
+		}
+		recorder := httptest.NewRecorder()
+
+		// Act
+		handler.ServeHTTP(recorder, req)
+
+		// Assert
+		if recorder.Code != c.status {
+			t.Errorf("expected %d for %s %s, got %d: %s", c.status, c.method, c.path, recorder.Code, recorder.Body)
+			continue
+		}
+		if !strings.Contains(recorder.Body.String(), c.response) {
+			t.Errorf("expected %q in the response of %s %s, got %s", c.response, c.method, c.path, recorder.Body)
+		}
+	}
+}
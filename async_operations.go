@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+	"github.com/pivotal-golang/lager"
+)
+
+const (
+	provisionOperation   = "provision"
+	deprovisionOperation = "deprovision"
+)
+
+// The states of an operation stored in the extended properties of the database
+const (
+	operationInProgress = "in progress"
+	operationSucceeded  = "succeeded"
+	operationFailed     = "failed"
+)
+
+// The error of a failed operation is truncated in the extended property
+const maxOperationErrorLength = 1000
+
+type asyncOperation struct {
+	kind       string
+	inProgress bool
+	err        error
+}
+
+// asyncOperations keeps track of the background workers started by this broker process.
+// The other broker processes, and this one after a restart, report the operations from the
+// application lock of the instance and from the operation stored on the database (see LastOperation).
+type asyncOperations struct {
+	mutex      sync.Mutex
+	operations map[string]*asyncOperation
+}
+
+func newAsyncOperations() *asyncOperations {
+	return &asyncOperations{
+		operations: map[string]*asyncOperation{},
+	}
+}
+
+// start runs the work in a new goroutine. Returns false if another
+// operation is already in progress for the instance.
+// Panics in the work function will crash the process, the same as exitOnPanicWrapper.
+func (ops *asyncOperations) start(instanceID, kind string, work func() error) bool {
+	ops.mutex.Lock()
+	defer ops.mutex.Unlock()
+
+	if op, ok := ops.operations[instanceID]; ok && op.inProgress {
+		return false
+	}
+
+	op := &asyncOperation{kind: kind, inProgress: true}
+	ops.operations[instanceID] = op
+
+	go func() {
+		err := work()
+
+		ops.mutex.Lock()
+		defer ops.mutex.Unlock()
+		op.inProgress = false
+		op.err = err
+	}()
+
+	return true
+}
+
+func (ops *asyncOperations) get(instanceID string) (asyncOperation, bool) {
+	ops.mutex.Lock()
+	defer ops.mutex.Unlock()
+
+	op, ok := ops.operations[instanceID]
+	if !ok {
+		return asyncOperation{}, false
+	}
+	return *op, true
+}
+
+// forget removes a finished operation. Operations in progress are kept.
+func (ops *asyncOperations) forget(instanceID string) {
+	ops.mutex.Lock()
+	defer ops.mutex.Unlock()
+
+	if op, ok := ops.operations[instanceID]; ok && !op.inProgress {
+		delete(ops.operations, instanceID)
+	}
+}
+
+// setOperationState stores the kind and state of a provision or deprovision on the database,
+// so any broker process can report it. The error is cleared unless the operation failed.
+func setOperationState(server *mssqlServer, databaseName, kind, state string, opErr error) error {
+	properties := map[string]string{operationProperty: kind, operationStateProperty: state}
+	if opErr != nil {
+		message := []rune(opErr.Error())
+		if len(message) > maxOperationErrorLength {
+			message = message[:maxOperationErrorLength]
+		}
+		properties[operationErrorProperty] = string(message)
+	}
+
+	err := server.provisioner.SetDatabaseProperties(databaseName, properties)
+	if err != nil {
+		return err
+	}
+	if opErr == nil {
+		return server.provisioner.DeleteDatabaseProperty(databaseName, operationErrorProperty)
+	}
+	return nil
+}
+
+// recordOperationFailure stores a failed operation on the database, if the database exists
+func recordOperationFailure(server *mssqlServer, databaseName, kind string, opErr error) {
+	exist, err := server.provisioner.IsDatabaseCreated(databaseName)
+	if err == nil && exist {
+		err = setOperationState(server, databaseName, kind, operationFailed, opErr)
+	}
+	if err != nil {
+		logger.Error("record-operation-failure-failed", err, lager.Data{"database": databaseName, "operation": kind})
+	}
+}
+
+// instanceLockHeld checks whether an operation holds the application lock of the instance on the server
+func instanceLockHeld(server *mssqlServer, instanceID string) (bool, error) {
+	release, err := acquireServerAppLock(server, instanceLockResource(instanceID), 0)
+	if err == provisioner.ErrAppLockTimeout {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	release()
+	return false, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestLastOperationWithoutDatabase(t *testing.T) {
+	fake := useFakeAppLocks(t)
+	previousServers := mssqlServers
+	defer func() { mssqlServers = previousServers }()
+	sql2 := &mssqlServer{MssqlServer: config.MssqlServer{Name: "sql2"}}
+	mssqlServers = &mssqlServerPool{servers: []*mssqlServer{{MssqlServer: config.MssqlServer{Name: "sql1"}}, sql2}}
+
+	// Act
+	_, deprovisioned := lastOperationWithoutDatabase("instance1", deprovisionOperation)
+	_, unknown := lastOperationWithoutDatabase("instance1", "")
+	failed, failedErr := lastOperationWithoutDatabase("instance1", provisionOperation)
+
+	fake.held["sql2/"+instanceLockResource("instance1")] = true
+	placed, placedErr := lastOperationWithoutDatabase("instance1", provisionOperation)
+	withoutOperation, withoutOperationErr := lastOperationWithoutDatabase("instance1", "")
+
+	// Assert
+	if deprovisioned != brokerapi.ErrInstanceDoesNotExist || unknown != brokerapi.ErrInstanceDoesNotExist {
+		t.Errorf("expected a finished deprovision to be gone, got %v, %v", deprovisioned, unknown)
+	}
+	if failedErr != nil || failed.State != lastOperationFailed {
+		t.Errorf("expected a provision without a database to fail instead of being gone, got %+v, %v", failed, failedErr)
+	}
+	if placedErr != nil || placed.State != lastOperationInProgress {
+		t.Errorf("expected a provision in progress while the lock is held on the placed server, got %+v, %v", placed, placedErr)
+	}
+	if withoutOperationErr != nil || withoutOperation.State != lastOperationInProgress || withoutOperation.Description != "provision in progress" {
+		t.Errorf("expected a provision in progress without the operation parameter, got %+v, %v", withoutOperation, withoutOperationErr)
+	}
+}
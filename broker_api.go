@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
+	"github.com/pivotal-golang/lager"
+)
+
+const statusUnprocessableEntity = 422
+
+const (
+	lastOperationInProgress = "in progress"
+	lastOperationSucceeded  = "succeeded"
+	lastOperationFailed     = "failed"
+)
+
+// ConcurrencyErrorResponse is the 422 response of the Service Broker API
+// when another operation is in progress for the instance
+type ConcurrencyErrorResponse struct {
+	Error       string `json:"error"`
+	Description string `json:"description"`
+}
+
+// AsyncOperationResponse is the 202 response of an asynchronous provision or deprovision.
+// The Cloud Controller sends the operation back as a query parameter of the last_operation requests.
+type AsyncOperationResponse struct {
+	Operation string `json:"operation"`
+}
+
+type LastOperationResponse struct {
+	State       string `json:"state"`
+	Description string `json:"description,omitempty"`
+}
+
+// ProvisionDetails adds the arbitrary parameters to the brokerapi.ServiceDetails
+type ProvisionDetails struct {
+	brokerapi.ServiceDetails
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+type UpdateDetails struct {
+	ServiceID      string                 `json:"service_id"`
+	PlanID         string                 `json:"plan_id"`
+	Parameters     map[string]interface{} `json:"parameters"`
+	PreviousValues struct {
+		PlanID    string `json:"plan_id"`
+		ServiceID string `json:"service_id"`
+		OrgID     string `json:"organization_id"`
+		SpaceID   string `json:"space_id"`
+	} `json:"previous_values"`
+}
+
+type BindDetails struct {
+	AppGUID    string                 `json:"app_guid"`
+	PlanID     string                 `json:"plan_id"`
+	ServiceID  string                 `json:"service_id"`
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+// newBrokerHandler adds the Service Broker API features that are not implemented
+// by the vendored brokerapi package around the brokerapi router:
+//   - asynchronous provision and deprovision (accepts_incomplete=true)
+//   - GET /v2/service_instances/:id/last_operation
+//   - arbitrary parameters for provision, update and bind
+//   - PATCH /v2/service_instances/:id and plan_updateable in the catalog
+//   - plan_id and service_id of the deprovision and unbind requests
+//
+// All other requests are served by the brokerapi router.
+func newBrokerHandler(serviceBroker *mssqlServiceBroker, logger lager.Logger, credentials brokerapi.BrokerCredentials) http.Handler {
+	router := mux.NewRouter()
+
+	router.HandleFunc("/v2/catalog", catalog(serviceBroker, logger)).
+		Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}", update(serviceBroker, logger)).
+		Methods("PATCH")
+	router.HandleFunc("/v2/service_instances/{instance_id}", provision(serviceBroker, logger)).
+		Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", deprovision(serviceBroker, logger)).
+		Methods("DELETE")
+	router.HandleFunc("/v2/service_instances/{instance_id}/last_operation", lastOperation(serviceBroker, logger)).
+		Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", bind(serviceBroker, logger)).
+		Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", unbind(serviceBroker, logger)).
+		Methods("DELETE")
+
+	router.NotFoundHandler = brokerapi.New(serviceBroker, logger, credentials)
+
+	return auth.NewWrapper(credentials.Username, credentials.Password).Wrap(router)
+}
+
+// CatalogResponse uses config.Service instead of brokerapi.Service
+type CatalogResponse struct {
+	Services []config.Service `json:"services"`
+}
+
+func catalog(serviceBroker *mssqlServiceBroker, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		respond(w, http.StatusOK, CatalogResponse{
+			Services: serviceBroker.Catalog(),
+		})
+	}
+}
+
+func update(serviceBroker *mssqlServiceBroker, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		instanceID := mux.Vars(req)["instance_id"]
+
+		logger := logger.Session("update", lager.Data{"instance-id": instanceID})
+
+		var details UpdateDetails
+		if err := json.NewDecoder(req.Body).Decode(&details); err != nil {
+			logger.Error("invalid-update-details", err)
+			respond(w, statusUnprocessableEntity, brokerapi.ErrorResponse{
+				Description: err.Error(),
+			})
+			return
+		}
+
+		if err := serviceBroker.Update(instanceID, details); err != nil {
+			switch err.(type) {
+			case invalidParametersError:
+				logger.Error("invalid-parameters", err)
+				respond(w, http.StatusBadRequest, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+				return
+			case updateNotSupportedError:
+				logger.Error("update-not-supported", err)
+				respond(w, statusUnprocessableEntity, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+				return
+			case quotaExceededError:
+				logger.Error("quota-exceeded", err)
+				respond(w, statusUnprocessableEntity, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+				return
+			case concurrencyError:
+				logger.Error("concurrency-error", err)
+				respondConcurrencyError(w, err)
+				return
+			}
+
+			switch err {
+			case brokerapi.ErrInstanceDoesNotExist:
+				logger.Error("instance-missing", err)
+				respond(w, http.StatusNotFound, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			default:
+				logger.Error("unknown-error", err)
+				respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			}
+			return
+		}
+
+		respond(w, http.StatusOK, brokerapi.EmptyResponse{})
+	}
+}
+
+func provision(serviceBroker *mssqlServiceBroker, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		instanceID := mux.Vars(req)["instance_id"]
+		acceptsIncomplete := req.URL.Query().Get("accepts_incomplete") == "true"
+
+		logger := logger.Session("provision", lager.Data{"instance-id": instanceID, "accepts-incomplete": acceptsIncomplete})
+
+		var details ProvisionDetails
+		if err := json.NewDecoder(req.Body).Decode(&details); err != nil {
+			logger.Error("invalid-service-details", err)
+			respond(w, statusUnprocessableEntity, brokerapi.ErrorResponse{
+				Description: err.Error(),
+			})
+			return
+		}
+
+		var err error
+		if acceptsIncomplete {
+			err = serviceBroker.ProvisionAsync(instanceID, details)
+		} else {
+			err = serviceBroker.ProvisionWithParameters(instanceID, details)
+		}
+
+		if err != nil {
+			switch err.(type) {
+			case invalidParametersError:
+				logger.Error("invalid-parameters", err)
+				respond(w, http.StatusBadRequest, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+				return
+			case concurrencyError:
+				logger.Error("concurrency-error", err)
+				respondConcurrencyError(w, err)
+				return
+			}
+
+			switch err {
+			case brokerapi.ErrInstanceAlreadyExists:
+				logger.Error("instance-already-exists", err)
+				respond(w, http.StatusConflict, brokerapi.EmptyResponse{})
+			case brokerapi.ErrInstanceLimitMet:
+				logger.Error("instance-limit-reached", err)
+				respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			default:
+				logger.Error("unknown-error", err)
+				respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			}
+			return
+		}
+
+		if acceptsIncomplete {
+			respond(w, http.StatusAccepted, AsyncOperationResponse{Operation: provisionOperation})
+		} else {
+			respond(w, http.StatusCreated, brokerapi.ProvisioningResponse{})
+		}
+	}
+}
+
+// DeprovisionDetails are sent as query parameters of the DELETE request
+type DeprovisionDetails struct {
+	PlanID    string
+	ServiceID string
+}
+
+func deprovision(serviceBroker *mssqlServiceBroker, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		instanceID := mux.Vars(req)["instance_id"]
+		query := req.URL.Query()
+		acceptsIncomplete := query.Get("accepts_incomplete") == "true"
+
+		logger := logger.Session("deprovision", lager.Data{"instance-id": instanceID, "accepts-incomplete": acceptsIncomplete})
+
+		details := DeprovisionDetails{
+			PlanID:    query.Get("plan_id"),
+			ServiceID: query.Get("service_id"),
+		}
+
+		var err error
+		if acceptsIncomplete {
+			err = serviceBroker.DeprovisionAsync(instanceID, details)
+		} else {
+			err = serviceBroker.DeprovisionWithDetails(instanceID, details)
+		}
+
+		if err != nil {
+			if _, ok := err.(concurrencyError); ok {
+				logger.Error("concurrency-error", err)
+				respondConcurrencyError(w, err)
+				return
+			}
+
+			switch err {
+			case brokerapi.ErrInstanceDoesNotExist:
+				logger.Error("instance-missing", err)
+				respond(w, http.StatusGone, brokerapi.EmptyResponse{})
+			default:
+				logger.Error("unknown-error", err)
+				respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			}
+			return
+		}
+
+		if acceptsIncomplete {
+			respond(w, http.StatusAccepted, AsyncOperationResponse{Operation: deprovisionOperation})
+			return
+		}
+		respond(w, http.StatusOK, brokerapi.EmptyResponse{})
+	}
+}
+
+func lastOperation(serviceBroker *mssqlServiceBroker, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		instanceID := mux.Vars(req)["instance_id"]
+		operation := req.URL.Query().Get("operation")
+
+		logger := logger.Session("last-operation", lager.Data{"instance-id": instanceID, "operation": operation})
+
+		lastOperation, err := serviceBroker.LastOperationWithDetails(instanceID, operation)
+		if err != nil {
+			switch err {
+			case brokerapi.ErrInstanceDoesNotExist:
+				// The Cloud Controller expects 410 Gone when a deprovision succeeded
+				logger.Info("instance-missing")
+				respond(w, http.StatusGone, brokerapi.EmptyResponse{})
+			default:
+				logger.Error("unknown-error", err)
+				respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			}
+			return
+		}
+
+		respond(w, http.StatusOK, lastOperation)
+	}
+}
+
+func bind(serviceBroker *mssqlServiceBroker, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		instanceID := vars["instance_id"]
+		bindingID := vars["binding_id"]
+
+		logger := logger.Session("bind", lager.Data{"instance-id": instanceID, "binding-id": bindingID})
+
+		var details BindDetails
+		if err := json.NewDecoder(req.Body).Decode(&details); err != nil {
+			logger.Error("invalid-bind-details", err)
+			respond(w, statusUnprocessableEntity, brokerapi.ErrorResponse{
+				Description: err.Error(),
+			})
+			return
+		}
+
+		credentials, err := serviceBroker.BindWithParameters(instanceID, bindingID, details)
+		if err != nil {
+			switch err.(type) {
+			case invalidParametersError:
+				logger.Error("invalid-parameters", err)
+				respond(w, http.StatusBadRequest, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+				return
+			case quotaExceededError:
+				logger.Error("quota-exceeded", err)
+				respond(w, statusUnprocessableEntity, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+				return
+			case concurrencyError:
+				logger.Error("concurrency-error", err)
+				respondConcurrencyError(w, err)
+				return
+			}
+
+			switch err {
+			case brokerapi.ErrInstanceDoesNotExist:
+				logger.Error("instance-missing", err)
+				respond(w, http.StatusNotFound, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			case brokerapi.ErrBindingAlreadyExists:
+				logger.Error("binding-already-exists", err)
+				respond(w, http.StatusConflict, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			default:
+				logger.Error("unknown-error", err)
+				respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			}
+			return
+		}
+
+		respond(w, http.StatusCreated, brokerapi.BindingResponse{
+			Credentials: credentials,
+		})
+	}
+}
+
+// UnbindDetails are sent as query parameters of the DELETE request
+type UnbindDetails struct {
+	PlanID    string
+	ServiceID string
+}
+
+func unbind(serviceBroker *mssqlServiceBroker, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		instanceID := vars["instance_id"]
+		bindingID := vars["binding_id"]
+		query := req.URL.Query()
+
+		logger := logger.Session("unbind", lager.Data{"instance-id": instanceID, "binding-id": bindingID})
+
+		details := UnbindDetails{
+			PlanID:    query.Get("plan_id"),
+			ServiceID: query.Get("service_id"),
+		}
+
+		if err := serviceBroker.UnbindWithDetails(instanceID, bindingID, details); err != nil {
+			if _, ok := err.(concurrencyError); ok {
+				logger.Error("concurrency-error", err)
+				respondConcurrencyError(w, err)
+				return
+			}
+
+			switch err {
+			case brokerapi.ErrInstanceDoesNotExist:
+				logger.Error("instance-missing", err)
+				respond(w, http.StatusNotFound, brokerapi.EmptyResponse{})
+			case brokerapi.ErrBindingDoesNotExist:
+				logger.Error("binding-missing", err)
+				respond(w, http.StatusGone, brokerapi.EmptyResponse{})
+			default:
+				logger.Error("unknown-error", err)
+				respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+					Description: err.Error(),
+				})
+			}
+			return
+		}
+
+		respond(w, http.StatusOK, brokerapi.EmptyResponse{})
+	}
+}
+
+func respondConcurrencyError(w http.ResponseWriter, err error) {
+	respond(w, statusUnprocessableEntity, ConcurrencyErrorResponse{
+		Error:       "ConcurrencyError",
+		Description: err.Error(),
+	})
+}
+
+func respond(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(response)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+	"github.com/pivotal-golang/lager"
+)
+
+var (
+	requestsTotal = newCounterVec("cf_mssql_broker_requests_total",
+		"Broker API requests by operation and outcome.", "operation", "outcome")
+	requestDuration = newHistogramVec("cf_mssql_broker_request_duration_seconds",
+		"Duration of the broker API requests by operation and outcome.", durationBuckets, "operation", "outcome")
+	sqlCallsTotal = newCounterVec("cf_mssql_broker_sql_calls_total",
+		"Provisioner sql calls by server, template and outcome.", "server", "template", "outcome")
+	sqlCallDuration = newHistogramVec("cf_mssql_broker_sql_call_duration_seconds",
+		"Duration of the provisioner sql calls by server and template.", durationBuckets, "server", "template")
+)
+
+// brokerOperation names the broker API operation of a request, without the IDs of the path
+func brokerOperation(method, path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch {
+	case len(parts) == 2 && parts[0] == "v2" && parts[1] == "catalog" && method == "GET":
+		return "catalog"
+	case len(parts) == 3 && parts[0] == "v2" && parts[1] == "service_instances":
+		switch method {
+		case "PUT":
+			return "provision"
+		case "PATCH":
+			return "update"
+		case "DELETE":
+			return "deprovision"
+		}
+	case len(parts) == 4 && parts[0] == "v2" && parts[1] == "service_instances" && parts[3] == "last_operation" && method == "GET":
+		return "last_operation"
+	case len(parts) == 5 && parts[0] == "v2" && parts[1] == "service_instances" && parts[3] == "service_bindings":
+		switch method {
+		case "PUT":
+			return "bind"
+		case "DELETE":
+			return "unbind"
+		}
+	case len(parts) == 2 && parts[0] == "admin" && parts[1] == "service_instances" && method == "GET":
+		return "list_instances"
+	case len(parts) == 3 && parts[0] == "admin" && parts[1] == "service_instances" && method == "GET":
+		return "get_instance"
+	case len(parts) == 2 && parts[0] == "admin" && parts[1] == "unexpected_users" && method == "GET":
+		return "unexpected_users"
+	case len(parts) == 6 && parts[0] == "admin" && parts[1] == "service_instances" && parts[5] == "rotate" && method == "POST":
+		return "rotate_binding"
+	case len(parts) == 2 && parts[0] == "admin" && parts[1] == "stale_bindings" && method == "GET":
+		return "stale_bindings"
+	case len(parts) == 2 && parts[0] == "admin" && parts[1] == "reconcile" && method == "POST":
+		return "reconcile"
+	case len(parts) == 2 && parts[0] == "admin" && parts[1] == "quota_violations" && method == "GET":
+		return "quota_violations"
+	}
+
+	return "other"
+}
+
+// requestOutcome groups the status codes of the responses
+func requestOutcome(status int) string {
+	switch {
+	case status >= 500:
+		return "server_error"
+	case status >= 400:
+		return "client_error"
+	}
+	return "success"
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// instrumentHandler records the count and the duration of the requests
+func instrumentHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		handler.ServeHTTP(recorder, req)
+
+		operation := brokerOperation(req.Method, req.URL.Path)
+		outcome := requestOutcome(recorder.status)
+		requestsTotal.add(1, operation, outcome)
+		requestDuration.observe(time.Since(start).Seconds(), operation, outcome)
+	})
+}
+
+// observeSqlCalls records the sql calls of the provisioners of the pool
+func (pool *mssqlServerPool) observeSqlCalls() {
+	for _, server := range pool.servers {
+		serverName := server.Name
+		server.provisioner.ObserveSqlCalls(func(template string, duration time.Duration, err error) {
+			outcome := "success"
+			if err != nil {
+				outcome = provisioner.ClassifyError(err).String()
+			}
+			sqlCallsTotal.add(1, serverName, template, outcome)
+			sqlCallDuration.observe(duration.Seconds(), serverName, template)
+		})
+	}
+}
+
+// metricsHandler writes the broker metrics, and collects the gauges of the servers
+func metricsHandler(pool *mssqlServerPool, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		logger := logger.Session("metrics")
+
+		var metrics bytes.Buffer
+		requestsTotal.write(&metrics)
+		requestDuration.write(&metrics)
+		sqlCallsTotal.write(&metrics)
+		sqlCallDuration.write(&metrics)
+		pool.writeServerMetrics(&metrics, logger)
+
+		w.Header().Set("Content-Type", metricsContentType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(metrics.Bytes())
+	}
+}
+
+func (pool *mssqlServerPool) writeServerMetrics(metrics *bytes.Buffer, logger lager.Logger) {
+	databases := []collectedSample{}
+	bindingUsers := []collectedSample{}
+	openConnections := []collectedSample{}
+	inUseConnections := []collectedSample{}
+	idleConnections := []collectedSample{}
+	maxOpenConnections := []collectedSample{}
+	waitCount := []collectedSample{}
+	waitDuration := []collectedSample{}
+	scrapeErrors := []collectedSample{}
+
+	for _, server := range pool.servers {
+		labels := []string{server.Name}
+
+		stats := server.provisioner.DbStats()
+		openConnections = append(openConnections, collectedSample{labels, float64(stats.OpenConnections)})
+		inUseConnections = append(inUseConnections, collectedSample{labels, float64(stats.InUse)})
+		idleConnections = append(idleConnections, collectedSample{labels, float64(stats.Idle)})
+		maxOpenConnections = append(maxOpenConnections, collectedSample{labels, float64(stats.MaxOpenConnections)})
+		waitCount = append(waitCount, collectedSample{labels, float64(stats.WaitCount)})
+		waitDuration = append(waitDuration, collectedSample{labels, stats.WaitDuration.Seconds()})
+
+		errors := 0
+		infos, err := server.provisioner.ListDatabaseInfo(brokerConfig.DbIdentifierPrefix)
+		if err != nil {
+			logger.Error("list-databases-failed", err, lager.Data{"server": server.Name})
+			errors++
+		} else {
+			databases = append(databases, collectedSample{labels, float64(len(infos))})
+		}
+
+		for _, info := range infos {
+			databaseName := info.Name
+			users, err := server.provisioner.ListUsers(databaseName)
+			if err != nil {
+				logger.Error("list-users-failed", err, lager.Data{"server": server.Name, "database": databaseName})
+				errors++
+				continue
+			}
+
+			count := 0
+			for _, user := range users {
+				if _, ok := bindingIDOfUser(databaseName, user.Name); ok {
+					count++
+				}
+			}
+			instanceID := strings.TrimPrefix(databaseName, brokerConfig.DbIdentifierPrefix)
+			bindingUsers = append(bindingUsers, collectedSample{[]string{server.Name, instanceID}, float64(count)})
+		}
+
+		scrapeErrors = append(scrapeErrors, collectedSample{labels, float64(errors)})
+	}
+
+	serverLabel := []string{"server"}
+	writeCollected(metrics, "cf_mssql_broker_managed_databases", "Databases managed by the broker.", "gauge", serverLabel, databases)
+	writeCollected(metrics, "cf_mssql_broker_binding_users", "Binding users of each service instance, including the dual users.", "gauge", []string{"server", "instance_id"}, bindingUsers)
+	writeCollected(metrics, "cf_mssql_broker_sql_open_connections", "Open connections of the sql connection pool.", "gauge", serverLabel, openConnections)
+	writeCollected(metrics, "cf_mssql_broker_sql_in_use_connections", "Connections in use of the sql connection pool.", "gauge", serverLabel, inUseConnections)
+	writeCollected(metrics, "cf_mssql_broker_sql_idle_connections", "Idle connections of the sql connection pool.", "gauge", serverLabel, idleConnections)
+	writeCollected(metrics, "cf_mssql_broker_sql_max_open_connections", "Maximum open connections of the sql connection pool, 0 for unlimited.", "gauge", serverLabel, maxOpenConnections)
+	writeCollected(metrics, "cf_mssql_broker_sql_wait_count_total", "Connections waited for by the sql connection pool.", "counter", serverLabel, waitCount)
+	writeCollected(metrics, "cf_mssql_broker_sql_wait_duration_seconds_total", "Time blocked waiting for connections of the sql connection pool.", "counter", serverLabel, waitDuration)
+	writeCollected(metrics, "cf_mssql_broker_metrics_scrape_errors", "Sql errors while collecting the server metrics of the last scrape.", "gauge", serverLabel, scrapeErrors)
+}
+
+// startMetricsListener serves /metrics on its own address, without the broker credentials
+func startMetricsListener(addr string, pool *mssqlServerPool, logger lager.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(pool, logger))
+
+	logger.Info("start-metrics-listening", lager.Data{"addr": addr})
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			logger.Fatal("error-metrics-listening", err)
+		}
+	}()
+}
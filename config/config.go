@@ -2,6 +2,7 @@ package config
 
 import (
 	"encoding/json"
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
 	"github.com/pivotal-cf/brokerapi"
 	"io/ioutil"
 	"os"
@@ -13,11 +14,180 @@ type Config struct {
 	ListeningAddr         string                      `json:"listeningAddr"`
 	LogLevel              string                      `json:"logLevel"`
 	Crednetials           brokerapi.BrokerCredentials `json:"brokerCredentials"`
-	ServiceCatalog        []brokerapi.Service         `json:"serviceCatalog"`
+	ServiceCatalog        []Service                   `json:"serviceCatalog"`
 	BrokerGoSqlDriver     string                      `json:"brokerGoSqlDriver"`
 	BrokerMssqlConnection map[string]string           `json:"brokerMssqlConnection"`
 	ServedBindingHostname string                      `json:"servedMssqlBindingHostname"`
 	ServedBindingPort     int                         `json:"servedMssqlBindingPort"`
+	// Encryption of the connections to the single server, and default of the mssqlServers without a tls
+	Tls TlsSettings `json:"tls"`
+	// Serve the broker API over https with the certificate, and optionally require client certificates
+	Https HttpsSettings `json:"https"`
+	// Address of the /metrics listener, without the broker credentials. Empty to disable the metrics.
+	MetricsListeningAddr string `json:"metricsListeningAddr"`
+	// Time to wait for the lock of an instance held by another operation. Default: 10
+	LockTimeoutSeconds int `json:"lockTimeoutSeconds"`
+	// Regular expression for the instance and binding IDs. Default: ^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$
+	IdentifierPattern string `json:"identifierPattern"`
+	// Database settings keyed by the plan ID from the service catalog
+	PlanSettings map[string]provisioner.DatabaseSettings `json:"planSettings"`
+	// Parameters schemas keyed by the plan ID from the service catalog
+	PlanParameters map[string]PlanParametersSchema `json:"planParameters"`
+	// Database roles granted to the binding users, keyed by the plan ID. Default: ["db_owner"]
+	PlanBindingRoles map[string][]string `json:"planBindingRoles"`
+	// Go text/templates of the connection strings added to the binding credentials, keyed by the
+	// credential name. They add to or replace the built-in ones, "" removes a built-in one.
+	BindingCredentialTemplates map[string]string `json:"bindingCredentialTemplates"`
+	// Backup taken before a database is deleted, keyed by the plan ID.
+	// The "" key applies to plans without an entry and to requests without a plan ID.
+	PlanFinalBackup map[string]provisioner.FinalBackupSettings `json:"planFinalBackup"`
+	// Json file with the sql template sets (see provisioner.SqlTemplateSet)
+	SqlTemplatesFile string `json:"sqlTemplatesFile"`
+	// Sql template set names keyed by plan ID. Plans without an entry use the built-in templates
+	PlanSqlTemplates map[string]string `json:"planSqlTemplates"`
+	// Password rotation of the binding users
+	CredentialRotation CredentialRotationSettings `json:"credentialRotation"`
+	// Keep deprovisioned databases offline for a grace period before dropping them
+	SoftDelete SoftDeleteSettings `json:"softDelete"`
+	// Source of the instances and bindings known by the Cloud Controller for the orphan reconciliation
+	Reconcile ReconcileSettings `json:"reconcile"`
+	// Instance count and database size limits, and the scanner of the databases over their limit
+	Quotas QuotaSettings `json:"quotas"`
+
+	// Pool of SQL Servers. If empty, the single server from the brokerGoSqlDriver,
+	// brokerMssqlConnection, servedMssqlBindingHostname and servedMssqlBindingPort is used.
+	MssqlServers []MssqlServer `json:"mssqlServers"`
+	// "least-databases" (default), "least-size" or "plan-pinned"
+	PlacementStrategy string `json:"placementStrategy"`
+	// Server names keyed by plan ID, used by the "plan-pinned" placement strategy
+	PlanServers map[string][]string `json:"planServers"`
+
+	// The json of the config file, checked for unknown keys by Validate
+	source []byte
+}
+
+// SoftDeleteSettings configure the soft delete of deprovisioned databases
+type SoftDeleteSettings struct {
+	Enabled bool `json:"enabled"`
+	// Time before a soft deleted database is dropped
+	GracePeriodHours int `json:"gracePeriodHours"`
+	// Time between two checks for expired soft deleted databases. Default: 60
+	ReaperIntervalMinutes int `json:"reaperIntervalMinutes"`
+}
+
+// HttpsSettings configure the tls listener of the broker API. Https is enabled when certFile is set.
+type HttpsSettings struct {
+	// PEM files of the server certificate chain and its private key. They are reloaded when they change.
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// "1.0", "1.1", "1.2" or "1.3". Default: 1.2
+	MinTlsVersion string `json:"minTlsVersion"`
+	// PEM file with the CA certificates of the client certificates. If set, the clients must send a valid certificate.
+	ClientCaFile string `json:"clientCaFile"`
+}
+
+// QuotaSettings limit the number and the size of the managed databases
+type QuotaSettings struct {
+	// Managed databases of all plans on all servers, 0 for unlimited
+	MaxInstances int `json:"maxInstances"`
+	// Managed databases of each plan, keyed by plan ID
+	PlanMaxInstances map[string]int `json:"planMaxInstances"`
+	// Upper bound of the maxDataSizeMB of the databases, keyed by plan ID.
+	// It also applies when the plan settings or the parameters leave the size unlimited.
+	PlanMaxDataSizeMB map[string]int `json:"planMaxDataSizeMB"`
+	// Action of the quota scanner for the databases over planMaxDataSizeMB: "report" or "read-only".
+	// Empty to disable the scanner.
+	ScanAction string `json:"scanAction"`
+	// Time between two quota scans. Default: 60
+	ScanIntervalMinutes int `json:"scanIntervalMinutes"`
+}
+
+// ReconcileSettings configure the source of the known instances and bindings
+type ReconcileSettings struct {
+	// Json file with {"instances": [...], "bindings": [...]}
+	KnownResourcesFile string `json:"knownResourcesFile"`
+	// Cloud Controller API, e.g. https://api.example.com, used when there is no file
+	CloudControllerUrl string `json:"cloudControllerUrl"`
+	// UAA client with the cloud_controller.admin_read_only or cloud_controller.admin scope
+	UaaUrl            string `json:"uaaUrl"`
+	ClientId          string `json:"clientId"`
+	ClientSecret      string `json:"clientSecret"`
+	SkipSslValidation bool   `json:"skipSslValidation"`
+	// Databases and users created more recently are never reported as orphans,
+	// the Cloud Controller may not know them yet. Default: 60
+	MinAgeMinutes int `json:"minAgeMinutes"`
+	// The delete and soft-delete actions are refused when more than this percent of the managed
+	// databases, or of the binding users, are orphans. Default: 25
+	MaxOrphanPercent int `json:"maxOrphanPercent"`
+}
+
+// CredentialRotationSettings configure the password rotation of the binding users
+type CredentialRotationSettings struct {
+	// Each binding gets a second user on the first rotation. A rotation changes the password
+	// of the user with the oldest password, so the last credentials keep working.
+	DualUsers bool `json:"dualUsers"`
+	// Default age of the passwords reported by the stale bindings report. Default: 90
+	MaxPasswordAgeDays int `json:"maxPasswordAgeDays"`
+}
+
+// MssqlServer is a SQL Server instance where the broker can place databases
+type MssqlServer struct {
+	Name                  string            `json:"name"`
+	BrokerGoSqlDriver     string            `json:"brokerGoSqlDriver"`
+	BrokerMssqlConnection map[string]string `json:"brokerMssqlConnection"`
+	ServedBindingHostname string            `json:"servedMssqlBindingHostname"`
+	ServedBindingPort     int               `json:"servedMssqlBindingPort"`
+	// Encryption of the connections of the broker and of the bindings to this server
+	Tls TlsSettings `json:"tls"`
+}
+
+// TlsSettings configure the encryption of the TDS connections to a SQL Server,
+// for the connection of the broker and in the binding credentials
+type TlsSettings struct {
+	// Encrypt the connections, the server must have a certificate
+	Encrypt bool `json:"encrypt"`
+	// Accept the server certificate without validating it, e.g. a self-signed certificate
+	TrustServerCertificate bool `json:"trustServerCertificate"`
+	// PEM file with the CA certificates of the server certificate, also sent in the binding credentials
+	CaCertificateFile string `json:"caCertificateFile"`
+	// Host name in the server certificate, if it is not the host of the connection
+	HostNameInCertificate string `json:"hostNameInCertificate"`
+}
+
+// Servers returns the configured pool of SQL Servers, or a single server named
+// "default" built from the top level connection settings.
+// Servers without a brokerGoSqlDriver or a tls use the top level brokerGoSqlDriver or tls.
+func (config *Config) Servers() []MssqlServer {
+	if len(config.MssqlServers) == 0 {
+		return []MssqlServer{
+			{
+				Name:                  "default",
+				BrokerGoSqlDriver:     config.BrokerGoSqlDriver,
+				BrokerMssqlConnection: config.BrokerMssqlConnection,
+				ServedBindingHostname: config.ServedBindingHostname,
+				ServedBindingPort:     config.ServedBindingPort,
+				Tls:                   config.Tls,
+			},
+		}
+	}
+
+	servers := []MssqlServer{}
+	for _, server := range config.MssqlServers {
+		if server.BrokerGoSqlDriver == "" {
+			server.BrokerGoSqlDriver = config.BrokerGoSqlDriver
+		}
+		if server.Tls == (TlsSettings{}) {
+			server.Tls = config.Tls
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// Service adds the catalog fields that are not available in the brokerapi.Service
+type Service struct {
+	brokerapi.Service
+	PlanUpdateable bool `json:"plan_updateable"`
 }
 
 func LoadFromFile(path string) (*Config, error) {
@@ -42,5 +212,6 @@ func ParseJson(jsonConf []byte) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	config.source = jsonConf
 	return config, nil
 }
@@ -0,0 +1,194 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Prefix of the environment variables that override the settings of the config file
+const EnvironmentPrefix = "MSSQL_BROKER_"
+
+// Suffix of the environment variables with the path of a file that has the value, e.g. a mounted secret
+const fileEnvironmentSuffix = "_FILE"
+
+// Load reads the config file, then applies the overrides of the environment variables
+func Load(path string, environ []string) (*Config, error) {
+	config, err := LoadFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.ApplyEnvironment(environ)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ApplyEnvironment overrides the settings with the MSSQL_BROKER_ environment variables, in the
+// "key=value" format of os.Environ. The variable of a setting is the upper snake case of its
+// json path, e.g. MSSQL_BROKER_BROKER_CREDENTIALS_PASSWORD for brokerCredentials.password,
+// MSSQL_BROKER_BROKER_MSSQL_CONNECTION_PWD for the pwd of brokerMssqlConnection, and
+// MSSQL_BROKER_MSSQL_SERVERS_0_SERVED_MSSQL_BINDING_PORT for the first of mssqlServers.
+// The same variable with a _FILE suffix reads the value from a file, and takes precedence.
+// Only the strings, numbers, booleans and string maps can be overridden, and the list
+// items must be in the config file.
+func (config *Config) ApplyEnvironment(environ []string) error {
+	variables := map[string]string{}
+	for _, variable := range environ {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[0], EnvironmentPrefix) {
+			variables[parts[0]] = parts[1]
+		}
+	}
+
+	return applyEnvironment(reflect.ValueOf(config).Elem(), strings.TrimSuffix(EnvironmentPrefix, "_"), variables)
+}
+
+func applyEnvironment(value reflect.Value, name string, variables map[string]string) error {
+	switch value.Kind() {
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+
+			fieldName := name
+			if !field.Anonymous {
+				fieldName = name + "_" + environmentName(jsonName(field))
+			}
+			err := applyEnvironment(value.Field(i), fieldName, variables)
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.Struct {
+			return nil
+		}
+		for i := 0; i < value.Len(); i++ {
+			err := applyEnvironment(value.Index(i), name+"_"+strconv.Itoa(i), variables)
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if value.Type() != reflect.TypeOf(map[string]string{}) {
+			return nil
+		}
+		return applyMapEnvironment(value, name, variables)
+	case reflect.String, reflect.Int, reflect.Bool:
+		setting, ok, err := lookupEnvironment(name, variables)
+		if err != nil || !ok {
+			return err
+		}
+		return setEnvironmentValue(value, name, setting)
+	}
+	return nil
+}
+
+// applyMapEnvironment sets the keys of a string map, e.g. the connection parameters.
+// A variable matches an existing key with the same letters and digits, e.g. USER_ID for "user id",
+// the other variables add their lower case key.
+func applyMapEnvironment(value reflect.Value, name string, variables map[string]string) error {
+	prefix := name + "_"
+
+	keys := map[string]string{}
+	for variable := range variables {
+		if strings.HasPrefix(variable, prefix) {
+			key := strings.TrimSuffix(strings.TrimPrefix(variable, prefix), fileEnvironmentSuffix)
+			keys[key] = strings.ToLower(key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if value.IsNil() {
+		value.Set(reflect.MakeMap(value.Type()))
+	}
+	params := value.Interface().(map[string]string)
+	for existing := range params {
+		if _, ok := keys[environmentName(existing)]; ok {
+			keys[environmentName(existing)] = existing
+		}
+	}
+
+	for key, paramName := range keys {
+		setting, ok, err := lookupEnvironment(prefix+key, variables)
+		if err != nil {
+			return err
+		}
+		if ok {
+			params[paramName] = setting
+		}
+	}
+	return nil
+}
+
+// lookupEnvironment returns the value of the variable, or the content of the file of its _FILE variable
+func lookupEnvironment(name string, variables map[string]string) (string, bool, error) {
+	if path, ok := variables[name+fileEnvironmentSuffix]; ok {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("%s%s: %v", name, fileEnvironmentSuffix, err)
+		}
+		// the secret files usually end with a new line
+		return strings.TrimRight(string(content), "\r\n"), true, nil
+	}
+
+	setting, ok := variables[name]
+	return setting, ok, nil
+}
+
+func setEnvironmentValue(value reflect.Value, name string, setting string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(setting)
+	case reflect.Int:
+		number, err := strconv.Atoi(setting)
+		if err != nil {
+			return fmt.Errorf("%s: invalid number %q", name, setting)
+		}
+		value.SetInt(int64(number))
+	case reflect.Bool:
+		flag, err := strconv.ParseBool(setting)
+		if err != nil {
+			return fmt.Errorf("%s: invalid boolean %q", name, setting)
+		}
+		value.SetBool(flag)
+	}
+	return nil
+}
+
+func jsonName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// environmentName converts a json name to upper snake case, e.g. servedMssqlBindingPort to
+// SERVED_MSSQL_BINDING_PORT. The characters that are not letters or digits become "_".
+func environmentName(name string) string {
+	converted := []rune{}
+	previous := ' '
+	for _, r := range name {
+		switch {
+		case unicode.IsUpper(r) && (unicode.IsLower(previous) || unicode.IsDigit(previous)):
+			converted = append(converted, '_', r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			converted = append(converted, unicode.ToUpper(r))
+		default:
+			converted = append(converted, '_')
+		}
+		previous = r
+	}
+	return string(converted)
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var testEnvironmentJson = `{
+	"logLevel": "info",
+	"brokerCredentials": {"username": "broker", "password": "file-password"},
+	"brokerMssqlConnection": {"server": "10.0.0.93", "user id": "sa", "password": "file-sql-password"},
+	"mssqlServers": [{"name": "sql1", "servedMssqlBindingPort": 1433}]
+}`
+
+func TestApplyEnvironment(t *testing.T) {
+	config, err := ParseJson([]byte(testEnvironmentJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretFile := filepath.Join(t.TempDir(), "sql-password")
+	err = ioutil.WriteFile(secretFile, []byte("mounted-sql-password\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	err = config.ApplyEnvironment([]string{
+		"MSSQL_BROKER_BROKER_CREDENTIALS_PASSWORD=env-password",
+		"MSSQL_BROKER_BROKER_MSSQL_CONNECTION_PASSWORD=env-sql-password",
+		"MSSQL_BROKER_BROKER_MSSQL_CONNECTION_PASSWORD_FILE=" + secretFile,
+		"MSSQL_BROKER_BROKER_MSSQL_CONNECTION_USER_ID=admin",
+		"MSSQL_BROKER_BROKER_MSSQL_CONNECTION_DATABASE=master",
+		"MSSQL_BROKER_MSSQL_SERVERS_0_SERVED_MSSQL_BINDING_PORT=1444",
+		"MSSQL_BROKER_HTTPS_CERT_FILE=/etc/broker.crt",
+		"MSSQL_BROKER_SOFT_DELETE_ENABLED=true",
+		"OTHER_LOG_LEVEL=debug",
+	})
+
+	// Assert
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if config.Crednetials.Password != "env-password" || config.Crednetials.Username != "broker" {
+		t.Errorf("expected the broker password from the environment, got %+v", config.Crednetials)
+	}
+	if config.BrokerMssqlConnection["password"] != "mounted-sql-password" {
+		t.Errorf("expected the _FILE variable to take precedence, got %q", config.BrokerMssqlConnection["password"])
+	}
+	if config.BrokerMssqlConnection["user id"] != "admin" || config.BrokerMssqlConnection["database"] != "master" || len(config.BrokerMssqlConnection) != 4 {
+		t.Errorf("expected the existing and the new connection parameters, got %v", config.BrokerMssqlConnection)
+	}
+	if config.MssqlServers[0].ServedBindingPort != 1444 {
+		t.Errorf("expected the port of the first server, got %d", config.MssqlServers[0].ServedBindingPort)
+	}
+	if config.Https.CertFile != "/etc/broker.crt" || !config.SoftDelete.Enabled || config.LogLevel != "info" {
+		t.Errorf("expected the nested settings from the environment, got %+v %+v %s", config.Https, config.SoftDelete, config.LogLevel)
+	}
+}
+
+func TestApplyEnvironmentErrors(t *testing.T) {
+	cases := [][]string{
+		{"MSSQL_BROKER_SERVED_MSSQL_BINDING_PORT=port"},
+		{"MSSQL_BROKER_SOFT_DELETE_ENABLED=maybe"},
+		{"MSSQL_BROKER_BROKER_CREDENTIALS_PASSWORD_FILE=/nonexistent/password"},
+	}
+
+	for _, environ := range cases {
+		config := &Config{}
+
+		// Act
+		err := config.ApplyEnvironment(environ)
+
+		// Assert
+		if err == nil {
+			t.Errorf("expected an error for %v", environ)
+		}
+	}
+}
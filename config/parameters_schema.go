@@ -0,0 +1,185 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// patterns caches the compiled pattern regular expressions of the parameter schemas,
+// they are compiled once by Config.Validate instead of on each request
+var patterns = struct {
+	sync.RWMutex
+	compiled map[string]*regexp.Regexp
+}{compiled: map[string]*regexp.Regexp{}}
+
+// compilePattern returns the compiled pattern from the cache, and compiles it on the first use
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	patterns.RLock()
+	compiled, ok := patterns.compiled[pattern]
+	patterns.RUnlock()
+	if ok {
+		return compiled, nil
+	}
+
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns.Lock()
+	patterns.compiled[pattern] = compiled
+	patterns.Unlock()
+	return compiled, nil
+}
+
+// PlanParametersSchema declares the parameters accepted for a plan (cf create-service -c, cf bind-service -c)
+type PlanParametersSchema struct {
+	Provision ParametersSchema `json:"provision"`
+	Update    ParametersSchema `json:"update"`
+	Bind      ParametersSchema `json:"bind"`
+}
+
+// ParametersSchema is a small subset of JSON Schema for a flat parameters object.
+// Parameters that are not declared in the properties are rejected.
+type ParametersSchema struct {
+	Properties map[string]ParameterSchema `json:"properties"`
+	Required   []string                   `json:"required"`
+}
+
+// The types of the parameters, a parameter without a type can have any value of its enum
+var parameterTypes = []string{"string", "integer", "number", "boolean", "array"}
+
+type ParameterSchema struct {
+	// "string", "integer", "number", "boolean" or "array"
+	Type        string        `json:"type"`
+	Description string        `json:"description"`
+	Enum        []interface{} `json:"enum"`
+	Pattern     string        `json:"pattern"`
+	Minimum     *float64      `json:"minimum"`
+	Maximum     *float64      `json:"maximum"`
+	// Schema for the elements of an array
+	Items *ParameterSchema `json:"items"`
+}
+
+// Validate checks the parameters against the schema and returns an error describing every problem found
+func (schema ParametersSchema) Validate(parameters map[string]interface{}) error {
+	problems := []string{}
+
+	names := []string{}
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		propertySchema, ok := schema.Properties[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown parameter %q%s", name, schema.acceptedParameters()))
+			continue
+		}
+		problems = append(problems, propertySchema.validate(name, parameters[name])...)
+	}
+
+	for _, name := range schema.Required {
+		if _, ok := parameters[name]; !ok {
+			problems = append(problems, fmt.Sprintf("missing required parameter %q", name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid parameters: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (schema ParametersSchema) acceptedParameters() string {
+	if len(schema.Properties) == 0 {
+		return ", no parameters are accepted"
+	}
+
+	names := []string{}
+	for name := range schema.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return ", accepted parameters: " + strings.Join(names, ", ")
+}
+
+func (schema ParameterSchema) validate(name string, value interface{}) []string {
+	// json numbers are decoded as float64
+	switch schema.Type {
+	case "string":
+		stringValue, ok := value.(string)
+		if !ok {
+			return []string{fmt.Sprintf("parameter %q must be a string", name)}
+		}
+		if schema.Pattern != "" {
+			compiled, err := compilePattern(schema.Pattern)
+			if err != nil || !compiled.MatchString(stringValue) {
+				return []string{fmt.Sprintf("parameter %q must match the pattern %s", name, schema.Pattern)}
+			}
+		}
+	case "integer", "number":
+		numberValue, ok := value.(float64)
+		if !ok || (schema.Type == "integer" && numberValue != float64(int64(numberValue))) {
+			return []string{fmt.Sprintf("parameter %q must be of type %s", name, schema.Type)}
+		}
+		if schema.Minimum != nil && numberValue < *schema.Minimum {
+			return []string{fmt.Sprintf("parameter %q must be greater than or equal to %v", name, *schema.Minimum)}
+		}
+		if schema.Maximum != nil && numberValue > *schema.Maximum {
+			return []string{fmt.Sprintf("parameter %q must be less than or equal to %v", name, *schema.Maximum)}
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []string{fmt.Sprintf("parameter %q must be a boolean", name)}
+		}
+	case "array":
+		arrayValue, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("parameter %q must be an array", name)}
+		}
+		if schema.Items != nil {
+			problems := []string{}
+			for i, item := range arrayValue {
+				problems = append(problems, schema.Items.validate(fmt.Sprintf("%s[%d]", name, i), item)...)
+			}
+			if len(problems) > 0 {
+				return problems
+			}
+		}
+	}
+
+	if len(schema.Enum) > 0 {
+		for _, allowed := range schema.Enum {
+			if reflect.DeepEqual(allowed, value) {
+				return nil
+			}
+		}
+		return []string{fmt.Sprintf("parameter %q must be one of %v", name, schema.Enum)}
+	}
+
+	return nil
+}
+
+// check returns the unknown types and the invalid patterns of the schema and of its array items.
+// The patterns are compiled into the cache.
+func (schema ParameterSchema) check(path string) []string {
+	problems := []string{}
+	if schema.Type != "" && !containsString(parameterTypes, schema.Type) {
+		problems = append(problems, fmt.Sprintf("%s.type %q is not one of %s", path, schema.Type, strings.Join(parameterTypes, ", ")))
+	}
+	if schema.Pattern != "" {
+		if _, err := compilePattern(schema.Pattern); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.pattern %q is not a valid regular expression: %v", path, schema.Pattern, err))
+		}
+	}
+	if schema.Items != nil {
+		problems = append(problems, schema.Items.check(path+".items")...)
+	}
+	return problems
+}
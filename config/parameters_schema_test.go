@@ -0,0 +1,98 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+var testSchemaJson = `{
+	"properties": {
+		"collation": {"type": "string", "pattern": "^[A-Za-z0-9_]+$"},
+		"recoveryModel": {"type": "string", "enum": ["SIMPLE", "FULL"]},
+		"maxDataSizeMB": {"type": "integer", "minimum": 100, "maximum": 10240},
+		"roles": {"type": "array", "items": {"type": "string", "enum": ["db_datareader", "db_datawriter"]}}
+	},
+	"required": ["collation"]
+}`
+
+func TestParametersSchemaValidate(t *testing.T) {
+	schema := ParametersSchema{}
+	err := json.Unmarshal([]byte(testSchemaJson), &schema)
+	if err != nil {
+		t.Fatalf("Schema unmarshal error, %v", err)
+	}
+
+	valid := []string{
+		`{"collation": "Latin1_General_CS_AS"}`,
+		`{"collation": "Latin1_General_CS_AS", "recoveryModel": "FULL", "maxDataSizeMB": 1024}`,
+		`{"collation": "Latin1_General_CS_AS", "roles": ["db_datareader"]}`,
+	}
+	invalid := map[string]string{
+		`{}`:                              `missing required parameter "collation"`,
+		`{"collation": "Latin1 General"}`: `must match the pattern`,
+		`{"collation": "x", "recoveryModel": "BULK_LOGGED"}`:          `must be one of`,
+		`{"collation": "x", "maxDataSizeMB": 10.5}`:                   `must be of type integer`,
+		`{"collation": "x", "maxDataSizeMB": 10}`:                     `greater than or equal to 100`,
+		`{"collation": "x", "roles": ["db_owner"]}`:                   `parameter "roles[0]" must be one of`,
+		`{"collation": "x", "owner": "me"}`:                           `unknown parameter "owner", accepted parameters: collation, maxDataSizeMB, recoveryModel, roles`,
+		`{"collation": 1, "maxDataSizeMB": "big", "roles": "reader"}`: `must be a string; parameter "maxDataSizeMB" must be of type integer; parameter "roles" must be an array`,
+	}
+
+	for _, parameters := range valid {
+		// Act
+		err := schema.Validate(decodeTestParameters(t, parameters))
+
+		// Assert
+		if err != nil {
+			t.Errorf("Validate error for %s, %v", parameters, err)
+		}
+	}
+
+	for parameters, expected := range invalid {
+		// Act
+		err := schema.Validate(decodeTestParameters(t, parameters))
+
+		// Assert
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Validate for %s returned %v, expected an error containing %q", parameters, err, expected)
+		}
+	}
+}
+
+func decodeTestParameters(t *testing.T, parameters string) map[string]interface{} {
+	res := map[string]interface{}{}
+	err := json.Unmarshal([]byte(parameters), &res)
+	if err != nil {
+		t.Fatalf("Parameters unmarshal error, %v", err)
+	}
+	return res
+}
+
+func TestParameterSchemaCheck(t *testing.T) {
+	cases := map[string]struct {
+		schema   ParameterSchema
+		expected []string
+	}{
+		"known type":         {ParameterSchema{Type: "integer"}, []string{}},
+		"enum without type":  {ParameterSchema{Enum: []interface{}{"FULL"}}, []string{}},
+		"unknown type":       {ParameterSchema{Type: "int"}, []string{`p.type "int" is not one of string, integer, number, boolean, array`}},
+		"unknown items type": {ParameterSchema{Type: "array", Items: &ParameterSchema{Type: "str"}}, []string{`p.items.type "str" is not one of`}},
+	}
+
+	for name, c := range cases {
+		// Act
+		problems := c.schema.check("p")
+
+		// Assert
+		if len(problems) != len(c.expected) {
+			t.Errorf("%s: expected %d problems, got %v", name, len(c.expected), problems)
+			continue
+		}
+		for i, expected := range c.expected {
+			if !strings.Contains(problems[i], expected) {
+				t.Errorf("%s: expected the problem %q, got %q", name, expected, problems[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package config
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+)
+
+var guidPattern = regexp.MustCompile(`^[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}$`)
+
+var logLevels = []string{"debug", "info", "error", "fatal"}
+
+// "" is the default of each setting
+var placementStrategies = []string{"", "least-databases", "least-size", "plan-pinned"}
+var quotaScanActions = []string{"", "report", "read-only"}
+
+// BrokerChecks report the problems of the settings compiled by the broker itself, e.g. the
+// binding credential templates, so Validate lists them with the other problems
+var BrokerChecks []func(config *Config) []string
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// Validate checks the settings required to start the broker, and returns an error describing
+// every problem found: the unknown keys of the config file, the broker credentials, the log level,
+// the service catalog IDs, the connection and binding settings of each SQL Server, the settings
+// of the plans and of the broker features, and the BrokerChecks.
+func (config *Config) Validate() error {
+	problems := []string{}
+
+	if config.source != nil {
+		var raw interface{}
+		err := json.Unmarshal(config.source, &raw)
+		if err == nil {
+			for _, key := range unknownKeys(raw, reflect.TypeOf(*config), "") {
+				problems = append(problems, fmt.Sprintf("unknown setting %q, check its spelling and location", key))
+			}
+		}
+	}
+
+	if config.Crednetials.Username == "" || config.Crednetials.Password == "" {
+		problems = append(problems, "brokerCredentials.username and brokerCredentials.password are required")
+	}
+
+	if !containsString(logLevels, config.LogLevel) {
+		problems = append(problems, fmt.Sprintf("invalid logLevel %q, expected %s", config.LogLevel, strings.Join(logLevels, ", ")))
+	}
+
+	problems = append(problems, config.validateCatalog()...)
+	problems = append(problems, config.validateServers()...)
+	problems = append(problems, config.validatePlanParameters()...)
+	problems = append(problems, config.validatePlanSettings()...)
+	problems = append(problems, config.validateSqlTemplates()...)
+	problems = append(problems, config.validateLifecycle()...)
+	problems = append(problems, config.validatePlacement()...)
+
+	if config.Reconcile.MaxOrphanPercent < 0 || config.Reconcile.MaxOrphanPercent > 100 {
+		problems = append(problems, fmt.Sprintf("reconcile.maxOrphanPercent %d is not between 0 and 100", config.Reconcile.MaxOrphanPercent))
+	}
+
+	for _, check := range BrokerChecks {
+		problems = append(problems, check(config)...)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+func (config *Config) validateCatalog() []string {
+	problems := []string{}
+
+	if len(config.ServiceCatalog) == 0 {
+		problems = append(problems, "serviceCatalog is empty, add a service with at least one plan")
+	}
+
+	ids := map[string]string{}
+	checkID := func(path, id string) {
+		if !guidPattern.MatchString(id) {
+			problems = append(problems, fmt.Sprintf("%s.id %q is not a GUID", path, id))
+			return
+		}
+		if previous, ok := ids[strings.ToLower(id)]; ok {
+			problems = append(problems, fmt.Sprintf("%s.id %s is already used by %s", path, id, previous))
+			return
+		}
+		ids[strings.ToLower(id)] = path
+	}
+
+	for i, service := range config.ServiceCatalog {
+		path := fmt.Sprintf("serviceCatalog[%d]", i)
+		checkID(path, service.ID)
+		if service.Name == "" {
+			problems = append(problems, path+".name is required")
+		}
+		if len(service.Plans) == 0 {
+			problems = append(problems, path+".plans is empty, add at least one plan")
+		}
+
+		for j, plan := range service.Plans {
+			planPath := fmt.Sprintf("%s.plans[%d]", path, j)
+			checkID(planPath, plan.ID)
+			if plan.Name == "" {
+				problems = append(problems, planPath+".name is required")
+			}
+		}
+	}
+
+	return problems
+}
+
+func (config *Config) validateServers() []string {
+	problems := []string{}
+
+	drivers := sql.Drivers()
+	names := map[string]bool{}
+	for i, server := range config.Servers() {
+		path := ""
+		if len(config.MssqlServers) > 0 {
+			path = fmt.Sprintf("mssqlServers[%d].", i)
+			if server.Name == "" {
+				problems = append(problems, path+"name is required")
+			} else if names[server.Name] {
+				problems = append(problems, fmt.Sprintf("%sname %q is already used by another server", path, server.Name))
+			}
+			names[server.Name] = true
+		}
+
+		if server.BrokerGoSqlDriver == "" {
+			problems = append(problems, path+"brokerGoSqlDriver is required")
+		} else if !containsString(drivers, server.BrokerGoSqlDriver) {
+			problems = append(problems, fmt.Sprintf("%sbrokerGoSqlDriver %q is not compiled in this broker, available drivers: %s", path, server.BrokerGoSqlDriver, strings.Join(drivers, ", ")))
+		}
+		if len(server.BrokerMssqlConnection) == 0 {
+			problems = append(problems, path+"brokerMssqlConnection is required")
+		}
+		if server.ServedBindingHostname == "" {
+			problems = append(problems, path+"servedMssqlBindingHostname is required, it is the host sent to the applications in the binding credentials")
+		}
+		if server.ServedBindingPort < 1 || server.ServedBindingPort > 65535 {
+			problems = append(problems, fmt.Sprintf("%sservedMssqlBindingPort %d is not between 1 and 65535", path, server.ServedBindingPort))
+		}
+	}
+
+	return problems
+}
+
+// validatePlanParameters checks the types of the parameter schemas, and compiles their patterns,
+// so the requests use the cached regular expressions
+func (config *Config) validatePlanParameters() []string {
+	problems := []string{}
+
+	planIDs := []string{}
+	for planID := range config.PlanParameters {
+		planIDs = append(planIDs, planID)
+	}
+	sort.Strings(planIDs)
+
+	for _, planID := range planIDs {
+		plan := config.PlanParameters[planID]
+		operations := []struct {
+			name   string
+			schema ParametersSchema
+		}{{"provision", plan.Provision}, {"update", plan.Update}, {"bind", plan.Bind}}
+
+		for _, operation := range operations {
+			names := []string{}
+			for name := range operation.schema.Properties {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				path := fmt.Sprintf("planParameters.%s.%s.properties.%s", planID, operation.name, name)
+				problems = append(problems, operation.schema.Properties[name].check(path)...)
+			}
+		}
+	}
+
+	return problems
+}
+
+// validatePlanSettings checks the database settings and the final backups of the plans
+func (config *Config) validatePlanSettings() []string {
+	problems := []string{}
+
+	planIDs := []string{}
+	for planID := range config.PlanSettings {
+		planIDs = append(planIDs, planID)
+	}
+	sort.Strings(planIDs)
+	for _, planID := range planIDs {
+		if err := config.PlanSettings[planID].Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("planSettings.%s: %v", planID, err))
+		}
+	}
+
+	planIDs = []string{}
+	for planID := range config.PlanFinalBackup {
+		planIDs = append(planIDs, planID)
+	}
+	sort.Strings(planIDs)
+	for _, planID := range planIDs {
+		if err := config.PlanFinalBackup[planID].Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("planFinalBackup.%s: %v", planID, err))
+		}
+	}
+
+	return problems
+}
+
+// validateSqlTemplates loads the sql templates file, and checks the template sets of the plans
+func (config *Config) validateSqlTemplates() []string {
+	sets := map[string]*provisioner.SqlTemplateSet{}
+	if config.SqlTemplatesFile != "" {
+		var err error
+		sets, err = provisioner.LoadSqlTemplates(config.SqlTemplatesFile)
+		if err != nil {
+			// the template sets of the plans can not be checked without the file
+			return []string{fmt.Sprintf("sqlTemplatesFile %s: %v", config.SqlTemplatesFile, err)}
+		}
+	}
+
+	problems := []string{}
+	planIDs := []string{}
+	for planID := range config.PlanSqlTemplates {
+		planIDs = append(planIDs, planID)
+	}
+	sort.Strings(planIDs)
+	for _, planID := range planIDs {
+		name := config.PlanSqlTemplates[planID]
+		if _, ok := sets[name]; !ok {
+			problems = append(problems, fmt.Sprintf("planSqlTemplates.%s %q is not a template set of the sqlTemplatesFile", planID, name))
+		}
+	}
+	return problems
+}
+
+// validateLifecycle checks the credential rotation, soft delete and quota settings
+func (config *Config) validateLifecycle() []string {
+	problems := []string{}
+
+	if config.CredentialRotation.MaxPasswordAgeDays < 0 {
+		problems = append(problems, fmt.Sprintf("credentialRotation.maxPasswordAgeDays %d can not be negative", config.CredentialRotation.MaxPasswordAgeDays))
+	}
+
+	if config.SoftDelete.Enabled {
+		if config.SoftDelete.GracePeriodHours <= 0 {
+			problems = append(problems, fmt.Sprintf("softDelete.gracePeriodHours %d must be positive", config.SoftDelete.GracePeriodHours))
+		}
+		if config.SoftDelete.ReaperIntervalMinutes < 0 {
+			problems = append(problems, fmt.Sprintf("softDelete.reaperIntervalMinutes %d can not be negative", config.SoftDelete.ReaperIntervalMinutes))
+		}
+	}
+
+	quotas := config.Quotas
+	if quotas.MaxInstances < 0 {
+		problems = append(problems, fmt.Sprintf("quotas.maxInstances %d can not be negative", quotas.MaxInstances))
+	}
+	for _, planID := range sortedIntKeys(quotas.PlanMaxInstances) {
+		if quotas.PlanMaxInstances[planID] < 0 {
+			problems = append(problems, fmt.Sprintf("quotas.planMaxInstances.%s %d can not be negative", planID, quotas.PlanMaxInstances[planID]))
+		}
+	}
+	for _, planID := range sortedIntKeys(quotas.PlanMaxDataSizeMB) {
+		if quotas.PlanMaxDataSizeMB[planID] < 0 {
+			problems = append(problems, fmt.Sprintf("quotas.planMaxDataSizeMB.%s %d can not be negative", planID, quotas.PlanMaxDataSizeMB[planID]))
+		}
+	}
+	if !containsString(quotaScanActions, quotas.ScanAction) {
+		problems = append(problems, fmt.Sprintf("quotas.scanAction %q is not %q or %q", quotas.ScanAction, quotaScanActions[1], quotaScanActions[2]))
+	}
+	if quotas.ScanIntervalMinutes < 0 {
+		problems = append(problems, fmt.Sprintf("quotas.scanIntervalMinutes %d can not be negative", quotas.ScanIntervalMinutes))
+	}
+
+	return problems
+}
+
+// validatePlacement checks the placement strategy, and the servers of the plan-pinned plans
+func (config *Config) validatePlacement() []string {
+	problems := []string{}
+
+	if !containsString(placementStrategies, config.PlacementStrategy) {
+		problems = append(problems, fmt.Sprintf("invalid placementStrategy %q, expected %s", config.PlacementStrategy, strings.Join(placementStrategies[1:], ", ")))
+	}
+
+	names := []string{}
+	for _, server := range config.Servers() {
+		names = append(names, server.Name)
+	}
+	planIDs := []string{}
+	for planID := range config.PlanServers {
+		planIDs = append(planIDs, planID)
+	}
+	sort.Strings(planIDs)
+	for _, planID := range planIDs {
+		for _, name := range config.PlanServers[planID] {
+			if !containsString(names, name) {
+				problems = append(problems, fmt.Sprintf("planServers.%s server %q is not in mssqlServers", planID, name))
+			}
+		}
+	}
+
+	return problems
+}
+
+// unknownKeys returns the paths of the json object keys that do not match a field of the type.
+// The keys are matched case insensitively, like encoding/json does.
+func unknownKeys(raw interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return nil
+	}
+
+	unknown := []string{}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := jsonFields(t)
+		for _, key := range sortedKeys(object) {
+			fieldType, ok := fields[strings.ToLower(key)]
+			if !ok {
+				unknown = append(unknown, joinPath(path, key))
+				continue
+			}
+			unknown = append(unknown, unknownKeys(object[key], fieldType, joinPath(path, key))...)
+		}
+	case reflect.Map:
+		object, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for _, key := range sortedKeys(object) {
+			unknown = append(unknown, unknownKeys(object[key], t.Elem(), joinPath(path, key))...)
+		}
+	case reflect.Slice, reflect.Array:
+		items, ok := raw.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, item := range items {
+			unknown = append(unknown, unknownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return unknown
+}
+
+// jsonFields returns the types of the fields of a struct keyed by their lower case json name,
+// with the fields of the embedded structs
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			for name, fieldType := range jsonFields(field.Type) {
+				if _, ok := fields[name]; !ok {
+					fields[name] = fieldType
+				}
+			}
+			continue
+		}
+		if field.PkgPath != "" || field.Tag.Get("json") == "-" {
+			continue
+		}
+		fields[strings.ToLower(jsonName(field))] = field.Type
+	}
+	return fields
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedKeys(object map[string]interface{}) []string {
+	keys := []string{}
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedIntKeys(object map[string]int) []string {
+	keys := []string{}
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
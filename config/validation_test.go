@@ -0,0 +1,201 @@
+package config
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+)
+
+type testDriver struct{}
+
+func (testDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("not implemented")
+}
+
+func init() {
+	sql.Register("test-driver", testDriver{})
+}
+
+var testValidJson = `{
+	"logLevel": "info",
+	"brokerCredentials": {"username": "broker", "password": "password"},
+	"serviceCatalog": [{
+		"id": "b6844738-382b-4a9e-9f80-2ff5049d512f",
+		"name": "mssql-dev",
+		"plan_updateable": true,
+		"plans": [{"id": "fb740fd7-2029-467a-9256-63ecd882f11c", "name": "default", "metadata": {"bullets": [], "displayName": "Mssql"}}]
+	}],
+	"brokerGoSqlDriver": "test-driver",
+	"brokerMssqlConnection": {"server": "localhost"},
+	"servedMssqlBindingHostname": "192.168.1.10",
+	"servedMssqlBindingPort": 1433,
+	"planParameters": {"fb740fd7-2029-467a-9256-63ecd882f11c": {"provision": {"properties": {"collation": {"type": "string", "pattern": "^[A-Za-z0-9_]{1,128}$"}}}}}
+}`
+
+var testInvalidJson = `{
+	"logLevel": "verbose",
+	"brokerCredentails": {"username": "broker", "password": "password"},
+	"serviceCatalog": [{
+		"id": "b6844738-382b-4a9e-9f80-2ff5049d512f",
+		"name": "mssql-dev",
+		"plans": [
+			{"id": "fb740fd7-2029-467a-9256-63ecd882f11c", "name": "default", "metadata": {"displayname": "Mssql", "color": "red"}},
+			{"id": "fb740fd7-2029-467a-9256-63ecd882f11c", "name": "large"},
+			{"id": "large", "name": "larger"}
+		]
+	}],
+	"mssqlServers": [
+		{"name": "sql1", "brokerGoSqlDriver": "odbc-missing", "brokerMssqlConnection": {"server": "sql1"}, "servedMssqlBindingPort": 70000},
+		{"name": "sql1", "brokerGoSqlDriver": "test-driver", "brokerMssqlConnection": {"server": "sql2"}, "servedMssqlBindingHostname": "sql2", "servedMssqlBindingPort": 1433}
+	],
+	"reconcile": {"maxOrphanPercent": 150},
+	"planSettings": {"fb740fd7-2029-467a-9256-63ecd882f11c": {"recoveryModel": "PARTIAL"}},
+	"planSqlTemplates": {"fb740fd7-2029-467a-9256-63ecd882f11c": "audited"},
+	"credentialRotation": {"maxPasswordAgeDays": -1},
+	"softDelete": {"enabled": true},
+	"quotas": {"scanAction": "drop"},
+	"placementStrategy": "round-robin",
+	"planParameters": {"fb740fd7-2029-467a-9256-63ecd882f11c": {"bind": {"properties": {"roles": {"type": "array", "items": {"type": "string", "pattern": "^db_(["}}}}, "update": {"properties": {"maxDataSizeMB": {"type": "int"}}}}}
+}`
+
+func TestValidate(t *testing.T) {
+	valid, err := ParseJson([]byte(testValidJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid, err := ParseJson([]byte(testInvalidJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	validErr := valid.Validate()
+	invalidErr := invalid.Validate()
+	emptyErr := (&Config{}).Validate()
+
+	// Assert
+	if validErr != nil {
+		t.Errorf("expected a valid config, got %v", validErr)
+	}
+	if _, ok := patterns.compiled["^[A-Za-z0-9_]{1,128}$"]; !ok {
+		t.Errorf("expected the parameter patterns to be compiled by Validate")
+	}
+
+	if invalidErr == nil {
+		t.Fatalf("expected an invalid config")
+	}
+	expected := []string{
+		`unknown setting "brokerCredentails"`,
+		`unknown setting "serviceCatalog[0].plans[0].metadata.color"`,
+		"brokerCredentials.username and brokerCredentials.password are required",
+		`invalid logLevel "verbose"`,
+		"serviceCatalog[0].plans[1].id fb740fd7-2029-467a-9256-63ecd882f11c is already used by serviceCatalog[0].plans[0]",
+		`serviceCatalog[0].plans[2].id "large" is not a GUID`,
+		`mssqlServers[0].brokerGoSqlDriver "odbc-missing" is not compiled in this broker`,
+		"mssqlServers[0].servedMssqlBindingHostname is required",
+		"mssqlServers[0].servedMssqlBindingPort 70000 is not between 1 and 65535",
+		`mssqlServers[1].name "sql1" is already used by another server`,
+		"reconcile.maxOrphanPercent 150 is not between 0 and 100",
+		`planParameters.fb740fd7-2029-467a-9256-63ecd882f11c.bind.properties.roles.items.pattern "^db_([" is not a valid regular expression`,
+		`planParameters.fb740fd7-2029-467a-9256-63ecd882f11c.update.properties.maxDataSizeMB.type "int" is not one of string, integer, number, boolean, array`,
+		`planSettings.fb740fd7-2029-467a-9256-63ecd882f11c: invalid recoveryModel "PARTIAL"`,
+		`planSqlTemplates.fb740fd7-2029-467a-9256-63ecd882f11c "audited" is not a template set of the sqlTemplatesFile`,
+		"credentialRotation.maxPasswordAgeDays -1 can not be negative",
+		"softDelete.gracePeriodHours 0 must be positive",
+		`quotas.scanAction "drop" is not "report" or "read-only"`,
+		`invalid placementStrategy "round-robin"`,
+	}
+	for _, problem := range expected {
+		if !strings.Contains(invalidErr.Error(), problem) {
+			t.Errorf("expected the problem %q in: %v", problem, invalidErr)
+		}
+	}
+	if strings.Contains(invalidErr.Error(), "displayname") || strings.Contains(invalidErr.Error(), "mssqlServers[1].brokerGoSqlDriver") {
+		t.Errorf("expected only the invalid settings to be reported, got: %v", invalidErr)
+	}
+
+	if emptyErr == nil || !strings.Contains(emptyErr.Error(), "serviceCatalog is empty") || !strings.Contains(emptyErr.Error(), "brokerGoSqlDriver is required") {
+		t.Errorf("expected the missing catalog and driver, got %v", emptyErr)
+	}
+}
+
+func TestValidateFeatureSettings(t *testing.T) {
+	planID := "fb740fd7-2029-467a-9256-63ecd882f11c"
+	missingFile := filepath.Join(t.TempDir(), "missing.json")
+	cases := []struct {
+		name     string
+		change   func(config *Config)
+		expected string
+	}{
+		{"plan settings", func(config *Config) {
+			config.PlanSettings = map[string]provisioner.DatabaseSettings{planID: {InitialDataSizeMB: 100, MaxDataSizeMB: 10}}
+		}, "planSettings." + planID + ": maxDataSizeMB 10 is less than initialDataSizeMB 100"},
+		{"final backup", func(config *Config) {
+			config.PlanFinalBackup = map[string]provisioner.FinalBackupSettings{planID: {Enabled: true}}
+		}, "planFinalBackup." + planID + ": the final backup directory is required"},
+		{"sql templates file", func(config *Config) {
+			config.SqlTemplatesFile = missingFile
+		}, "sqlTemplatesFile " + missingFile},
+		{"sql template set of a plan", func(config *Config) {
+			config.PlanSqlTemplates = map[string]string{planID: "audited"}
+		}, "planSqlTemplates." + planID + ` "audited" is not a template set of the sqlTemplatesFile`},
+		{"max password age", func(config *Config) {
+			config.CredentialRotation.MaxPasswordAgeDays = -1
+		}, "credentialRotation.maxPasswordAgeDays -1 can not be negative"},
+		{"soft delete grace period", func(config *Config) {
+			config.SoftDelete = SoftDeleteSettings{Enabled: true}
+		}, "softDelete.gracePeriodHours 0 must be positive"},
+		{"soft delete reaper interval", func(config *Config) {
+			config.SoftDelete = SoftDeleteSettings{Enabled: true, GracePeriodHours: 24, ReaperIntervalMinutes: -1}
+		}, "softDelete.reaperIntervalMinutes -1 can not be negative"},
+		{"instance quota", func(config *Config) {
+			config.Quotas.MaxInstances = -1
+		}, "quotas.maxInstances -1 can not be negative"},
+		{"plan instance quota", func(config *Config) {
+			config.Quotas.PlanMaxInstances = map[string]int{planID: -1}
+		}, "quotas.planMaxInstances." + planID + " -1 can not be negative"},
+		{"plan data size quota", func(config *Config) {
+			config.Quotas.PlanMaxDataSizeMB = map[string]int{planID: -1}
+		}, "quotas.planMaxDataSizeMB." + planID + " -1 can not be negative"},
+		{"quota scan action", func(config *Config) {
+			config.Quotas.ScanAction = "drop"
+		}, `quotas.scanAction "drop" is not "report" or "read-only"`},
+		{"quota scan interval", func(config *Config) {
+			config.Quotas.ScanIntervalMinutes = -1
+		}, "quotas.scanIntervalMinutes -1 can not be negative"},
+		{"placement strategy", func(config *Config) {
+			config.PlacementStrategy = "round-robin"
+		}, `invalid placementStrategy "round-robin"`},
+		{"server of a plan", func(config *Config) {
+			config.PlacementStrategy = "plan-pinned"
+			config.PlanServers = map[string][]string{planID: {"sql9"}}
+		}, "planServers." + planID + ` server "sql9" is not in mssqlServers`},
+		{"broker checks", func(config *Config) {
+			BrokerChecks = []func(config *Config) []string{func(*Config) []string { return []string{"invalid identifierPattern"} }}
+		}, "invalid identifierPattern"},
+	}
+
+	previousChecks := BrokerChecks
+	defer func() { BrokerChecks = previousChecks }()
+
+	for _, c := range cases {
+		config, err := ParseJson([]byte(testValidJson))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.change(config)
+
+		// Act
+		err = config.Validate()
+
+		// Assert
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("%s: expected the problem %q, got %v", c.name, c.expected, err)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-golang/lager"
+)
+
+// The second user of a binding in the dual users scheme.
+// The suffix is not allowed in the binding IDs, so it can not collide with another binding.
+const dualUserSuffix = "~2"
+
+const defaultMaxPasswordAgeDays = 90
+
+type RotateDetails struct {
+	PlanID string `json:"plan_id"`
+}
+
+// StaleBinding is a binding user whose password was not changed for a long time
+type StaleBinding struct {
+	Server            string    `json:"server"`
+	Database          string    `json:"database"`
+	InstanceID        string    `json:"instanceId"`
+	BindingID         string    `json:"bindingId"`
+	User              string    `json:"user"`
+	PasswordChangedAt time.Time `json:"passwordChangedAt"`
+	AgeDays           int       `json:"ageDays"`
+}
+
+// SkippedDatabase is a database whose users could not be checked, e.g. a database that is not ONLINE
+type SkippedDatabase struct {
+	Server   string `json:"server"`
+	Database string `json:"database"`
+	State    string `json:"state"`
+	Error    string `json:"error,omitempty"`
+}
+
+func bindingUsername(databaseName, bindingID string) string {
+	return databaseName + "-" + bindingID
+}
+
+// bindingIDOfUser returns the binding ID of a primary or dual user of the database
+func bindingIDOfUser(databaseName, username string) (string, bool) {
+	prefix := databaseName + "-"
+	if !strings.HasPrefix(username, prefix) {
+		return "", false
+	}
+	bindingID := strings.TrimSuffix(strings.TrimPrefix(username, prefix), dualUserSuffix)
+	return bindingID, bindingID != ""
+}
+
+// passwordChangedAt returns when the broker last set the password of the user, from the
+// cf_password_changed_at property of the users (see GetUserProperty). The modify_date of the user
+// is also changed by the other ALTER USER statements, so it is only used without the property,
+// e.g. for the users bound by an older broker.
+func passwordChangedAt(user provisioner.DatabaseUser, changedAt map[string]string) time.Time {
+	if value, ok := changedAt[user.Name]; ok {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err == nil {
+			return parsed
+		}
+	}
+	return user.ModifiedAt
+}
+
+// setPasswordChangedAt records the time of a new password on the user
+func setPasswordChangedAt(server *mssqlServer, databaseName, username string, now time.Time) {
+	setUserProperties(server, databaseName, username, map[string]string{passwordChangedAtProperty: now.UTC().Format(time.RFC3339)})
+}
+
+func newBindingPassword() string {
+	return secureRandomString(32) + happySqlPasswordPolicySuffix
+}
+
+// RotateBinding changes the password of a binding and returns its new credentials
+func (*mssqlServiceBroker) RotateBinding(instanceID, bindingID string, details RotateDetails) (interface{}, error) {
+	logger.Info("rotate-binding-called", lager.Data{"instanceId": instanceID, "bindingId": bindingID, "planId": details.PlanID})
+
+	if validateIdentifier("instance", instanceID) != nil {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	}
+	if validateIdentifier("binding", bindingID) != nil {
+		return nil, brokerapi.ErrBindingDoesNotExist
+	}
+
+	databaseName := brokerConfig.DbIdentifierPrefix + instanceID
+	username := bindingUsername(databaseName, bindingID)
+
+	server, unlock, err := lockInstance(instanceID, "rotate-binding", locateInstance(databaseName))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if server == nil {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	err = checkQuotaRestriction(server, databaseName)
+	if err != nil {
+		return nil, err
+	}
+
+	exist, err := server.provisioner.IsUserCreated(databaseName, username)
+	if err != nil {
+		return nil, brokerError(err, nil, brokerapi.ErrInstanceDoesNotExist)
+	}
+
+	if !exist {
+		return nil, brokerapi.ErrBindingDoesNotExist
+	}
+
+	return rotateBindingCredentials(server, databaseName, username, details.PlanID)
+}
+
+// rotateBindingCredentials sets a new password for the binding user.
+// With dual users the first rotation creates the second user with the same roles,
+// and the next rotations change the user with the oldest password.
+// The credentials returned by the previous bind or rotation keep working until the next rotation.
+func rotateBindingCredentials(server *mssqlServer, databaseName, username, planID string) (interface{}, error) {
+	templatesProvisioner := server.provisioner.WithTemplates(planSqlTemplates(planID))
+	password := newBindingPassword()
+
+	if !brokerConfig.CredentialRotation.DualUsers {
+		err := templatesProvisioner.RotatePassword(databaseName, username, password)
+		if err != nil {
+			return nil, brokerError(err, nil, brokerapi.ErrBindingDoesNotExist)
+		}
+
+		setPasswordChangedAt(server, databaseName, username, time.Now())
+
+		logger.Info("binding-password-rotated", lager.Data{"database": databaseName, "user": username})
+		return newMssqlBindingCredentials(server, databaseName, username, password)
+	}
+
+	dualUsername := username + dualUserSuffix
+
+	users, err := server.provisioner.ListUsers(databaseName)
+	if err != nil {
+		return nil, brokerError(err, nil, brokerapi.ErrInstanceDoesNotExist)
+	}
+
+	var primary, dual *provisioner.DatabaseUser
+	for i := range users {
+		switch users[i].Name {
+		case username:
+			primary = &users[i]
+		case dualUsername:
+			dual = &users[i]
+		}
+	}
+
+	if primary == nil {
+		return nil, brokerapi.ErrBindingDoesNotExist
+	}
+
+	if dual == nil {
+		roles, err := server.provisioner.GetUserRoles(databaseName, username)
+		if err != nil {
+			return nil, brokerError(err, nil, brokerapi.ErrBindingDoesNotExist)
+		}
+
+		err = templatesProvisioner.CreateUser(databaseName, dualUsername, password, roles)
+		if err != nil {
+			return nil, brokerError(err, nil, brokerapi.ErrInstanceDoesNotExist)
+		}
+
+		bindingID, _ := isBindingUser(databaseName, username)
+		now := time.Now().UTC().Format(time.RFC3339)
+		setUserProperties(server, databaseName, dualUsername, propertyValues(map[string]string{
+			planIdProperty:            planID,
+			instanceIdProperty:        strings.TrimPrefix(databaseName, brokerConfig.DbIdentifierPrefix),
+			bindingIdProperty:         bindingID,
+			createdAtProperty:         now,
+			passwordChangedAtProperty: now,
+			brokerVersionProperty:     brokerVersion,
+		}))
+
+		logger.Info("binding-dual-user-created", lager.Data{"database": databaseName, "user": dualUsername})
+		return newMssqlBindingCredentials(server, databaseName, dualUsername, password)
+	}
+
+	changedAt, err := server.provisioner.GetUserProperty(databaseName, passwordChangedAtProperty)
+	if err != nil {
+		return nil, brokerError(err, nil, brokerapi.ErrInstanceDoesNotExist)
+	}
+
+	rotated := primary.Name
+	if passwordChangedAt(*dual, changedAt).Before(passwordChangedAt(*primary, changedAt)) {
+		rotated = dual.Name
+	}
+
+	err = templatesProvisioner.RotatePassword(databaseName, rotated, password)
+	if err != nil {
+		return nil, brokerError(err, nil, brokerapi.ErrBindingDoesNotExist)
+	}
+
+	setPasswordChangedAt(server, databaseName, rotated, time.Now())
+
+	logger.Info("binding-password-rotated", lager.Data{"database": databaseName, "user": rotated})
+	return newMssqlBindingCredentials(server, databaseName, rotated, password)
+}
+
+// deleteDualUser drops the second user of the binding, if it was created by a rotation
+func deleteDualUser(server *mssqlServer, databaseName, username, planID string) error {
+	dualUsername := username + dualUserSuffix
+
+	exist, err := server.provisioner.IsUserCreated(databaseName, dualUsername)
+	if err != nil {
+		return brokerError(err, nil, nil)
+	}
+
+	if !exist {
+		return nil
+	}
+
+	err = server.provisioner.WithTemplates(planSqlTemplates(planID)).DeleteUser(databaseName, dualUsername)
+	if err != nil {
+		return brokerError(err, nil, nil)
+	}
+
+	return nil
+}
+
+// StaleBindings reports the binding users of all servers with a password older than the given days,
+// by the time the broker set the password (see passwordChangedAt).
+// The databases that are not ONLINE, or whose users can not be listed, are reported as skipped.
+func (*mssqlServiceBroker) StaleBindings(olderThanDays int) ([]StaleBinding, []SkippedDatabase, error) {
+	logger.Info("stale-bindings-called", lager.Data{"olderThanDays": olderThanDays})
+
+	now := time.Now()
+	cutoff := now.Add(-time.Duration(olderThanDays) * 24 * time.Hour)
+	stale := []StaleBinding{}
+	skipped := []SkippedDatabase{}
+
+	for _, server := range mssqlServers.servers {
+		databases, err := server.provisioner.ListDatabaseInfo(brokerConfig.DbIdentifierPrefix)
+		if err != nil {
+			return nil, nil, brokerError(err, nil, nil)
+		}
+
+		for _, info := range databases {
+			databaseName := info.Name
+			if info.State != "ONLINE" {
+				skipped = append(skipped, SkippedDatabase{Server: server.Name, Database: databaseName, State: info.State})
+				continue
+			}
+
+			users, err := server.provisioner.ListUsers(databaseName)
+			if err == nil {
+				var changedAt map[string]string
+				changedAt, err = server.provisioner.GetUserProperty(databaseName, passwordChangedAtProperty)
+				if err == nil {
+					stale = append(stale, staleBindingUsers(server.Name, databaseName, users, changedAt, cutoff, now)...)
+				}
+			}
+			if err != nil {
+				logger.Error("list-users-failed", err, lager.Data{"server": server.Name, "database": databaseName})
+				skipped = append(skipped, SkippedDatabase{Server: server.Name, Database: databaseName, State: info.State, Error: brokerError(err, nil, nil).Error()})
+			}
+		}
+	}
+
+	sort.Sort(staleBindingsByAge(stale))
+	return stale, skipped, nil
+}
+
+// staleBindingUsers returns the binding users of the database whose password was changed before the cutoff
+func staleBindingUsers(serverName, databaseName string, users []provisioner.DatabaseUser, changedAt map[string]string, cutoff, now time.Time) []StaleBinding {
+	stale := []StaleBinding{}
+	for _, user := range users {
+		bindingID, ok := isBindingUser(databaseName, user.Name)
+		if !ok {
+			continue
+		}
+
+		passwordChanged := passwordChangedAt(user, changedAt)
+		if passwordChanged.After(cutoff) {
+			continue
+		}
+
+		stale = append(stale, StaleBinding{
+			Server:            serverName,
+			Database:          databaseName,
+			InstanceID:        strings.TrimPrefix(databaseName, brokerConfig.DbIdentifierPrefix),
+			BindingID:         bindingID,
+			User:              user.Name,
+			PasswordChangedAt: passwordChanged,
+			AgeDays:           int(now.Sub(passwordChanged).Hours() / 24),
+		})
+	}
+	return stale
+}
+
+type staleBindingsByAge []StaleBinding
+
+func (s staleBindingsByAge) Len() int      { return len(s) }
+func (s staleBindingsByAge) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s staleBindingsByAge) Less(i, j int) bool {
+	return s[i].PasswordChangedAt.Before(s[j].PasswordChangedAt)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+)
+
+func TestBindingIDOfUser(t *testing.T) {
+	users := map[string]string{
+		"cf-instance1-binding1":   "binding1",
+		"cf-instance1-binding1~2": "binding1",
+	}
+
+	for user, expected := range users {
+		// Act
+		bindingID, ok := bindingIDOfUser("cf-instance1", user)
+
+		// Assert
+		if !ok || bindingID != expected {
+			t.Errorf("expected binding %q for %q, got %q", expected, user, bindingID)
+		}
+	}
+
+	for _, user := range []string{"dbo", "cf-instance2-binding1", "cf-instance1-", "cf-instance1-~2"} {
+		if _, ok := bindingIDOfUser("cf-instance1", user); ok {
+			t.Errorf("%q should not be a binding user", user)
+		}
+	}
+}
+
+func TestRotateParameter(t *testing.T) {
+	// Act
+	rotate, parameters, err := rotateParameter(map[string]interface{}{"rotate": true, "role": "db_datareader"})
+	_, _, invalidErr := rotateParameter(map[string]interface{}{"rotate": "yes"})
+
+	// Assert
+	if err != nil || !rotate {
+		t.Errorf("expected rotate, got %v, %v", rotate, err)
+	}
+	if _, ok := parameters["rotate"]; ok || parameters["role"] != "db_datareader" {
+		t.Errorf("unexpected parameters %v", parameters)
+	}
+	if _, ok := invalidErr.(invalidParametersError); !ok {
+		t.Errorf("expected an invalidParametersError, got %v", invalidErr)
+	}
+}
+
+func TestPasswordChangedAt(t *testing.T) {
+	modified := time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+	changedAt := map[string]string{
+		"cf-instance1-binding1":   "2016-03-04T05:06:07Z",
+		"cf-instance1-binding2":   "not a time",
+		"cf-instance1-binding3~2": "",
+	}
+
+	cases := map[string]time.Time{
+		"cf-instance1-binding1":   time.Date(2016, 3, 4, 5, 6, 7, 0, time.UTC),
+		"cf-instance1-binding2":   modified,
+		"cf-instance1-binding3~2": modified,
+		"cf-instance1-binding4":   modified,
+	}
+
+	for name, expected := range cases {
+		// Act
+		changed := passwordChangedAt(provisioner.DatabaseUser{Name: name, ModifiedAt: modified}, changedAt)
+
+		// Assert
+		if !changed.Equal(expected) {
+			t.Errorf("expected %v for %s, got %v", expected, name, changed)
+		}
+	}
+}
+
+func TestStaleBindingUsers(t *testing.T) {
+	previousConfig := brokerConfig
+	brokerConfig = &config.Config{DbIdentifierPrefix: "cf-"}
+	defer func() { brokerConfig = previousConfig }()
+	now := time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+	old := now.Add(-100 * 24 * time.Hour)
+	users := []provisioner.DatabaseUser{
+		// the password was rotated recently, the user was altered later for another reason
+		{Name: "cf-instance1-binding1", ModifiedAt: now},
+		// the user was altered recently, the password is old
+		{Name: "cf-instance1-binding2", ModifiedAt: now},
+		// bound by an older broker, without the property
+		{Name: "cf-instance1-binding3", ModifiedAt: old},
+		{Name: "cf-instance1-binding4~2", ModifiedAt: old},
+		{Name: "dbo", ModifiedAt: old},
+		{Name: "cf-instance1-bad]name", ModifiedAt: old},
+	}
+	changedAt := map[string]string{
+		"cf-instance1-binding1": now.Add(-24 * time.Hour).Format(time.RFC3339),
+		"cf-instance1-binding2": old.Format(time.RFC3339),
+	}
+
+	// Act
+	stale := staleBindingUsers("sql1", "cf-instance1", users, changedAt, now.Add(-90*24*time.Hour), now)
+
+	// Assert
+	bindings := []string{}
+	for _, binding := range stale {
+		bindings = append(bindings, binding.BindingID)
+		if binding.Server != "sql1" || binding.InstanceID != "instance1" || !binding.PasswordChangedAt.Equal(old) || binding.AgeDays != 100 {
+			t.Errorf("unexpected stale binding %+v", binding)
+		}
+	}
+	if !reflect.DeepEqual(bindings, []string{"binding2", "binding3", "binding4"}) {
+		t.Errorf("expected the bindings with an old password, got %v", bindings)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+	"github.com/pivotal-golang/lager"
+)
+
+const (
+	checkPassed  = "ok"
+	checkFailed  = "failed"
+	checkSkipped = "skipped"
+	// reported without failing the readiness
+	checkWarning = "warning"
+)
+
+type HealthCheck struct {
+	Name   string `json:"name"`
+	Server string `json:"server,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type HealthResponse struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+// healthz reports that the broker process is alive, without checking the servers
+func healthz(w http.ResponseWriter, req *http.Request) {
+	respond(w, http.StatusOK, HealthResponse{Status: checkPassed})
+}
+
+// readyz checks that every server of the pool can serve the broker operations.
+// It responds 503 with the failed checks if one of them is not ready.
+func readyz(pool *mssqlServerPool, logger lager.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		logger := logger.Session("readyz")
+
+		response := HealthResponse{Status: checkPassed, Checks: []HealthCheck{}}
+		for _, server := range pool.servers {
+			for _, check := range checkServerReadiness(server) {
+				if check.Status == checkFailed {
+					logger.Info("check-failed", lager.Data{"check": check})
+					response.Status = checkFailed
+				}
+				if check.Status == checkWarning {
+					logger.Info("check-warning", lager.Data{"check": check})
+				}
+				response.Checks = append(response.Checks, check)
+			}
+		}
+
+		if response.Status != checkPassed {
+			respond(w, http.StatusServiceUnavailable, response)
+			return
+		}
+		respond(w, http.StatusOK, response)
+	}
+}
+
+func checkServerReadiness(server *mssqlServer) []HealthCheck {
+	connection := HealthCheck{Name: "sql-connection", Server: server.Name, Status: checkPassed}
+	version := HealthCheck{Name: "contained-databases-version", Server: server.Name, Status: checkPassed}
+	authentication := HealthCheck{Name: "contained-database-authentication", Server: server.Name, Status: checkPassed}
+	encryption := HealthCheck{Name: "sql-connection-encryption", Server: server.Name, Status: checkPassed}
+
+	err := server.provisioner.Ping()
+	if err != nil {
+		connection.Status, connection.Error = checkFailed, err.Error()
+		version.Status, authentication.Status, encryption.Status = checkSkipped, checkSkipped, checkSkipped
+		return []HealthCheck{connection, version, authentication, encryption}
+	}
+
+	productVersion, err := server.provisioner.ProductVersion()
+	if err == nil {
+		var major int
+		major, err = provisioner.ProductMajorVersion(productVersion)
+		if err == nil && major < provisioner.MinContainedDatabasesMajorVersion {
+			err = fmt.Errorf("SQL Server %s does not support contained databases, SQL Server 2012 or later is required", productVersion)
+		}
+	}
+	if err != nil {
+		version.Status, version.Error = checkFailed, err.Error()
+	}
+
+	enabled, err := server.provisioner.IsContainedDatabaseAuthenticationEnabled()
+	if err == nil && !enabled {
+		err = fmt.Errorf("contained database authentication is disabled, run: sp_configure 'contained database authentication', 1; reconfigure")
+	}
+	if err != nil {
+		authentication.Status, authentication.Error = checkFailed, err.Error()
+	}
+
+	// The credentials are still sent encrypted, the drivers encrypt the login packet
+	encrypted, err := server.provisioner.IsConnectionEncrypted()
+	if err == nil && !encrypted {
+		err = fmt.Errorf("the broker connects to the server without encryption, set tls.encrypt for the server")
+	}
+	if err != nil {
+		encryption.Status, encryption.Error = checkWarning, err.Error()
+	}
+
+	return []HealthCheck{connection, version, authentication, encryption}
+}
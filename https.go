@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-golang/lager"
+)
+
+const defaultMinTlsVersion = "1.2"
+
+// The certificate files are checked for changes at most once per interval, on a new tls connection
+const certificateCheckInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// httpsEnabled checks whether the broker API is served with https
+func httpsEnabled(settings config.HttpsSettings) bool {
+	return settings.CertFile != "" || settings.KeyFile != ""
+}
+
+// newTlsConfig returns the tls config of the broker API listener. The certificate
+// is reloaded when its files change, and the client certificates are verified with
+// the clientCaFile if it is set. The handshake accepts the clients without a certificate,
+// e.g. the health checks: requireClientCertificate rejects them on the broker and admin APIs.
+func newTlsConfig(settings config.HttpsSettings, logger lager.Logger) (*tls.Config, error) {
+	if settings.CertFile == "" || settings.KeyFile == "" {
+		return nil, fmt.Errorf("both certFile and keyFile are required")
+	}
+
+	minVersion := settings.MinTlsVersion
+	if minVersion == "" {
+		minVersion = defaultMinTlsVersion
+	}
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid minTlsVersion %q, expected 1.0, 1.1, 1.2 or 1.3", settings.MinTlsVersion)
+	}
+
+	reloader, err := newCertificateReloader(settings.CertFile, settings.KeyFile, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     version,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if settings.ClientCaFile != "" {
+		pem, err := ioutil.ReadFile(settings.ClientCaFile)
+		if err != nil {
+			return nil, err
+		}
+
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in clientCaFile %s", settings.ClientCaFile)
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// requireClientCertificate rejects the requests without a verified client certificate when the
+// clientCaFile is set. /healthz and /readyz are not wrapped, so the probes do not need a certificate.
+func requireClientCertificate(settings config.HttpsSettings, handler http.Handler) http.Handler {
+	if !httpsEnabled(settings) || settings.ClientCaFile == "" {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			respond(w, http.StatusUnauthorized, brokerapi.ErrorResponse{
+				Description: "a client certificate signed by the clientCaFile is required",
+			})
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// certificateReloader serves the certificate of the cert and key files, and loads
+// them again when they change, e.g. after a renewal, without a restart of the broker.
+// The previous certificate is kept while the new files can not be loaded.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+	logger   lager.Logger
+
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+	checkedAt   time.Time
+}
+
+func newCertificateReloader(certFile, keyFile string, logger lager.Logger) (*certificateReloader, error) {
+	reloader := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger.Session("certificate-reloader", lager.Data{"certFile": certFile}),
+	}
+
+	err := reloader.load()
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// filesModTime returns the last modification time of the cert and key files
+func (reloader *certificateReloader) filesModTime() (time.Time, error) {
+	var modTime time.Time
+	for _, file := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTime, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+func (reloader *certificateReloader) load() error {
+	modTime, err := reloader.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+
+	reloader.certificate = &certificate
+	reloader.modTime = modTime
+	reloader.checkedAt = time.Now()
+	return nil
+}
+
+func (reloader *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	if time.Since(reloader.checkedAt) < certificateCheckInterval {
+		return reloader.certificate, nil
+	}
+	reloader.checkedAt = time.Now()
+
+	modTime, err := reloader.filesModTime()
+	if err != nil {
+		reloader.logger.Error("stat-certificate-failed", err)
+		return reloader.certificate, nil
+	}
+
+	if !modTime.Equal(reloader.modTime) {
+		err = reloader.load()
+		if err != nil {
+			reloader.logger.Error("reload-certificate-failed", err)
+			return reloader.certificate, nil
+		}
+		reloader.logger.Info("certificate-reloaded", lager.Data{"modTime": modTime})
+	}
+
+	return reloader.certificate, nil
+}
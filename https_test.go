@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+	"github.com/pivotal-golang/lager"
+)
+
+// writeTestCertificate writes a self-signed certificate with the common name, and its key
+func writeTestCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func certificateCommonName(t *testing.T, certificate *tls.Certificate) string {
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestNewTlsConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "broker.crt"), filepath.Join(dir, "broker.key")
+	writeTestCertificate(t, certFile, keyFile, "broker")
+	logger := lager.NewLogger("https-test")
+
+	// Act
+	defaults, err := newTlsConfig(config.HttpsSettings{CertFile: certFile, KeyFile: keyFile}, logger)
+	mutual, mutualErr := newTlsConfig(config.HttpsSettings{CertFile: certFile, KeyFile: keyFile, MinTlsVersion: "1.3", ClientCaFile: certFile}, logger)
+	_, versionErr := newTlsConfig(config.HttpsSettings{CertFile: certFile, KeyFile: keyFile, MinTlsVersion: "1.4"}, logger)
+	_, keyErr := newTlsConfig(config.HttpsSettings{CertFile: certFile}, logger)
+	_, caErr := newTlsConfig(config.HttpsSettings{CertFile: certFile, KeyFile: keyFile, ClientCaFile: keyFile}, logger)
+
+	// Assert
+	if err != nil || defaults.MinVersion != tls.VersionTLS12 || defaults.ClientAuth != tls.NoClientCert {
+		t.Errorf("expected tls 1.2 without client certificates, got %v", err)
+	}
+	if mutualErr != nil || mutual.MinVersion != tls.VersionTLS13 || mutual.ClientAuth != tls.VerifyClientCertIfGiven || mutual.ClientCAs == nil {
+		t.Errorf("expected tls 1.3 with verified client certificates, got %v", mutualErr)
+	}
+	if versionErr == nil {
+		t.Errorf("expected an error for an unknown tls version")
+	}
+	if keyErr == nil {
+		t.Errorf("expected an error without a key file")
+	}
+	if caErr == nil {
+		t.Errorf("expected an error for a client CA file without certificates")
+	}
+}
+
+func TestRequireClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "broker.crt"), filepath.Join(dir, "broker.key")
+	clientCertFile, clientKeyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeTestCertificate(t, certFile, keyFile, "broker")
+	writeTestCertificate(t, clientCertFile, clientKeyFile, "client")
+	settings := config.HttpsSettings{CertFile: certFile, KeyFile: keyFile, ClientCaFile: clientCertFile}
+
+	tlsConfig, err := newTlsConfig(settings, lager.NewLogger("https-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	mux := http.NewServeMux()
+	mux.Handle("/", requireClientCertificate(settings, ok))
+	mux.Handle("/healthz", ok)
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	clientCertificate, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string, certificates []tls.Certificate) int {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: certificates}}}
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Act
+	health := get("/healthz", nil)
+	withoutCertificate := get("/v2/catalog", nil)
+	withCertificate := get("/v2/catalog", []tls.Certificate{clientCertificate})
+
+	// Assert
+	if health != http.StatusOK {
+		t.Errorf("expected the health check without a client certificate, got %d", health)
+	}
+	if withoutCertificate != http.StatusUnauthorized {
+		t.Errorf("expected 401 for the broker API without a client certificate, got %d", withoutCertificate)
+	}
+	if withCertificate != http.StatusOK {
+		t.Errorf("expected the broker API with a client certificate, got %d", withCertificate)
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "broker.crt"), filepath.Join(dir, "broker.key")
+	writeTestCertificate(t, certFile, keyFile, "first")
+	reloader, err := newCertificateReloader(certFile, keyFile, lager.NewLogger("https-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	writeTestCertificate(t, certFile, keyFile, "second")
+	renewed := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, renewed, renewed)
+	cached, _ := reloader.GetCertificate(nil)
+	reloader.checkedAt = time.Time{}
+	reloaded, _ := reloader.GetCertificate(nil)
+
+	ioutil.WriteFile(keyFile, []byte("invalid"), 0600)
+	broken := renewed.Add(time.Minute)
+	os.Chtimes(keyFile, broken, broken)
+	reloader.checkedAt = time.Time{}
+	kept, _ := reloader.GetCertificate(nil)
+
+	// Assert
+	if name := certificateCommonName(t, cached); name != "first" {
+		t.Errorf("expected the loaded certificate before the check interval, got %s", name)
+	}
+	if name := certificateCommonName(t, reloaded); name != "second" {
+		t.Errorf("expected the renewed certificate, got %s", name)
+	}
+	if name := certificateCommonName(t, kept); name != "second" {
+		t.Errorf("expected the previous certificate to be kept for invalid files, got %s", name)
+	}
+}
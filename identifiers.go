@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+)
+
+// The instance and binding IDs are used in the database and user names.
+// The default pattern accepts the Cloud Controller GUIDs, and rejects the characters
+// that have a meaning in sql or in the broker names (e.g. "]", "'" or the soft delete "~" marker).
+const defaultIdentifierPattern = `^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`
+
+var identifierPattern = regexp.MustCompile(defaultIdentifierPattern)
+
+// The "~" marks the names made by the broker: the second user of a binding ("~2", see dualUserSuffix)
+// and the soft deleted databases ("~deleted~<timestamp>"), so it is never accepted in an ID
+const reservedIdentifierCharacter = "~"
+
+// IDs with the reserved character that a configured pattern must not match
+var reservedIdentifierSamples = []string{
+	"~",
+	"instance1" + dualUserSuffix,
+	"binding1~3",
+	"instance1~deleted~20160304T050607Z",
+}
+
+// setIdentifierPattern replaces the default pattern with the configured one
+func setIdentifierPattern(pattern string) error {
+	if pattern == "" {
+		return nil
+	}
+
+	compiled, err := compileIdentifierPattern(pattern)
+	if err != nil {
+		return err
+	}
+	identifierPattern = compiled
+	return nil
+}
+
+func compileIdentifierPattern(pattern string) (*regexp.Regexp, error) {
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identifierPattern: %v", err)
+	}
+	for _, sample := range reservedIdentifierSamples {
+		if compiled.MatchString(sample) {
+			return nil, fmt.Errorf("invalid identifierPattern: it matches %q, the %q character is reserved for the dual users and the soft deleted databases", sample, reservedIdentifierCharacter)
+		}
+	}
+	return compiled, nil
+}
+
+// checkIdentifierPattern is the config.BrokerChecks of the identifierPattern
+func checkIdentifierPattern(brokerConfig *config.Config) []string {
+	if brokerConfig.IdentifierPattern == "" {
+		return nil
+	}
+	if _, err := compileIdentifierPattern(brokerConfig.IdentifierPattern); err != nil {
+		return []string{err.Error()}
+	}
+	return nil
+}
+
+// validateIdentifier returns an invalidParametersError if the instance or binding ID
+// does not match the identifier pattern, or has the reserved "~" character
+func validateIdentifier(kind string, id string) error {
+	if strings.Contains(id, reservedIdentifierCharacter) {
+		return invalidParametersError{fmt.Errorf("invalid %s ID %q, the %q character is reserved", kind, id, reservedIdentifierCharacter)}
+	}
+	if !identifierPattern.MatchString(id) {
+		return invalidParametersError{fmt.Errorf("invalid %s ID %q, it must match %s", kind, id, identifierPattern)}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+)
+
+func TestValidateIdentifier(t *testing.T) {
+	valid := []string{"2bbc4ee7-8b41-4f5a-a7f0-54b4b2c9a2f7", "instance_1", "a"}
+	invalid := []string{"", "x]; drop database master --", "x'", "x~deleted~20160304T050607Z", "-x", strings.Repeat("a", 65), "x y"}
+
+	for _, id := range valid {
+		if err := validateIdentifier("instance", id); err != nil {
+			t.Errorf("%q should be valid, got %v", id, err)
+		}
+	}
+	for _, id := range invalid {
+		if err := validateIdentifier("instance", id); err == nil {
+			t.Errorf("%q should be invalid", id)
+		}
+	}
+}
+
+func TestSetIdentifierPattern(t *testing.T) {
+	previous := identifierPattern
+	defer func() { identifierPattern = previous }()
+
+	// Act
+	tildeErr := setIdentifierPattern(`^[a-z0-9~]+$`)
+	anyErr := setIdentifierPattern(`.+`)
+	err := setIdentifierPattern(`^[a-z0-9]+$`)
+
+	// Assert
+	if tildeErr == nil || anyErr == nil {
+		t.Errorf("expected the patterns matching the reserved character to be rejected, got %v, %v", tildeErr, anyErr)
+	}
+	if err != nil {
+		t.Fatalf("expected a valid pattern, got %v", err)
+	}
+	if validateIdentifier("binding", "binding1") != nil || validateIdentifier("binding", "Binding1") == nil {
+		t.Errorf("expected the IDs to be checked with the configured pattern")
+	}
+}
+
+func TestValidateIdentifierReservedCharacter(t *testing.T) {
+	previous := identifierPattern
+	defer func() { identifierPattern = previous }()
+	// a pattern set without setIdentifierPattern, e.g. by a test
+	identifierPattern = regexp.MustCompile(`.+`)
+
+	// Act
+	err := validateIdentifier("binding", "binding1~2")
+
+	// Assert
+	if _, ok := err.(invalidParametersError); !ok {
+		t.Errorf("expected an invalidParametersError for the reserved character, got %v", err)
+	}
+}
+
+func TestConfigValidateIdentifierPattern(t *testing.T) {
+	previous := identifierPattern
+
+	// Act
+	err := (&config.Config{IdentifierPattern: `^[a-z0-9~]+$`}).Validate()
+	validErr := (&config.Config{IdentifierPattern: `^[a-z0-9]+$`}).Validate()
+
+	// Assert
+	if err == nil || !strings.Contains(err.Error(), "invalid identifierPattern") {
+		t.Errorf("expected the identifierPattern to be checked with the config, got %v", err)
+	}
+	if validErr == nil || strings.Contains(validErr.Error(), "identifierPattern") {
+		t.Errorf("expected only the other problems of the empty config, got %v", validErr)
+	}
+	if identifierPattern != previous {
+		t.Errorf("expected the config check to keep the identifier pattern")
+	}
+}
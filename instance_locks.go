@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+	"github.com/pivotal-golang/lager"
+)
+
+const defaultLockTimeoutSeconds = 10
+
+// concurrencyError is returned when another operation holds the lock of the instance.
+// It is sent to the Cloud Controller as 422 with "error": "ConcurrencyError".
+type concurrencyError struct {
+	err error
+}
+
+func (e concurrencyError) Error() string {
+	return e.err.Error()
+}
+
+// instanceLocks serializes the lifecycle operations of an instance in this broker process.
+// The operations also take a SQL Server application lock (sp_getapplock) on the server of the
+// instance, shared by all the broker processes with the same config.
+type instanceLocks struct {
+	mutex sync.Mutex
+	locks map[string]*instanceLock
+}
+
+type instanceLock struct {
+	held    chan struct{}
+	waiters int
+}
+
+func newInstanceLocks() *instanceLocks {
+	return &instanceLocks{
+		locks: map[string]*instanceLock{},
+	}
+}
+
+// lock waits for the lock of the instance, returns false after the timeout
+func (locks *instanceLocks) lock(instanceID string, timeout time.Duration) bool {
+	locks.mutex.Lock()
+	lock, ok := locks.locks[instanceID]
+	if !ok {
+		lock = &instanceLock{held: make(chan struct{}, 1)}
+		locks.locks[instanceID] = lock
+	}
+	lock.waiters++
+	locks.mutex.Unlock()
+
+	select {
+	case lock.held <- struct{}{}:
+		return true
+	case <-time.After(timeout):
+		locks.release(instanceID, lock, false)
+		return false
+	}
+}
+
+func (locks *instanceLocks) unlock(instanceID string) {
+	locks.mutex.Lock()
+	lock := locks.locks[instanceID]
+	locks.mutex.Unlock()
+
+	locks.release(instanceID, lock, true)
+}
+
+func (locks *instanceLocks) release(instanceID string, lock *instanceLock, held bool) {
+	locks.mutex.Lock()
+	defer locks.mutex.Unlock()
+
+	if held {
+		<-lock.held
+	}
+	lock.waiters--
+	if lock.waiters == 0 {
+		delete(locks.locks, instanceID)
+	}
+}
+
+var brokerLocks = newInstanceLocks()
+
+func lockTimeout() time.Duration {
+	if brokerConfig.LockTimeoutSeconds > 0 {
+		return time.Duration(brokerConfig.LockTimeoutSeconds) * time.Second
+	}
+	return defaultLockTimeoutSeconds * time.Second
+}
+
+// acquireServerAppLock takes the application lock of the resource on the server, and returns
+// the function that releases it. The tests replace it with a fake.
+var acquireServerAppLock = func(server *mssqlServer, resource string, timeout time.Duration) (func(), error) {
+	appLock, err := server.provisioner.AcquireAppLock(resource, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return appLock.Release, nil
+}
+
+func instanceLockResource(instanceID string) string {
+	return "cf-mssql-broker:" + instanceID
+}
+
+// locateInstance is the lock target of the operations on an existing instance: the server of its database
+func locateInstance(databaseName string) func() (*mssqlServer, error) {
+	return func() (*mssqlServer, error) {
+		server, err := mssqlServers.Locate(databaseName)
+		if err != nil {
+			return nil, brokerError(err, nil, nil)
+		}
+		return server, nil
+	}
+}
+
+// provisionLockServer is the lock target of a provision: the first server of the pool, the same in all the
+// broker processes, as the database does not exist yet and each broker could place it on another server
+func provisionLockServer() (*mssqlServer, error) {
+	if len(mssqlServers.servers) == 0 {
+		return nil, fmt.Errorf("No SQL Server available for the new database")
+	}
+	return mssqlServers.servers[0], nil
+}
+
+// onServer is the lock target of the operations on a database found on a known server
+func onServer(server *mssqlServer) func() (*mssqlServer, error) {
+	return func() (*mssqlServer, error) {
+		return server, nil
+	}
+}
+
+// lockInstance takes the process lock of the instance, then the SQL Server application lock
+// on the server returned by target, so an instance only depends on the server that holds it.
+// If target returns no server, e.g. the instance does not exist, only the process lock is taken.
+// The returned function releases both locks.
+func lockInstance(instanceID string, operation string, target func() (*mssqlServer, error)) (*mssqlServer, func(), error) {
+	start := time.Now()
+	timeout := lockTimeout()
+
+	if !brokerLocks.lock(instanceID, timeout) {
+		return nil, nil, concurrencyError{fmt.Errorf("Another operation is in progress for instance %s", instanceID)}
+	}
+
+	server, err := target()
+	if err != nil {
+		brokerLocks.unlock(instanceID)
+		return nil, nil, err
+	}
+
+	if server == nil {
+		return nil, func() { brokerLocks.unlock(instanceID) }, nil
+	}
+
+	releaseAppLock, err := acquireInstanceAppLock(server, instanceID, timeout-time.Since(start))
+	if err != nil {
+		brokerLocks.unlock(instanceID)
+		return nil, nil, err
+	}
+
+	logger.Debug("instance-locked", lager.Data{"instanceId": instanceID, "operation": operation, "server": server.Name, "wait": time.Since(start).String()})
+
+	return server, func() {
+		releaseAppLock()
+		brokerLocks.unlock(instanceID)
+		logger.Debug("instance-unlocked", lager.Data{"instanceId": instanceID, "operation": operation})
+	}, nil
+}
+
+// lockNewInstance takes the locks of a provision and places the new database. The application lock is
+// taken on the provisionLockServer before the placement, so the brokers provisioning the same instance
+// wait for each other, and then also on the placed server, where the other operations of the instance lock it.
+func lockNewInstance(instanceID string, planID string) (*mssqlServer, func(), error) {
+	start := time.Now()
+
+	lockServer, unlock, err := lockInstance(instanceID, "provision", provisionLockServer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	server, err := mssqlServers.Place(planID)
+	if err != nil {
+		unlock()
+		return nil, nil, fmt.Errorf("No SQL Server available for the new database: %v", err)
+	}
+
+	if server == lockServer {
+		return server, unlock, nil
+	}
+
+	releaseAppLock, err := acquireInstanceAppLock(server, instanceID, lockTimeout()-time.Since(start))
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+
+	return server, func() {
+		releaseAppLock()
+		unlock()
+	}, nil
+}
+
+// acquireInstanceAppLock takes the application lock of the instance on the server
+func acquireInstanceAppLock(server *mssqlServer, instanceID string, remaining time.Duration) (func(), error) {
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	releaseAppLock, err := acquireServerAppLock(server, instanceLockResource(instanceID), remaining)
+	if err != nil {
+		if err == provisioner.ErrAppLockTimeout {
+			return nil, concurrencyError{fmt.Errorf("Another broker is running an operation for instance %s", instanceID)}
+		}
+		return nil, brokerError(err, nil, nil)
+	}
+	return releaseAppLock, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+)
+
+func TestInstanceLocks(t *testing.T) {
+	locks := newInstanceLocks()
+
+	// Act
+	locked := locks.lock("instance1", time.Second)
+	lockedAgain := locks.lock("instance1", 10*time.Millisecond)
+	otherLocked := locks.lock("instance2", 10*time.Millisecond)
+
+	// Assert
+	if !locked || !otherLocked {
+		t.Errorf("expected the free locks to be taken, got %v, %v", locked, otherLocked)
+	}
+	if lockedAgain {
+		t.Errorf("expected a timeout on the held lock")
+	}
+
+	locks.unlock("instance1")
+	if !locks.lock("instance1", 10*time.Millisecond) {
+		t.Errorf("expected the released lock to be taken")
+	}
+
+	locks.unlock("instance1")
+	locks.unlock("instance2")
+	if len(locks.locks) != 0 {
+		t.Errorf("expected the released locks to be removed, got %d", len(locks.locks))
+	}
+}
+
+func TestInstanceLocksWaiter(t *testing.T) {
+	locks := newInstanceLocks()
+	locks.lock("instance1", time.Second)
+
+	// Act
+	done := make(chan bool)
+	go func() {
+		done <- locks.lock("instance1", time.Second)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	locks.unlock("instance1")
+
+	// Assert
+	if !<-done {
+		t.Errorf("expected the waiter to take the released lock")
+	}
+}
+
+// fakeAppLocks replaces the SQL Server application locks, keyed by server name and resource
+type fakeAppLocks struct {
+	mutex sync.Mutex
+	held  map[string]bool
+	// the keys of the taken locks, in order
+	acquired []string
+}
+
+func (locks *fakeAppLocks) acquire(server *mssqlServer, resource string, timeout time.Duration) (func(), error) {
+	locks.mutex.Lock()
+	defer locks.mutex.Unlock()
+
+	key := server.Name + "/" + resource
+	if locks.held[key] {
+		return nil, provisioner.ErrAppLockTimeout
+	}
+	locks.held[key] = true
+	locks.acquired = append(locks.acquired, key)
+	return func() {
+		locks.mutex.Lock()
+		defer locks.mutex.Unlock()
+		delete(locks.held, key)
+	}, nil
+}
+
+func useFakeAppLocks(t *testing.T) *fakeAppLocks {
+	fake := &fakeAppLocks{held: map[string]bool{}}
+	previousAcquire, previousConfig := acquireServerAppLock, brokerConfig
+	acquireServerAppLock = fake.acquire
+	brokerConfig = &config.Config{LockTimeoutSeconds: 1}
+	t.Cleanup(func() {
+		acquireServerAppLock, brokerConfig = previousAcquire, previousConfig
+	})
+	return fake
+}
+
+func TestLockInstanceAppLock(t *testing.T) {
+	fake := useFakeAppLocks(t)
+	sql1 := &mssqlServer{MssqlServer: config.MssqlServer{Name: "sql1"}}
+	sql2 := &mssqlServer{MssqlServer: config.MssqlServer{Name: "sql2"}}
+
+	// Act
+	server, unlock, err := lockInstance("instance1", "test", onServer(sql2))
+	heldOnInstanceServer := fake.held["sql2/"+instanceLockResource("instance1")]
+	heldOnOtherServer := fake.held["sql1/"+instanceLockResource("instance1")]
+	_, _, otherInstanceErr := lockInstance("instance2", "test", onServer(sql1))
+	unlock()
+	releasedOnServer := !fake.held["sql2/"+instanceLockResource("instance1")]
+
+	// Assert
+	if err != nil || server != sql2 {
+		t.Fatalf("expected the lock on the server of the instance, got %v, %v", server, err)
+	}
+	if !heldOnInstanceServer || heldOnOtherServer {
+		t.Errorf("expected the application lock only on the server of the instance, got %v", fake.held)
+	}
+	if otherInstanceErr != nil {
+		t.Errorf("expected the lock of another instance to be free, got %v", otherInstanceErr)
+	}
+	if !releasedOnServer {
+		t.Errorf("expected the application lock to be released")
+	}
+}
+
+func TestLockInstanceAppLockHeldByAnotherBroker(t *testing.T) {
+	fake := useFakeAppLocks(t)
+	sql1 := &mssqlServer{MssqlServer: config.MssqlServer{Name: "sql1"}}
+	fake.held["sql1/"+instanceLockResource("instance1")] = true
+
+	// Act
+	_, _, err := lockInstance("instance1", "test", onServer(sql1))
+	delete(fake.held, "sql1/"+instanceLockResource("instance1"))
+	_, unlock, retryErr := lockInstance("instance1", "test", onServer(sql1))
+
+	// Assert
+	if _, ok := err.(concurrencyError); !ok {
+		t.Errorf("expected a concurrencyError while another broker holds the lock, got %v", err)
+	}
+	if retryErr != nil {
+		t.Errorf("expected the process lock to be released after the timeout, got %v", retryErr)
+	} else {
+		unlock()
+	}
+}
+
+func TestLockInstanceWithoutServer(t *testing.T) {
+	fake := useFakeAppLocks(t)
+	targetErr := errors.New("no server available")
+
+	// Act
+	server, unlock, err := lockInstance("instance1", "test", func() (*mssqlServer, error) { return nil, nil })
+	_, _, lockedErr := lockInstance("instance1", "test", onServer(&mssqlServer{}))
+	unlock()
+	_, _, failedErr := lockInstance("instance1", "test", func() (*mssqlServer, error) { return nil, targetErr })
+	_, unlockAgain, retryErr := lockInstance("instance1", "test", func() (*mssqlServer, error) { return nil, nil })
+
+	// Assert
+	if err != nil || server != nil || len(fake.held) != 0 {
+		t.Errorf("expected only the process lock without a server, got %v, %v", err, fake.held)
+	}
+	if _, ok := lockedErr.(concurrencyError); !ok {
+		t.Errorf("expected the process lock to be held, got %v", lockedErr)
+	}
+	if failedErr != targetErr {
+		t.Errorf("expected the error of the target, got %v", failedErr)
+	}
+	if retryErr != nil {
+		t.Errorf("expected the process lock to be released after the target error, got %v", retryErr)
+	} else {
+		unlockAgain()
+	}
+}
+
+func TestLockNewInstance(t *testing.T) {
+	fake := useFakeAppLocks(t)
+	sql1 := &mssqlServer{MssqlServer: config.MssqlServer{Name: "sql1"}}
+	sql2 := &mssqlServer{MssqlServer: config.MssqlServer{Name: "sql2"}}
+	previousServers, previousLocks := mssqlServers, brokerLocks
+	// each plan is placed on another server, like two brokers that see different server usages
+	mssqlServers = &mssqlServerPool{
+		servers:     []*mssqlServer{sql1, sql2},
+		strategy:    planPinnedPlacement,
+		planServers: map[string][]string{"plan1": {"sql2"}, "plan2": {"sql1"}},
+	}
+	t.Cleanup(func() { mssqlServers, brokerLocks = previousServers, previousLocks })
+	resource := instanceLockResource("instance1")
+
+	// Act
+	server, unlock, err := lockNewInstance("instance1", "plan1")
+	firstAcquired := fake.acquired
+	fake.acquired = nil
+	// the other broker process has its own process locks
+	firstBrokerLocks := brokerLocks
+	brokerLocks = newInstanceLocks()
+	_, _, otherBrokerErr := lockNewInstance("instance1", "plan2")
+	otherBrokerAcquired := fake.acquired
+	brokerLocks = firstBrokerLocks
+	unlock()
+	releasedLocks := len(fake.held)
+	fake.acquired = nil
+	otherServer, otherUnlock, retryErr := lockNewInstance("instance1", "plan2")
+	retryAcquired := fake.acquired
+
+	// Assert
+	if err != nil || server != sql2 {
+		t.Fatalf("expected the placed server, got %v, %v", server, err)
+	}
+	if !reflect.DeepEqual(firstAcquired, []string{"sql1/" + resource, "sql2/" + resource}) {
+		t.Errorf("expected the lock on the first server before the placed server, got %v", firstAcquired)
+	}
+	if _, ok := otherBrokerErr.(concurrencyError); !ok {
+		t.Errorf("expected a concurrencyError for the provision placed on another server, got %v", otherBrokerErr)
+	}
+	if len(otherBrokerAcquired) != 0 {
+		t.Errorf("expected the other provision to wait for the lock on the first server, got %v", otherBrokerAcquired)
+	}
+	if releasedLocks != 0 {
+		t.Errorf("expected the locks of both servers to be released, got %v", fake.held)
+	}
+	if retryErr != nil || otherServer != sql1 || !reflect.DeepEqual(retryAcquired, []string{"sql1/" + resource}) {
+		t.Errorf("expected a single lock when the first server is placed, got %v, %v", retryAcquired, retryErr)
+	} else {
+		otherUnlock()
+	}
+}
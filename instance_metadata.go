@@ -0,0 +1,106 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-golang/lager"
+)
+
+// brokerVersion is set by the build, e.g. go build -ldflags "-X main.brokerVersion=1.2.0"
+var brokerVersion = "dev"
+
+// The extended properties of the databases and of the binding users (see provisioner.ExtendedPropertyPrefix)
+const (
+	organizationGuidProperty = "cf_organization_guid"
+	spaceGuidProperty        = "cf_space_guid"
+	serviceIdProperty        = "cf_service_id"
+	planIdProperty           = "cf_plan_id"
+	instanceIdProperty       = "cf_instance_id"
+	bindingIdProperty        = "cf_binding_id"
+	appGuidProperty          = "cf_app_guid"
+	createdAtProperty        = "cf_created_at"
+	updatedAtProperty        = "cf_updated_at"
+	brokerVersionProperty    = "cf_broker_version"
+	// When the password of the binding user was set by a bind or a rotation
+	passwordChangedAtProperty = "cf_password_changed_at"
+	// The kind, state and error of the last provision or deprovision (see LastOperation)
+	operationProperty      = "cf_operation"
+	operationStateProperty = "cf_operation_state"
+	operationErrorProperty = "cf_operation_error"
+)
+
+// The values are read back as nvarchar(4000), so they are truncated to 4000 UTF-16 code units
+const maxPropertyValueLength = 4000
+
+// propertyValues drops the properties that were not sent by the Cloud Controller,
+// and truncates the values that can not be read back
+func propertyValues(properties map[string]string) map[string]string {
+	for name, value := range properties {
+		if value == "" {
+			delete(properties, name)
+			continue
+		}
+		properties[name] = truncatePropertyValue(value)
+	}
+	return properties
+}
+
+// truncatePropertyValue keeps the first 4000 UTF-16 code units of the value, without splitting a character
+func truncatePropertyValue(value string) string {
+	length := 0
+	for i, r := range value {
+		// the characters outside of the basic multilingual plane are a surrogate pair
+		runeLength := 1
+		if r > 0xFFFF {
+			runeLength = 2
+		}
+		if length+runeLength > maxPropertyValueLength {
+			return value[:i]
+		}
+		length += runeLength
+	}
+	return value
+}
+
+func instanceProperties(instanceID string, details brokerapi.ServiceDetails, now time.Time) map[string]string {
+	return propertyValues(map[string]string{
+		organizationGuidProperty: details.OrganizationGUID,
+		spaceGuidProperty:        details.SpaceGUID,
+		serviceIdProperty:        details.ID,
+		planIdProperty:           details.PlanID,
+		instanceIdProperty:       instanceID,
+		createdAtProperty:        now.UTC().Format(time.RFC3339),
+		brokerVersionProperty:    brokerVersion,
+	})
+}
+
+func bindingProperties(instanceID, bindingID string, details BindDetails, now time.Time) map[string]string {
+	return propertyValues(map[string]string{
+		serviceIdProperty:         details.ServiceID,
+		planIdProperty:            details.PlanID,
+		instanceIdProperty:        instanceID,
+		bindingIdProperty:         bindingID,
+		appGuidProperty:           details.AppGUID,
+		createdAtProperty:         now.UTC().Format(time.RFC3339),
+		passwordChangedAtProperty: now.UTC().Format(time.RFC3339),
+		brokerVersionProperty:     brokerVersion,
+	})
+}
+
+// setDatabaseProperties stores the metadata of the instance on its database.
+// The metadata is informative, the operation does not fail if it can not be stored.
+func setDatabaseProperties(server *mssqlServer, databaseName string, properties map[string]string) {
+	err := server.provisioner.SetDatabaseProperties(databaseName, properties)
+	if err != nil {
+		logger.Error("set-database-properties-failed", err, lager.Data{"database": databaseName})
+	}
+}
+
+// setUserProperties stores the metadata of the binding on its user
+func setUserProperties(server *mssqlServer, databaseName, username string, properties map[string]string) {
+	err := server.provisioner.SetUserProperties(databaseName, username, properties)
+	if err != nil {
+		logger.Error("set-user-properties-failed", err, lager.Data{"database": databaseName, "user": username})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestInstanceProperties(t *testing.T) {
+	now := time.Date(2016, 3, 4, 5, 6, 7, 0, time.FixedZone("CET", 3600))
+	long := strings.Repeat("a", 5000)
+
+	cases := []struct {
+		name     string
+		details  brokerapi.ServiceDetails
+		expected map[string]string
+	}{
+		{
+			"all the details",
+			brokerapi.ServiceDetails{ID: "service1", PlanID: "plan1", OrganizationGUID: "org1", SpaceGUID: "space1"},
+			map[string]string{serviceIdProperty: "service1", planIdProperty: "plan1", organizationGuidProperty: "org1", spaceGuidProperty: "space1"},
+		},
+		{
+			"without the organization and space",
+			brokerapi.ServiceDetails{ID: "service1", PlanID: "plan1"},
+			map[string]string{serviceIdProperty: "service1", planIdProperty: "plan1"},
+		},
+		{
+			"values with sql and unicode characters are kept as they are",
+			brokerapi.ServiceDetails{ID: "service'; drop database master --", PlanID: "plan]1", SpaceGUID: "espace-é中"},
+			map[string]string{serviceIdProperty: "service'; drop database master --", planIdProperty: "plan]1", spaceGuidProperty: "espace-é中"},
+		},
+		{
+			"values over 4000 characters are truncated",
+			brokerapi.ServiceDetails{ID: "service1", OrganizationGUID: long},
+			map[string]string{serviceIdProperty: "service1", organizationGuidProperty: long[:4000]},
+		},
+	}
+
+	for _, c := range cases {
+		// Act
+		properties := instanceProperties("instance1", c.details, now)
+
+		// Assert
+		c.expected[instanceIdProperty] = "instance1"
+		c.expected[createdAtProperty] = "2016-03-04T04:06:07Z"
+		c.expected[brokerVersionProperty] = brokerVersion
+		if !reflect.DeepEqual(properties, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, properties)
+		}
+	}
+}
+
+func TestBindingProperties(t *testing.T) {
+	now := time.Date(2016, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	cases := []struct {
+		name     string
+		details  BindDetails
+		expected map[string]string
+	}{
+		{
+			"binding of an app",
+			BindDetails{AppGUID: "app1", PlanID: "plan1", ServiceID: "service1", Parameters: map[string]interface{}{"role": "db_datareader"}},
+			map[string]string{appGuidProperty: "app1", planIdProperty: "plan1", serviceIdProperty: "service1"},
+		},
+		{
+			"service key without an app",
+			BindDetails{PlanID: "plan1", ServiceID: "service1"},
+			map[string]string{planIdProperty: "plan1", serviceIdProperty: "service1"},
+		},
+		{
+			"quotes are kept as they are",
+			BindDetails{AppGUID: "app'1", PlanID: `plan"1`},
+			map[string]string{appGuidProperty: "app'1", planIdProperty: `plan"1`},
+		},
+	}
+
+	for _, c := range cases {
+		// Act
+		properties := bindingProperties("instance1", "binding1", c.details, now)
+
+		// Assert
+		c.expected[instanceIdProperty] = "instance1"
+		c.expected[bindingIdProperty] = "binding1"
+		c.expected[createdAtProperty] = "2016-03-04T05:06:07Z"
+		c.expected[passwordChangedAtProperty] = "2016-03-04T05:06:07Z"
+		c.expected[brokerVersionProperty] = brokerVersion
+		if !reflect.DeepEqual(properties, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, properties)
+		}
+	}
+}
+
+func TestTruncatePropertyValue(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected string
+	}{
+		{"", ""},
+		{strings.Repeat("a", 4000), strings.Repeat("a", 4000)},
+		{strings.Repeat("a", 4001), strings.Repeat("a", 4000)},
+		{strings.Repeat("é", 4001), strings.Repeat("é", 4000)},
+		// a character outside of the basic multilingual plane is 2 UTF-16 code units, it is not split
+		{strings.Repeat("a", 3999) + "😀", strings.Repeat("a", 3999)},
+		{strings.Repeat("a", 3998) + "😀b", strings.Repeat("a", 3998) + "😀"},
+	}
+
+	for _, c := range cases {
+		// Act
+		truncated := truncatePropertyValue(c.value)
+
+		// Assert
+		if truncated != c.expected {
+			t.Errorf("expected %d bytes for a value of %d bytes, got %d", len(c.expected), len(c.value), len(truncated))
+		}
+	}
+}
@@ -1,16 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"runtime"
 
 	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
 	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
-	"github.com/pivotal-cf/brokerapi"
 	"github.com/pivotal-golang/lager"
 )
 
@@ -42,10 +41,15 @@ const (
 )
 
 var configFile = flag.String("config", "", "Location of the Mssql Service Broker config json file")
+var checkConfig = flag.Bool("check-config", false, "Validate the config with the environment overrides, print every problem found, and exit")
+var printEffectiveConfig = flag.Bool("print-effective-config", false, "Print the config with the environment overrides, with the secrets redacted, and exit")
 var brokerConfig *config.Config
 
 var logger = lager.NewLogger("mssql-service-broker")
-var mssqlProv *provisioner.MssqlProvisioner
+var mssqlServers *mssqlServerPool
+
+// Sql template sets loaded from the sqlTemplatesFile, keyed by name
+var sqlTemplateSets map[string]*provisioner.SqlTemplateSet
 
 func getListeningAddr(config *config.Config) string {
 	// CF and Heroku will set this env var for their hosted apps
@@ -60,6 +64,19 @@ func getListeningAddr(config *config.Config) string {
 	return ":" + envPort
 }
 
+// loadSqlTemplates loads the sql templates file, the template sets of the plans are checked by Config.Validate
+func loadSqlTemplates(brokerConfig *config.Config) (map[string]*provisioner.SqlTemplateSet, error) {
+	if brokerConfig.SqlTemplatesFile == "" {
+		return map[string]*provisioner.SqlTemplateSet{}, nil
+	}
+	return provisioner.LoadSqlTemplates(brokerConfig.SqlTemplatesFile)
+}
+
+func init() {
+	// the settings compiled by the broker are checked with the config, e.g. by -check-config
+	config.BrokerChecks = append(config.BrokerChecks, checkIdentifierPattern, checkCredentialTemplates)
+}
+
 func getLogLevel(config *config.Config) lager.LogLevel {
 	var minLogLevel lager.LogLevel
 	switch config.LogLevel {
@@ -78,48 +95,115 @@ func getLogLevel(config *config.Config) lager.LogLevel {
 	return minLogLevel
 }
 
+// writeEffectiveConfig prints the merged config as json, with the passwords and secrets redacted
+func writeEffectiveConfig(writer io.Writer, brokerConfig *config.Config) error {
+	effective, err := json.MarshalIndent(brokerConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(redact(effective), '\n'))
+	return err
+}
+
 func runMain(writer io.Writer) {
 
 	if !flag.Parsed() {
 		flag.Parse()
 	}
 	var err error
-	brokerConfig, err = config.LoadFromFile(*configFile)
+	brokerConfig, err = config.Load(*configFile, os.Environ())
 
 	if err != nil {
 		panic(fmt.Errorf("configuration load error from file %s. Err: %s", *configFile, err))
 	}
 
-	logger.RegisterSink(lager.NewWriterSink(writer, getLogLevel(brokerConfig)))
+	if *printEffectiveConfig {
+		err = writeEffectiveConfig(writer, brokerConfig)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	err = brokerConfig.Validate()
+	if *checkConfig {
+		if err != nil {
+			fmt.Fprintf(writer, "%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(writer, "config is valid\n")
+		return
+	}
+	if err != nil {
+		panic(fmt.Errorf("configuration validation error for file %s. Err: %s", *configFile, err))
+	}
+
+	logger.RegisterSink(newRedactingSink(lager.NewWriterSink(writer, getLogLevel(brokerConfig))))
 
 	logger.Debug("config-load-success", lager.Data{"file-source": *configFile, "config": brokerConfig})
 
-	mssqlPars := brokerConfig.BrokerMssqlConnection
+	sqlTemplateSets, err = loadSqlTemplates(brokerConfig)
+	if err != nil {
+		logger.Fatal("invalid-sql-templates", err, lager.Data{"file": brokerConfig.SqlTemplatesFile})
+	}
+
+	err = setIdentifierPattern(brokerConfig.IdentifierPattern)
+	if err != nil {
+		logger.Fatal("invalid-identifier-pattern", err)
+	}
 
-	// set default sql driver if it is not set based on the OS
-	if _, ok := mssqlPars["driver"]; !ok && brokerConfig.BrokerGoSqlDriver == "odbc" {
-		if runtime.GOOS != "windows" {
-			mssqlPars["driver"] = "freetds"
-		} else {
-			mssqlPars["driver"] = "sql server"
-		}
+	err = setCredentialTemplates(brokerConfig.BindingCredentialTemplates)
+	if err != nil {
+		logger.Fatal("invalid-binding-credential-templates", err)
 	}
 
-	mssqlProv = provisioner.NewMssqlProvisioner(logger, brokerConfig.BrokerGoSqlDriver, mssqlPars)
-	err = mssqlProv.Init()
+	mssqlServers, err = newMssqlServerPool(logger, brokerConfig.Servers(), brokerConfig.PlacementStrategy, brokerConfig.PlanServers)
+	if err != nil {
+		logger.Fatal("invalid-server-pool", err)
+	}
+
+	mssqlServers.observeSqlCalls()
+
+	err = mssqlServers.Init()
 	if err != nil {
 		logger.Fatal("error-initializing-provisioner", err)
 	}
 
-	serviceBroker := &mssqlServiceBroker{}
+	if brokerConfig.SoftDelete.Enabled {
+		startTombstoneReaper(mssqlServers, brokerConfig.SoftDelete, logger)
+	}
+
+	if brokerConfig.Quotas.ScanAction != "" {
+		startQuotaScanner(mssqlServers, brokerConfig.Quotas, logger)
+	}
 
-	brokerAPI := brokerapi.New(serviceBroker, logger, brokerConfig.Crednetials)
-	http.Handle("/", brokerAPI)
+	serviceBroker := newMssqlServiceBroker()
+
+	brokerAPI := newBrokerHandler(serviceBroker, logger, brokerConfig.Crednetials)
+	http.Handle("/", instrumentHandler(requireClientCertificate(brokerConfig.Https, brokerAPI)))
+	http.HandleFunc("/healthz", healthz)
+	http.Handle("/readyz", readyz(mssqlServers, logger))
+	http.Handle("/admin/", instrumentHandler(requireClientCertificate(brokerConfig.Https, newAdminHandler(serviceBroker, logger, brokerConfig.Crednetials))))
+
+	if brokerConfig.MetricsListeningAddr != "" {
+		startMetricsListener(brokerConfig.MetricsListeningAddr, mssqlServers, logger)
+	}
 
 	addr := getListeningAddr(brokerConfig)
-	logger.Info("start-listening", lager.Data{"addr": addr})
+	server := &http.Server{Addr: addr, Handler: exitOnPanicWrapper{http.DefaultServeMux}}
+
+	if httpsEnabled(brokerConfig.Https) {
+		server.TLSConfig, err = newTlsConfig(brokerConfig.Https, logger)
+		if err != nil {
+			logger.Fatal("invalid-https", err)
+		}
 
-	err = http.ListenAndServe(addr, exitOnPanicWrapper{http.DefaultServeMux})
+		logger.Info("start-listening", lager.Data{"addr": addr, "https": true, "clientCertificates": brokerConfig.Https.ClientCaFile != ""})
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		logger.Info("start-listening", lager.Data{"addr": addr})
+		err = server.ListenAndServe()
+	}
 	if err != nil {
 		logger.Fatal("error-listening", err)
 	}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The metrics are written in the Prometheus text exposition format (version 0.0.4).
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Buckets of the duration histograms, in seconds
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metricSeries is the key of a series in a vector, the label values joined with a separator
+// that can not be in the label values of the broker
+func metricSeries(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (counter *counterVec) add(value float64, labelValues ...string) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counter.values[metricSeries(labelValues)] += value
+}
+
+func (counter *counterVec) write(w io.Writer) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	writeMetricHeader(w, counter.name, counter.help, "counter")
+	for _, series := range sortedSeries(counter.values) {
+		writeSample(w, counter.name, counter.labels, strings.Split(series, "\xff"), counter.values[series])
+	}
+}
+
+type histogram struct {
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mutex  sync.Mutex
+	series map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (vec *histogramVec) observe(value float64, labelValues ...string) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+
+	key := metricSeries(labelValues)
+	h, ok := vec.series[key]
+	if !ok {
+		h = &histogram{bucketCounts: make([]uint64, len(vec.buckets))}
+		vec.series[key] = h
+	}
+
+	for i, bound := range vec.buckets {
+		if value <= bound {
+			h.bucketCounts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func (vec *histogramVec) write(w io.Writer) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+
+	writeMetricHeader(w, vec.name, vec.help, "histogram")
+
+	keys := []string{}
+	for key := range vec.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	bucketLabels := append(append([]string{}, vec.labels...), "le")
+	for _, key := range keys {
+		h := vec.series[key]
+		labelValues := strings.Split(key, "\xff")
+
+		for i, bound := range vec.buckets {
+			writeSample(w, vec.name+"_bucket", bucketLabels, append(append([]string{}, labelValues...), formatMetricValue(bound)), float64(h.bucketCounts[i]))
+		}
+		writeSample(w, vec.name+"_bucket", bucketLabels, append(append([]string{}, labelValues...), "+Inf"), float64(h.count))
+		writeSample(w, vec.name+"_sum", vec.labels, labelValues, h.sum)
+		writeSample(w, vec.name+"_count", vec.labels, labelValues, float64(h.count))
+	}
+}
+
+// collectedSample is a value collected when the metrics are scraped
+type collectedSample struct {
+	labelValues []string
+	value       float64
+}
+
+func writeCollected(w io.Writer, name, help, metricType string, labels []string, samples []collectedSample) {
+	writeMetricHeader(w, name, help, metricType)
+	for _, sample := range samples {
+		writeSample(w, name, labels, sample.labelValues, sample.value)
+	}
+}
+
+func sortedSeries(values map[string]float64) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeMetricHeader(w io.Writer, name, help, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, escapeMetricHelp(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+func writeSample(w io.Writer, name string, labels []string, labelValues []string, value float64) {
+	pairs := []string{}
+	for i, label := range labels {
+		if i < len(labelValues) {
+			pairs = append(pairs, label+"=\""+escapeMetricLabel(labelValues[i])+"\"")
+		}
+	}
+
+	if len(pairs) == 0 {
+		fmt.Fprintf(w, "%s %s\n", name, formatMetricValue(value))
+	} else {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(pairs, ","), formatMetricValue(value))
+	}
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeMetricLabel(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+}
+
+func escapeMetricHelp(help string) string {
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(help)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHistogramExposition(t *testing.T) {
+	histogram := newHistogramVec("test_duration_seconds", "Test durations.", []float64{0.1, 1}, "operation")
+	histogram.observe(0.05, "bind")
+	histogram.observe(0.5, "bind")
+	histogram.observe(5, "bind")
+
+	// Act
+	var metrics bytes.Buffer
+	histogram.write(&metrics)
+
+	// Assert
+	expected := `# HELP test_duration_seconds Test durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{operation="bind",le="0.1"} 1
+test_duration_seconds_bucket{operation="bind",le="1"} 2
+test_duration_seconds_bucket{operation="bind",le="+Inf"} 3
+test_duration_seconds_sum{operation="bind"} 5.55
+test_duration_seconds_count{operation="bind"} 3
+`
+	if metrics.String() != expected {
+		t.Errorf("unexpected exposition:\n%s", metrics.String())
+	}
+}
+
+func TestCounterExpositionEscapesLabels(t *testing.T) {
+	counter := newCounterVec("test_total", "Test counter.", "server", "template")
+	counter.add(1, "sql\"1\\", "isUserCreated")
+	counter.add(2, "sql\"1\\", "isUserCreated")
+
+	// Act
+	var metrics bytes.Buffer
+	counter.write(&metrics)
+
+	// Assert
+	if !strings.Contains(metrics.String(), "test_total{server=\"sql\\\"1\\\\\",template=\"isUserCreated\"} 3\n") {
+		t.Errorf("unexpected exposition:\n%s", metrics.String())
+	}
+}
+
+func TestBrokerOperation(t *testing.T) {
+	operations := map[string]string{
+		"GET /v2/catalog":                                             "catalog",
+		"PUT /v2/service_instances/i1":                                "provision",
+		"PATCH /v2/service_instances/i1":                              "update",
+		"DELETE /v2/service_instances/i1":                             "deprovision",
+		"GET /v2/service_instances/i1/last_operation":                 "last_operation",
+		"PUT /v2/service_instances/i1/service_bindings/b1":            "bind",
+		"DELETE /v2/service_instances/i1/service_bindings/b1":         "unbind",
+		"POST /admin/service_instances/i1/service_bindings/b1/rotate": "rotate_binding",
+		"GET /admin/service_instances/i1":                             "get_instance",
+		"GET /admin/stale_bindings":                                   "stale_bindings",
+		"GET /admin/quota_violations":                                 "quota_violations",
+		"GET /v2/service_instances/i1":                                "other",
+		"GET /favicon.ico":                                            "other",
+	}
+
+	for request, expected := range operations {
+		parts := strings.SplitN(request, " ", 2)
+
+		// Act
+		operation := brokerOperation(parts[0], parts[1])
+
+		// Assert
+		if operation != expected {
+			t.Errorf("expected %s for %s, got %s", expected, request, operation)
+		}
+	}
+}
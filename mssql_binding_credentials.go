@@ -1,15 +1,26 @@
 package main
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
 
-type MssqlBindingCredentials struct {
-	Hostname         string `json:"hostname"`
-	Host             string `json:"host"`
-	Port             int    `json:"port"`
-	Name             string `json:"name"`
-	Username         string `json:"username"`
-	Password         string `json:"password"`
-	ConnectionString string `json:"connectionString"`
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+)
+
+// credentialTemplateData are the values of a binding printed by the credential templates
+type credentialTemplateData struct {
+	Hostname string
+	Port     int
+	Name     string
+	Username string
+	Password string
+	// The tls settings of the server
+	Encrypt                bool
+	TrustServerCertificate bool
+	HostNameInCertificate  string
 }
 
 // References for connection strings:
@@ -17,11 +28,174 @@ type MssqlBindingCredentials struct {
 // http://www.mono-project.com/docs/database-access/providers/sqlclient/
 // http://freetds.schemamania.org/userguide/odbcconnattr.htm
 // https://msdn.microsoft.com/en-us/library/ms130822.aspx
-// This should be compatible with ADO.NET Sql connection string format.
+// https://docs.microsoft.com/en-us/sql/connect/jdbc/building-the-connection-url
+// https://github.com/denisenkom/go-mssqldb#connection-parameters-and-dsn
+// The connectionString should be compatible with ADO.NET Sql connection string format.
 // Also if posible, use only the subset that is also compatible with ODBC, FreeTds, and OleDb connection string.
-// fmt template parameters: 1.address, 2.port, 3.database name, 4.username, 5. password
-var connectionStringTemplate = "Address=%[1]v,%[2]v;Database=%[3]v;UID=%[4]v;PWD=%[5]v;"
+var defaultCredentialTemplates = map[string]string{
+	"connectionString": "Address={{.Hostname}},{{.Port}};Database={{ado .Name}};UID={{ado .Username}};PWD={{ado .Password}};" +
+		"{{if .Encrypt}}Encrypt=true;{{end}}{{if .TrustServerCertificate}}TrustServerCertificate=true;{{end}}{{with .HostNameInCertificate}}HostNameInCertificate={{ado .}};{{end}}",
+	"uri": "sqlserver://{{userinfo .Username .Password}}@{{.Hostname}}:{{.Port}}?database={{query .Name}}" +
+		"{{if .Encrypt}}&encrypt=true{{end}}{{if .TrustServerCertificate}}&trustservercertificate=true{{end}}{{with .HostNameInCertificate}}&hostnameincertificate={{query .}}{{end}}",
+	"jdbcUrl": "jdbc:sqlserver://{{.Hostname}}:{{.Port}};databaseName={{jdbc .Name}};user={{jdbc .Username}};password={{jdbc .Password}};" +
+		"{{if .Encrypt}}encrypt=true;{{end}}{{if .TrustServerCertificate}}trustServerCertificate=true;{{end}}{{with .HostNameInCertificate}}hostNameInCertificate={{jdbc .}};{{end}}",
+	"odbcConnectionString": "Driver={ODBC Driver 17 for SQL Server};Server=tcp:{{.Hostname}},{{.Port}};Database={{odbc .Name}};Uid={{odbc .Username}};Pwd={{odbc .Password}};" +
+		"{{if .Encrypt}}Encrypt=yes;{{end}}{{if .TrustServerCertificate}}TrustServerCertificate=yes;{{end}}{{with .HostNameInCertificate}}HostnameInCertificate={{odbc .}};{{end}}",
+	"goMssqlDsn": "server={{.Hostname}};port={{.Port}};database={{ado .Name}};user id={{ado .Username}};password={{ado .Password}}" +
+		"{{if .Encrypt}};encrypt=true{{end}}{{if .TrustServerCertificate}};trustservercertificate=true{{end}}{{with .HostNameInCertificate}};hostnameincertificate={{ado .}}{{end}}",
+}
+
+// The fixed fields of the binding credentials, they can not be replaced by a template
+var fixedCredentialFields = []string{"hostname", "host", "port", "name", "username", "password", "encrypt", "trustServerCertificate", "caCertificate"}
+
+// The escaping functions of the credential templates, for the values of each format
+var credentialTemplateFuncs = template.FuncMap{
+	"ado":      adoValue,
+	"odbc":     bracedValue,
+	"jdbc":     bracedValue,
+	"query":    url.QueryEscape,
+	"userinfo": func(username, password string) string { return url.UserPassword(username, password).String() },
+}
+
+var credentialTemplates = mustCompileCredentialTemplates(defaultCredentialTemplates)
+
+// adoValue quotes a value of an ADO.NET or go-mssqldb connection string
+// when it has a separator, a quote or surrounding spaces
+func adoValue(value string) string {
+	if !strings.ContainsAny(value, `;'"`) && strings.TrimSpace(value) == value {
+		return value
+	}
+	return `"` + strings.Replace(value, `"`, `""`, -1) + `"`
+}
+
+// bracedValue encloses a value of an ODBC connection string or a JDBC url in braces
+// when it has a separator, a brace or surrounding spaces
+func bracedValue(value string) string {
+	if !strings.ContainsAny(value, ";{}") && strings.TrimSpace(value) == value {
+		return value
+	}
+	return "{" + strings.Replace(value, "}", "}}", -1) + "}"
+}
+
+func compileCredentialTemplates(sources map[string]string) (map[string]*template.Template, error) {
+	compiled := map[string]*template.Template{}
+	for name, source := range sources {
+		parsed, err := template.New(name).Funcs(credentialTemplateFuncs).Parse(source)
+		if err != nil {
+			return nil, err
+		}
+		compiled[name] = parsed
+	}
+	return compiled, nil
+}
+
+func mustCompileCredentialTemplates(sources map[string]string) map[string]*template.Template {
+	compiled, err := compileCredentialTemplates(sources)
+	if err != nil {
+		panic(err)
+	}
+	return compiled
+}
+
+// setCredentialTemplates adds the configured templates to the built-in ones, or replaces them.
+// A template set to "" removes the built-in credential of the same name.
+func setCredentialTemplates(overrides map[string]string) error {
+	compiled, err := compileConfiguredCredentialTemplates(overrides)
+	if err != nil {
+		return err
+	}
+	credentialTemplates = compiled
+	return nil
+}
+
+// checkCredentialTemplates is the config.BrokerChecks of the bindingCredentialTemplates
+func checkCredentialTemplates(brokerConfig *config.Config) []string {
+	if _, err := compileConfiguredCredentialTemplates(brokerConfig.BindingCredentialTemplates); err != nil {
+		return []string{err.Error()}
+	}
+	return nil
+}
+
+func compileConfiguredCredentialTemplates(overrides map[string]string) (map[string]*template.Template, error) {
+	sources := map[string]string{}
+	for name, source := range defaultCredentialTemplates {
+		sources[name] = source
+	}
+
+	for name, source := range overrides {
+		for _, field := range fixedCredentialFields {
+			if name == field {
+				return nil, fmt.Errorf("invalid bindingCredentialTemplates: %q is a fixed field of the credentials", name)
+			}
+		}
+
+		if source == "" {
+			delete(sources, name)
+			continue
+		}
+		sources[name] = source
+	}
+
+	compiled, err := compileCredentialTemplates(sources)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bindingCredentialTemplates: %v", err)
+	}
+
+	// render sample values, so the templates that can not print the fields fail at startup
+	for _, tmpl := range compiled {
+		_, err = renderCredentialTemplate(tmpl, credentialTemplateData{Hostname: "host", Port: 1433, Name: "db", Username: "user", Password: "pw", HostNameInCertificate: "host"})
+		if err != nil {
+			return nil, fmt.Errorf("invalid bindingCredentialTemplates: %v", err)
+		}
+	}
+
+	return compiled, nil
+}
+
+func renderCredentialTemplate(tmpl *template.Template, data credentialTemplateData) (string, error) {
+	var rendered bytes.Buffer
+	err := tmpl.Execute(&rendered, data)
+	return rendered.String(), err
+}
+
+// newMssqlBindingCredentials returns the fixed fields of the binding, and the connection strings
+// of the credential templates, e.g. connectionString, uri and jdbcUrl.
+// The tls settings of the server are added to all of them, with the PEM of its CA certificates.
+func newMssqlBindingCredentials(server *mssqlServer, databaseName string, username string, password string) (map[string]interface{}, error) {
+	data := credentialTemplateData{
+		Hostname: server.ServedBindingHostname,
+		Port:     server.ServedBindingPort,
+		Name:     databaseName,
+		Username: username,
+		Password: password,
+
+		Encrypt:                server.Tls.Encrypt,
+		TrustServerCertificate: server.Tls.TrustServerCertificate,
+		HostNameInCertificate:  server.Tls.HostNameInCertificate,
+	}
+
+	credentials := map[string]interface{}{
+		"hostname": data.Hostname,
+		"host":     data.Hostname,
+		"port":     data.Port,
+		"name":     data.Name,
+		"username": data.Username,
+		"password": data.Password,
+
+		"encrypt":                data.Encrypt,
+		"trustServerCertificate": data.TrustServerCertificate,
+	}
+	if server.caCertificate != "" {
+		credentials["caCertificate"] = server.caCertificate
+	}
+
+	for name, tmpl := range credentialTemplates {
+		value, err := renderCredentialTemplate(tmpl, data)
+		if err != nil {
+			return nil, fmt.Errorf("credential template %s: %v", name, err)
+		}
+		credentials[name] = value
+	}
 
-func generateConnectionString(hostname string, port int, databaseName string, username string, password string) string {
-	return fmt.Sprintf(connectionStringTemplate, hostname, port, databaseName, username, password)
+	return credentials, nil
 }
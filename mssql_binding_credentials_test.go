@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+)
+
+func TestNewMssqlBindingCredentials(t *testing.T) {
+	server := &mssqlServer{MssqlServer: config.MssqlServer{ServedBindingHostname: "sql.example.com", ServedBindingPort: 1433}}
+
+	// Act
+	credentials, err := newMssqlBindingCredentials(server, "cf-instance1", "cf-instance1-binding1", "p;w'{d}\"@/=")
+
+	// Assert
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"hostname":             "sql.example.com",
+		"port":                 1433,
+		"connectionString":     `Address=sql.example.com,1433;Database=cf-instance1;UID=cf-instance1-binding1;PWD="p;w'{d}""@/=";`,
+		"jdbcUrl":              "jdbc:sqlserver://sql.example.com:1433;databaseName=cf-instance1;user=cf-instance1-binding1;password={p;w'{d}}\"@/=};",
+		"odbcConnectionString": "Driver={ODBC Driver 17 for SQL Server};Server=tcp:sql.example.com,1433;Database=cf-instance1;Uid=cf-instance1-binding1;Pwd={p;w'{d}}\"@/=};",
+		"goMssqlDsn":           `server=sql.example.com;port=1433;database=cf-instance1;user id=cf-instance1-binding1;password="p;w'{d}""@/="`,
+	}
+	for name, value := range expected {
+		if credentials[name] != value {
+			t.Errorf("expected %s %v, got %v", name, value, credentials[name])
+		}
+	}
+
+	uri, err := url.Parse(credentials["uri"].(string))
+	if err != nil {
+		t.Fatalf("invalid uri %v: %v", credentials["uri"], err)
+	}
+	password, _ := uri.User.Password()
+	if uri.Scheme != "sqlserver" || uri.Host != "sql.example.com:1433" || uri.User.Username() != "cf-instance1-binding1" || password != "p;w'{d}\"@/=" || uri.Query().Get("database") != "cf-instance1" {
+		t.Errorf("unexpected uri %v", credentials["uri"])
+	}
+}
+
+func TestSetCredentialTemplates(t *testing.T) {
+	defer func() {
+		credentialTemplates = mustCompileCredentialTemplates(defaultCredentialTemplates)
+	}()
+
+	// Act
+	err := setCredentialTemplates(map[string]string{"jdbcUrl": "", "dotnet": "Server={{.Hostname}};Password={{ado .Password}}"})
+	fixedErr := setCredentialTemplates(map[string]string{"password": "{{.Password}}"})
+	unknownErr := setCredentialTemplates(map[string]string{"dsn": "{{.Database}}"})
+
+	// Assert
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if fixedErr == nil || unknownErr == nil {
+		t.Errorf("expected errors for the invalid templates, got %v, %v", fixedErr, unknownErr)
+	}
+
+	server := &mssqlServer{MssqlServer: config.MssqlServer{ServedBindingHostname: "sql.example.com", ServedBindingPort: 1433}}
+	credentials, _ := newMssqlBindingCredentials(server, "cf-instance1", "cf-instance1-binding1", "pw")
+	if _, ok := credentials["jdbcUrl"]; ok {
+		t.Errorf("expected the jdbcUrl to be removed")
+	}
+	if credentials["dotnet"] != "Server=sql.example.com;Password=pw" || credentials["uri"] == nil {
+		t.Errorf("unexpected credentials %v", credentials)
+	}
+}
+
+func TestMssqlBindingCredentialsTls(t *testing.T) {
+	server := &mssqlServer{
+		MssqlServer: config.MssqlServer{
+			ServedBindingHostname: "10.0.0.93",
+			ServedBindingPort:     1433,
+			Tls:                   config.TlsSettings{Encrypt: true, HostNameInCertificate: "sql.example.com"},
+		},
+		caCertificate: "-----BEGIN CERTIFICATE-----",
+	}
+
+	// Act
+	credentials, err := newMssqlBindingCredentials(server, "db", "user", "pw")
+
+	// Assert
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"encrypt":                true,
+		"trustServerCertificate": false,
+		"caCertificate":          "-----BEGIN CERTIFICATE-----",
+		"connectionString":       "Address=10.0.0.93,1433;Database=db;UID=user;PWD=pw;Encrypt=true;HostNameInCertificate=sql.example.com;",
+		"uri":                    "sqlserver://user:pw@10.0.0.93:1433?database=db&encrypt=true&hostnameincertificate=sql.example.com",
+		"jdbcUrl":                "jdbc:sqlserver://10.0.0.93:1433;databaseName=db;user=user;password=pw;encrypt=true;hostNameInCertificate=sql.example.com;",
+		"odbcConnectionString":   "Driver={ODBC Driver 17 for SQL Server};Server=tcp:10.0.0.93,1433;Database=db;Uid=user;Pwd=pw;Encrypt=yes;HostnameInCertificate=sql.example.com;",
+		"goMssqlDsn":             "server=10.0.0.93;port=1433;database=db;user id=user;password=pw;encrypt=true;hostnameincertificate=sql.example.com",
+	}
+	for name, value := range expected {
+		if credentials[name] != value {
+			t.Errorf("expected %s %v, got %v", name, value, credentials[name])
+		}
+	}
+}
+
+func TestWithTlsConnectionParams(t *testing.T) {
+	settings := config.TlsSettings{Encrypt: true, TrustServerCertificate: true}
+
+	// Act
+	mssqlParams := withTlsConnectionParams("mssql", map[string]string{"server": "10.0.0.93", "Encrypt": "false"}, settings)
+	odbcParams := withTlsConnectionParams("odbc", map[string]string{"driver": "{ODBC Driver 17 for SQL Server}"}, settings)
+	freetdsParams := withTlsConnectionParams("odbc", map[string]string{"driver": "freetds"}, settings)
+
+	// Assert
+	if len(mssqlParams) != 3 || mssqlParams["Encrypt"] != "false" || mssqlParams["trustservercertificate"] != "true" {
+		t.Errorf("expected the configured encrypt to be kept, got %v", mssqlParams)
+	}
+	if odbcParams["encrypt"] != "yes" || odbcParams["trustservercertificate"] != "yes" {
+		t.Errorf("unexpected odbc params %v", odbcParams)
+	}
+	if len(freetdsParams) != 2 || freetdsParams["encryption"] != "require" {
+		t.Errorf("unexpected freetds params %v", freetdsParams)
+	}
+}
+
+func TestConfigValidateCredentialTemplates(t *testing.T) {
+	// Act
+	err := (&config.Config{BindingCredentialTemplates: map[string]string{"password": "{{.Password}}", "dsn": "{{.Database}}"}}).Validate()
+
+	// Assert
+	if err == nil || !strings.Contains(err.Error(), "invalid bindingCredentialTemplates") {
+		t.Errorf("expected the bindingCredentialTemplates to be checked with the config, got %v", err)
+	}
+}
@@ -3,6 +3,11 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
 	"github.com/pivotal-cf/brokerapi"
 	"github.com/pivotal-golang/lager"
 )
@@ -28,136 +33,625 @@ func secureRandomString(bytesOfEntpry int) string {
 	return base64.URLEncoding.EncodeToString(rb)
 }
 
-type mssqlServiceBroker struct{}
+// brokerError maps a provisioner error to the error returned to the brokerapi.
+// Conflict and not-found errors are translated to the given brokerapi errors (if not nil),
+// so that the Cloud Controller gets a 409 or 410 instead of a 500.
+// Only fatal errors, that can leave the sql driver in a corrupted state,
+// will crash the process (see exitOnPanicWrapper).
+func brokerError(err error, conflictErr error, notFoundErr error) error {
+	class := provisioner.ClassifyError(err)
+
+	logger.Error("provisioner-error", err, lager.Data{"errorClass": class.String()})
+
+	switch class {
+	case provisioner.FatalError:
+		logger.Fatal("provisioner-fatal-error", err)
+	case provisioner.TransientError:
+		return fmt.Errorf("Transient SQL Server error, retry the operation later: %v", err)
+	case provisioner.ConflictError:
+		if conflictErr != nil {
+			return conflictErr
+		}
+	case provisioner.NotFoundError:
+		if notFoundErr != nil {
+			return notFoundErr
+		}
+	}
+
+	return fmt.Errorf("SQL Server error: %v", err)
+}
+
+type mssqlServiceBroker struct {
+	operations *asyncOperations
+}
+
+func newMssqlServiceBroker() *mssqlServiceBroker {
+	return &mssqlServiceBroker{
+		operations: newAsyncOperations(),
+	}
+}
 
 func (*mssqlServiceBroker) Services() []brokerapi.Service {
 	// Return a []brokerapi.Service here, describing your service(s) and plan(s)
 	logger.Info("catalog-called")
 
+	services := []brokerapi.Service{}
+	for _, service := range brokerConfig.ServiceCatalog {
+		services = append(services, service.Service)
+	}
+	return services
+}
+
+// Catalog returns the service catalog with the fields not supported by brokerapi.Service (e.g. plan_updateable)
+func (*mssqlServiceBroker) Catalog() []config.Service {
+	logger.Info("catalog-called")
+
 	return brokerConfig.ServiceCatalog
 }
 
-func (*mssqlServiceBroker) Provision(instanceID string, serviceDetails brokerapi.ServiceDetails) error {
+func (broker *mssqlServiceBroker) Provision(instanceID string, serviceDetails brokerapi.ServiceDetails) error {
+	return broker.ProvisionWithParameters(instanceID, ProvisionDetails{ServiceDetails: serviceDetails})
+}
+
+func (*mssqlServiceBroker) ProvisionWithParameters(instanceID string, details ProvisionDetails) error {
 	// Provision a new instance here
-	logger.Info("provision-called", lager.Data{"instanceId": instanceID, "serviceDetails": serviceDetails})
+	logger.Info("provision-called", lager.Data{"instanceId": instanceID, "details": details})
+
+	if err := validateIdentifier("instance", instanceID); err != nil {
+		return err
+	}
 
 	databaseName := brokerConfig.DbIdentifierPrefix + instanceID
 
-	exist, err := mssqlProv.IsDatabaseCreated(databaseName)
+	settings, err := planDatabaseSettings(details.PlanID, details.Parameters)
 	if err != nil {
-		logger.Fatal("provisioner-error", err)
+		return err
 	}
 
-	if exist {
+	server, unlock, err := lockNewInstance(instanceID, details.PlanID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	existing, err := mssqlServers.Locate(databaseName)
+	if err != nil {
+		return brokerError(err, nil, nil)
+	}
+
+	if existing != nil {
+		return brokerapi.ErrInstanceAlreadyExists
+	}
+
+	unlockLimits, err := checkInstanceLimits(details.PlanID)
+	if err != nil {
+		return err
+	}
+	defer unlockLimits()
+
+	return createDatabase(server, databaseName, details.PlanID, settings, instanceProperties(instanceID, details.ServiceDetails, time.Now()))
+}
+
+// ProvisionAsync checks the request and creates the database in a background worker.
+// The progress is reported by LastOperation.
+func (broker *mssqlServiceBroker) ProvisionAsync(instanceID string, details ProvisionDetails) error {
+	logger.Info("provision-async-called", lager.Data{"instanceId": instanceID, "details": details})
+
+	if err := validateIdentifier("instance", instanceID); err != nil {
+		return err
+	}
+
+	databaseName := brokerConfig.DbIdentifierPrefix + instanceID
+
+	settings, err := planDatabaseSettings(details.PlanID, details.Parameters)
+	if err != nil {
+		return err
+	}
+
+	if op, ok := broker.operations.get(instanceID); ok && op.inProgress && op.kind == provisionOperation {
+		return nil
+	}
+
+	server, unlock, err := lockNewInstance(instanceID, details.PlanID)
+	if err != nil {
+		return err
+	}
+
+	existing, err := mssqlServers.Locate(databaseName)
+	if err != nil {
+		unlock()
+		return brokerError(err, nil, nil)
+	}
+
+	if existing != nil {
+		unlock()
 		return brokerapi.ErrInstanceAlreadyExists
 	}
 
-	err = mssqlProv.CreateDatabase(databaseName)
+	unlockLimits, err := checkInstanceLimits(details.PlanID)
 	if err != nil {
-		logger.Fatal("provisioner-error", err)
+		unlock()
+		return err
 	}
 
+	// the worker releases the locks of the instance and of the limits when the database is created
+	started := broker.operations.start(instanceID, provisionOperation, func() error {
+		defer unlock()
+		defer unlockLimits()
+		err := createDatabase(server, databaseName, details.PlanID, settings, instanceProperties(instanceID, details.ServiceDetails, time.Now()))
+		if err != nil {
+			logger.Error("provision-async-failed", err, lager.Data{"instanceId": instanceID})
+		}
+		return err
+	})
+	if !started {
+		unlockLimits()
+		unlock()
+		return concurrencyError{fmt.Errorf("Another operation is in progress for instance %s", instanceID)}
+	}
+
+	return nil
+}
+
+// createDatabase creates the new database on the server placed for it (see lockNewInstance),
+// and stores the metadata of the instance as extended properties of the database.
+// The provision succeeds only when the properties are stored: LastOperation reports
+// a database without the provision state as an interrupted provision.
+func createDatabase(server *mssqlServer, databaseName string, planID string, settings provisioner.DatabaseSettings, properties map[string]string) error {
+	err := server.provisioner.WithTemplates(planSqlTemplates(planID)).CreateDatabase(databaseName, settings)
+	if err != nil {
+		if provisioner.ClassifyError(err) != provisioner.ConflictError {
+			recordOperationFailure(server, databaseName, provisionOperation, err)
+		}
+		return brokerError(err, brokerapi.ErrInstanceAlreadyExists, nil)
+	}
+
+	mssqlServers.remember(databaseName, server)
+
+	properties[operationProperty] = provisionOperation
+	properties[operationStateProperty] = operationSucceeded
+	err = server.provisioner.SetDatabaseProperties(databaseName, properties)
+	if err != nil {
+		recordOperationFailure(server, databaseName, provisionOperation, err)
+		return brokerError(err, nil, nil)
+	}
+	return nil
+}
+
+// Update applies the settings of the new plan, and the update parameters, to an existing database
+func (*mssqlServiceBroker) Update(instanceID string, details UpdateDetails) error {
+	logger.Info("update-called", lager.Data{"instanceId": instanceID, "details": details})
+
+	if validateIdentifier("instance", instanceID) != nil {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+
+	databaseName := brokerConfig.DbIdentifierPrefix + instanceID
+
+	if details.PlanID != "" && details.PlanID != details.PreviousValues.PlanID {
+		service, ok := findService(details.ServiceID)
+		if !ok {
+			return updateNotSupportedError{fmt.Errorf("unknown service %q", details.ServiceID)}
+		}
+		if !service.PlanUpdateable {
+			return updateNotSupportedError{fmt.Errorf("the plan of service %q can not be changed", service.Name)}
+		}
+	}
+
+	planID := details.PlanID
+	if planID == "" {
+		planID = details.PreviousValues.PlanID
+	}
+
+	settings, err := planUpdateSettings(planID, details.Parameters)
+	if err != nil {
+		return err
+	}
+
+	server, unlock, err := lockInstance(instanceID, "update", locateInstance(databaseName))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if server == nil {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+
+	// a read-only database can only be updated to a plan whose quota fits its data
+	err = checkQuotaRestriction(server, databaseName)
+	if _, ok := err.(quotaExceededError); ok && planID != details.PreviousValues.PlanID {
+		err = unrestrictForPlan(server, databaseName, planID)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the settings that the new plan leaves unset are reset, not kept from the previous plan
+	planChanged := planID != details.PreviousValues.PlanID
+	err = server.provisioner.UpdateDatabase(databaseName, settings, planChanged)
+	if err != nil {
+		if tooLargeErr, ok := err.(*provisioner.DatabaseTooLargeError); ok {
+			return updateNotSupportedError{tooLargeErr}
+		}
+		return brokerError(err, nil, brokerapi.ErrInstanceDoesNotExist)
+	}
+
+	properties := map[string]string{updatedAtProperty: time.Now().UTC().Format(time.RFC3339)}
+	if details.PlanID != "" {
+		properties[planIdProperty] = details.PlanID
+	}
+	setDatabaseProperties(server, databaseName, properties)
+
 	return nil
 }
 
-func (*mssqlServiceBroker) Deprovision(instanceID string) error {
+func findService(serviceID string) (config.Service, bool) {
+	for _, service := range brokerConfig.ServiceCatalog {
+		if service.ID == serviceID {
+			return service, true
+		}
+	}
+	return config.Service{}, false
+}
+
+func (broker *mssqlServiceBroker) Deprovision(instanceID string) error {
+	return broker.DeprovisionWithDetails(instanceID, DeprovisionDetails{})
+}
+
+// DeprovisionWithDetails drops the database, after the final backup if the plan has one
+func (*mssqlServiceBroker) DeprovisionWithDetails(instanceID string, details DeprovisionDetails) error {
 	// Deprovision instances here
-	logger.Info("deprovision-called", lager.Data{"instanceId": instanceID})
+	logger.Info("deprovision-called", lager.Data{"instanceId": instanceID, "planId": details.PlanID})
+
+	if validateIdentifier("instance", instanceID) != nil {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
 
 	databaseName := brokerConfig.DbIdentifierPrefix + instanceID
 
-	exist, err := mssqlProv.IsDatabaseCreated(databaseName)
+	server, unlock, err := lockInstance(instanceID, "deprovision", locateInstance(databaseName))
 	if err != nil {
-		logger.Fatal("provisioner-error", err)
+		return err
 	}
+	defer unlock()
 
-	if !exist {
+	if server == nil {
 		return brokerapi.ErrInstanceDoesNotExist
 	}
 
-	err = mssqlProv.DeleteDatabase(databaseName)
+	return deleteDatabase(server, databaseName, details.PlanID, brokerConfig.SoftDelete.Enabled)
+}
+
+// DeprovisionAsync checks the request and drops the database in a background worker.
+// The progress is reported by LastOperation.
+func (broker *mssqlServiceBroker) DeprovisionAsync(instanceID string, details DeprovisionDetails) error {
+	logger.Info("deprovision-async-called", lager.Data{"instanceId": instanceID, "planId": details.PlanID})
+
+	if validateIdentifier("instance", instanceID) != nil {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+
+	databaseName := brokerConfig.DbIdentifierPrefix + instanceID
+
+	if op, ok := broker.operations.get(instanceID); ok && op.inProgress && op.kind == deprovisionOperation {
+		return nil
+	}
+
+	server, unlock, err := lockInstance(instanceID, "deprovision", locateInstance(databaseName))
 	if err != nil {
-		logger.Fatal("provisioner-error", err)
+		return err
+	}
+
+	if server == nil {
+		unlock()
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+
+	// the worker releases the lock of the instance when the database is deleted
+	started := broker.operations.start(instanceID, deprovisionOperation, func() error {
+		defer unlock()
+		err := deleteDatabase(server, databaseName, details.PlanID, brokerConfig.SoftDelete.Enabled)
+		if err != nil {
+			logger.Error("deprovision-async-failed", err, lager.Data{"instanceId": instanceID})
+		}
+		return err
+	})
+	if !started {
+		unlock()
+		return concurrencyError{fmt.Errorf("Another operation is in progress for instance %s", instanceID)}
 	}
 
 	return nil
 }
 
-func (*mssqlServiceBroker) Bind(instanceID, bindingID string) (interface{}, error) {
+// planSqlTemplates returns the sql template set of the plan, or nil for the built-in templates
+func planSqlTemplates(planID string) *provisioner.SqlTemplateSet {
+	name, ok := brokerConfig.PlanSqlTemplates[planID]
+	if !ok {
+		return nil
+	}
+	return sqlTemplateSets[name]
+}
+
+// deleteDatabase drops or soft deletes the database with the final backup settings of the plan.
+// Requests without a plan ID use the default final backup settings, keyed by "".
+func deleteDatabase(server *mssqlServer, databaseName string, planID string, softDelete bool) error {
+	backup, ok := brokerConfig.PlanFinalBackup[planID]
+	if !ok {
+		backup = brokerConfig.PlanFinalBackup[""]
+	}
+	// the retention only deletes the final backups of the managed databases
+	backup.NamePrefix = brokerConfig.DbIdentifierPrefix
+
+	// A read-only database can not store the state, the application lock still reports the operation
+	err := setOperationState(server, databaseName, deprovisionOperation, operationInProgress, nil)
+	if err != nil {
+		logger.Error("set-operation-state-failed", err, lager.Data{"database": databaseName, "operation": deprovisionOperation})
+	}
+
+	if softDelete {
+		err = server.provisioner.SoftDeleteDatabase(databaseName, backup)
+	} else {
+		err = server.provisioner.WithTemplates(planSqlTemplates(planID)).DeleteDatabase(databaseName, backup)
+	}
+	if err != nil {
+		recordOperationFailure(server, databaseName, deprovisionOperation, err)
+		return brokerError(err, nil, brokerapi.ErrInstanceDoesNotExist)
+	}
+
+	mssqlServers.forget(databaseName)
+	return nil
+}
+
+func (broker *mssqlServiceBroker) LastOperation(instanceID string) (LastOperationResponse, error) {
+	return broker.LastOperationWithDetails(instanceID, "")
+}
+
+// LastOperationWithDetails reports the state of the last asynchronous operation for an instance.
+// The operation is the kind returned with the 202 response ("provision" or "deprovision"),
+// sent back by the Cloud Controller, or "" if it was not sent.
+// A background worker of this process takes precedence, then the state is read from the SQL Server,
+// so that any broker process can answer:
+//   - the application lock of the instance is held: an operation is in progress
+//   - no database: deprovisioned (returns ErrInstanceDoesNotExist), or a failed provision
+//   - the provision or deprovision state stored on the database (see setOperationState):
+//     an operation that is still "in progress" without the lock was interrupted
+//   - single user access: an interrupted delete template
+//   - restoring/recovering: the database is not ready yet
+//   - online: provisioned
+func (broker *mssqlServiceBroker) LastOperationWithDetails(instanceID string, operation string) (LastOperationResponse, error) {
+	logger.Info("last-operation-called", lager.Data{"instanceId": instanceID, "operation": operation})
+
+	if validateIdentifier("instance", instanceID) != nil {
+		return LastOperationResponse{}, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	databaseName := brokerConfig.DbIdentifierPrefix + instanceID
+
+	if op, ok := broker.operations.get(instanceID); ok {
+		if op.inProgress {
+			return LastOperationResponse{State: lastOperationInProgress, Description: op.kind + " in progress"}, nil
+		}
+		broker.operations.forget(instanceID)
+		if op.err != nil {
+			return LastOperationResponse{State: lastOperationFailed, Description: op.kind + " failed: " + op.err.Error()}, nil
+		}
+	}
+
+	server, err := mssqlServers.Locate(databaseName)
+	if err != nil {
+		return LastOperationResponse{}, brokerError(err, nil, nil)
+	}
+
+	if server == nil {
+		return lastOperationWithoutDatabase(instanceID, operation)
+	}
+
+	held, err := instanceLockHeld(server, instanceID)
+	if err != nil {
+		return LastOperationResponse{}, brokerError(err, nil, nil)
+	}
+
+	kind := operation
+	if held {
+		if kind == "" {
+			kind = "operation"
+		}
+		return LastOperationResponse{State: lastOperationInProgress, Description: kind + " in progress"}, nil
+	}
+
+	state, err := server.provisioner.GetDatabaseState(databaseName)
+	if err != nil {
+		return LastOperationResponse{}, brokerError(err, nil, nil)
+	}
+
+	if !state.Exists {
+		return lastOperationWithoutDatabase(instanceID, operation)
+	}
+
+	// The properties of an offline or restoring database can not be read, its state is reported below
+	properties, err := server.provisioner.GetDatabaseProperties(databaseName)
+	propertiesRead := err == nil
+	if err != nil {
+		logger.Error("get-database-properties-failed", err, lager.Data{"database": databaseName})
+		properties = map[string]string{}
+	}
+	if properties[operationProperty] != "" {
+		kind = properties[operationProperty]
+	}
+
+	switch {
+	case properties[operationStateProperty] == operationInProgress:
+		return LastOperationResponse{State: lastOperationFailed, Description: kind + " was interrupted"}, nil
+	case properties[operationStateProperty] == operationFailed:
+		return LastOperationResponse{State: lastOperationFailed, Description: kind + " failed: " + properties[operationErrorProperty]}, nil
+	case operation == provisionOperation && propertiesRead && properties[operationProperty] == "":
+		return LastOperationResponse{State: lastOperationFailed, Description: "provision was interrupted before the database was ready"}, nil
+	}
+
+	switch {
+	case state.UserAccess == "SINGLE_USER":
+		// the delete template sets single user access, and no operation holds the lock
+		return LastOperationResponse{State: lastOperationFailed, Description: "deprovision was interrupted"}, nil
+	case state.State == "ONLINE":
+		return LastOperationResponse{State: lastOperationSucceeded}, nil
+	case state.State == "RESTORING", state.State == "RECOVERING", state.State == "RECOVERY_PENDING", state.State == "COPYING":
+		return LastOperationResponse{State: lastOperationInProgress, Description: "database is " + state.State}, nil
+	default:
+		return LastOperationResponse{State: lastOperationFailed, Description: "database is " + state.State}, nil
+	}
+}
+
+// lastOperationWithoutDatabase reports the operation of an instance without a database.
+// A provision holds the application lock on the server placed for the database before it is created.
+func lastOperationWithoutDatabase(instanceID string, operation string) (LastOperationResponse, error) {
+	for _, server := range mssqlServers.servers {
+		held, err := instanceLockHeld(server, instanceID)
+		if err != nil {
+			return LastOperationResponse{}, brokerError(err, nil, nil)
+		}
+		if held {
+			kind := operation
+			if kind == "" {
+				kind = provisionOperation
+			}
+			return LastOperationResponse{State: lastOperationInProgress, Description: kind + " in progress"}, nil
+		}
+	}
+
+	// The Cloud Controller would take 410 Gone for a finished delete
+	if operation == provisionOperation {
+		return LastOperationResponse{State: lastOperationFailed, Description: "provision failed, the database was not created"}, nil
+	}
+	return LastOperationResponse{}, brokerapi.ErrInstanceDoesNotExist
+}
+
+func (broker *mssqlServiceBroker) Bind(instanceID, bindingID string) (interface{}, error) {
+	return broker.BindWithParameters(instanceID, bindingID, BindDetails{})
+}
+
+func (*mssqlServiceBroker) BindWithParameters(instanceID, bindingID string, details BindDetails) (interface{}, error) {
 	// Bind to instances here
 	// Return credentials which will be marshalled to JSON
 
-	logger.Info("bind-called", lager.Data{"instanceId": instanceID, "bindingId": bindingID})
+	logger.Info("bind-called", lager.Data{"instanceId": instanceID, "bindingId": bindingID, "details": details})
+
+	if validateIdentifier("instance", instanceID) != nil {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	}
+	if err := validateIdentifier("binding", bindingID); err != nil {
+		return nil, err
+	}
 
 	databaseName := brokerConfig.DbIdentifierPrefix + instanceID
-	username := databaseName + "-" + bindingID
-	password := secureRandomString(32) + happySqlPasswordPolicySuffix
+	username := bindingUsername(databaseName, bindingID)
+	password := newBindingPassword()
 
-	exist, err := mssqlProv.IsDatabaseCreated(databaseName)
+	rotate, parameters, err := rotateParameter(details.Parameters)
 	if err != nil {
-		logger.Fatal("provisioner-error", err)
+		return nil, err
 	}
 
-	if !exist {
+	roles, rolesRequested, err := planBindingRoles(details.PlanID, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	server, unlock, err := lockInstance(instanceID, "bind", locateInstance(databaseName))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if server == nil {
 		return nil, brokerapi.ErrInstanceDoesNotExist
 	}
 
-	exist, err = mssqlProv.IsUserCreated(databaseName, username)
+	err = checkQuotaRestriction(server, databaseName)
+	if err != nil {
+		return nil, err
+	}
+
+	exist, err := server.provisioner.IsUserCreated(databaseName, username)
 	if err != nil {
-		logger.Fatal("provisioner-error", err)
+		return nil, brokerError(err, nil, brokerapi.ErrInstanceDoesNotExist)
 	}
 
 	if exist {
+		if rotate {
+			return rotateBindingCredentials(server, databaseName, username, details.PlanID)
+		}
 		return nil, brokerapi.ErrBindingAlreadyExists
 	}
 
-	err = mssqlProv.CreateUser(databaseName, username, password)
-	if err != nil {
-		logger.Fatal("provisioner-error", err)
+	for _, role := range roles {
+		exist, err = server.provisioner.IsRoleCreated(databaseName, role)
+		if err != nil {
+			return nil, brokerError(err, nil, brokerapi.ErrInstanceDoesNotExist)
+		}
+
+		if !exist {
+			err = fmt.Errorf("database role %q does not exist", role)
+			if rolesRequested {
+				return nil, invalidParametersError{err}
+			}
+			return nil, err
+		}
 	}
 
-	bindingInfo := MssqlBindingCredentials{
-		Hostname:         brokerConfig.ServedBindingHostname,
-		Host:             brokerConfig.ServedBindingHostname,
-		Port:             brokerConfig.ServedBindingPort,
-		Name:             databaseName,
-		Username:         username,
-		Password:         password,
-		ConnectionString: generateConnectionString(brokerConfig.ServedBindingHostname, brokerConfig.ServedBindingPort, databaseName, username, password),
+	err = server.provisioner.WithTemplates(planSqlTemplates(details.PlanID)).CreateUser(databaseName, username, password, roles)
+	if err != nil {
+		return nil, brokerError(err, brokerapi.ErrBindingAlreadyExists, brokerapi.ErrInstanceDoesNotExist)
 	}
 
-	return bindingInfo, nil
+	setUserProperties(server, databaseName, username, bindingProperties(instanceID, bindingID, details, time.Now()))
+
+	return newMssqlBindingCredentials(server, databaseName, username, password)
+}
+
+func (broker *mssqlServiceBroker) Unbind(instanceID, bindingID string) error {
+	return broker.UnbindWithDetails(instanceID, bindingID, UnbindDetails{})
 }
 
-func (*mssqlServiceBroker) Unbind(instanceID, bindingID string) error {
+// UnbindWithDetails drops the user with the sql templates of the plan
+func (*mssqlServiceBroker) UnbindWithDetails(instanceID, bindingID string, details UnbindDetails) error {
 	// Unbind from instances here
-	logger.Info("unbind-called", lager.Data{"instanceId": instanceID, "bindingId": bindingID})
+	logger.Info("unbind-called", lager.Data{"instanceId": instanceID, "bindingId": bindingID, "planId": details.PlanID})
+
+	if validateIdentifier("instance", instanceID) != nil {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	if validateIdentifier("binding", bindingID) != nil {
+		return brokerapi.ErrBindingDoesNotExist
+	}
 
 	databaseName := brokerConfig.DbIdentifierPrefix + instanceID
-	username := databaseName + "-" + bindingID
+	username := bindingUsername(databaseName, bindingID)
 
-	exist, err := mssqlProv.IsDatabaseCreated(databaseName)
+	server, unlock, err := lockInstance(instanceID, "unbind", locateInstance(databaseName))
 	if err != nil {
-		logger.Fatal("provisioner-error", err)
+		return err
 	}
+	defer unlock()
 
-	if !exist {
+	if server == nil {
 		return brokerapi.ErrInstanceDoesNotExist
 	}
 
-	exist, err = mssqlProv.IsUserCreated(databaseName, username)
+	exist, err := server.provisioner.IsUserCreated(databaseName, username)
 	if err != nil {
-		logger.Fatal("provisioner-error", err)
+		return brokerError(err, nil, brokerapi.ErrInstanceDoesNotExist)
 	}
 
 	if !exist {
-		return brokerapi.ErrBindingAlreadyExists
+		return brokerapi.ErrBindingDoesNotExist
 	}
 
-	err = mssqlProv.DeleteUser(databaseName, username)
+	err = server.provisioner.WithTemplates(planSqlTemplates(details.PlanID)).DeleteUser(databaseName, username)
 	if err != nil {
-		logger.Fatal("provisioner-error", err)
+		return brokerError(err, nil, brokerapi.ErrBindingDoesNotExist)
 	}
 
-	return nil
+	return deleteDualUser(server, databaseName, username, details.PlanID)
 }
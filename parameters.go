@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+)
+
+// invalidParametersError is returned to the Cloud Controller as 400 Bad Request
+type invalidParametersError struct {
+	err error
+}
+
+func (e invalidParametersError) Error() string {
+	return e.err.Error()
+}
+
+// updateNotSupportedError is returned to the Cloud Controller as 422 Unprocessable Entity
+type updateNotSupportedError struct {
+	err error
+}
+
+func (e updateNotSupportedError) Error() string {
+	return e.err.Error()
+}
+
+// planDatabaseSettings returns the database settings of the plan, overridden by
+// the provision parameters. The parameters are validated with the plan schema and
+// they must use the same names as the planSettings, e.g. {"collation":"Latin1_General_CS_AS"}
+func planDatabaseSettings(planID string, parameters map[string]interface{}) (provisioner.DatabaseSettings, error) {
+	settings, err := settingsWithParameters(planID, brokerConfig.PlanParameters[planID].Provision, parameters)
+	if err != nil {
+		return settings, err
+	}
+	return capDataSize(settings, brokerConfig.Quotas.PlanMaxDataSizeMB[planID])
+}
+
+// planUpdateSettings returns the database settings of the plan, overridden by the update parameters.
+// The collation of an existing database can not be changed, so the collation parameter is rejected.
+func planUpdateSettings(planID string, parameters map[string]interface{}) (provisioner.DatabaseSettings, error) {
+	if _, ok := parameters["collation"]; ok {
+		return brokerConfig.PlanSettings[planID], invalidParametersError{fmt.Errorf("invalid parameters: the collation of an existing database can not be changed")}
+	}
+
+	settings, err := settingsWithParameters(planID, brokerConfig.PlanParameters[planID].Update, parameters)
+	if err != nil {
+		return settings, err
+	}
+	return capDataSize(settings, brokerConfig.Quotas.PlanMaxDataSizeMB[planID])
+}
+
+func settingsWithParameters(planID string, schema config.ParametersSchema, parameters map[string]interface{}) (provisioner.DatabaseSettings, error) {
+	settings := brokerConfig.PlanSettings[planID]
+
+	// also without parameters, so the required ones are enforced
+	err := schema.Validate(parameters)
+	if err != nil {
+		return settings, invalidParametersError{err}
+	}
+	if len(parameters) == 0 {
+		return settings, nil
+	}
+
+	err = decodeParameters(parameters, &settings)
+	if err != nil {
+		return settings, invalidParametersError{err}
+	}
+
+	err = settings.Validate()
+	if err != nil {
+		return settings, invalidParametersError{fmt.Errorf("invalid parameters: %v", err)}
+	}
+
+	return settings, nil
+}
+
+// Used for plans without planBindingRoles
+var defaultBindingRoles = []string{"db_owner"}
+
+type bindParameters struct {
+	Role  string   `json:"role"`
+	Roles []string `json:"roles"`
+}
+
+// planBindingRoles returns the database roles requested with the bind parameters
+// (e.g. {"role":"db_datareader"} or {"roles":["db_datareader","db_datawriter"]}),
+// or the roles configured for the plan if none are requested.
+// The parameters are validated with the plan schema, which should restrict the allowed roles.
+func planBindingRoles(planID string, parameters map[string]interface{}) (roles []string, requested bool, err error) {
+	roles = brokerConfig.PlanBindingRoles[planID]
+	if len(roles) == 0 {
+		roles = defaultBindingRoles
+	}
+
+	// also without parameters, so the required ones are enforced
+	err = brokerConfig.PlanParameters[planID].Bind.Validate(parameters)
+	if err != nil {
+		return nil, false, invalidParametersError{err}
+	}
+	if len(parameters) == 0 {
+		return roles, false, nil
+	}
+
+	bindParams := bindParameters{}
+	err = decodeParameters(parameters, &bindParams)
+	if err != nil {
+		return nil, false, invalidParametersError{err}
+	}
+
+	requestedRoles := bindParams.Roles
+	if bindParams.Role != "" {
+		requestedRoles = append(requestedRoles, bindParams.Role)
+	}
+	if len(requestedRoles) == 0 {
+		return roles, false, nil
+	}
+
+	return requestedRoles, true, nil
+}
+
+// rotateParameter removes the {"rotate":true} flag from the bind parameters.
+// The flag is accepted for all the plans, it does not need to be in the parameters schema.
+func rotateParameter(parameters map[string]interface{}) (bool, map[string]interface{}, error) {
+	value, ok := parameters["rotate"]
+	if !ok {
+		return false, parameters, nil
+	}
+
+	rotate, ok := value.(bool)
+	if !ok {
+		return false, nil, invalidParametersError{fmt.Errorf("invalid parameters: rotate must be of type boolean")}
+	}
+
+	withoutRotate := map[string]interface{}{}
+	for name, value := range parameters {
+		if name != "rotate" {
+			withoutRotate[name] = value
+		}
+	}
+	return rotate, withoutRotate, nil
+}
+
+// decodeParameters sets the fields of target from the parameters using the json field names.
+// Parameters without a matching field are rejected.
+func decodeParameters(parameters map[string]interface{}, target interface{}) error {
+	jsonParameters, err := json.Marshal(parameters)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(jsonParameters))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(target)
+	if err != nil {
+		return fmt.Errorf("invalid parameters: %v", err)
+	}
+	return nil
+}
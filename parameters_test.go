@@ -0,0 +1,167 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var requiredCollationSchema = config.ParametersSchema{
+	Properties: map[string]config.ParameterSchema{"collation": {Type: "string"}},
+	Required:   []string{"collation"},
+}
+
+func useParametersConfig(t *testing.T, brokerConfigForTest *config.Config) {
+	previous := brokerConfig
+	brokerConfig = brokerConfigForTest
+	t.Cleanup(func() { brokerConfig = previous })
+}
+
+func TestRequiredParametersWithoutParameters(t *testing.T) {
+	useParametersConfig(t, &config.Config{
+		PlanParameters: map[string]config.PlanParametersSchema{
+			"plan1": {
+				Provision: requiredCollationSchema,
+				Update:    requiredCollationSchema,
+				Bind: config.ParametersSchema{
+					Properties: map[string]config.ParameterSchema{"role": {Type: "string"}},
+					Required:   []string{"role"},
+				},
+			},
+		},
+	})
+	broker := newMssqlServiceBroker()
+	updateDetails := UpdateDetails{PlanID: "plan1"}
+	updateDetails.PreviousValues.PlanID = "plan1"
+
+	// Act
+	provisionErr := broker.ProvisionWithParameters("instance1", ProvisionDetails{ServiceDetails: brokerapi.ServiceDetails{PlanID: "plan1"}})
+	asyncProvisionErr := broker.ProvisionAsync("instance1", ProvisionDetails{ServiceDetails: brokerapi.ServiceDetails{PlanID: "plan1"}})
+	updateErr := broker.Update("instance1", updateDetails)
+	_, bindErr := broker.BindWithParameters("instance1", "binding1", BindDetails{PlanID: "plan1"})
+	_, rotateOnlyErr := broker.BindWithParameters("instance1", "binding1", BindDetails{PlanID: "plan1", Parameters: map[string]interface{}{"rotate": true}})
+
+	// Assert
+	for name, err := range map[string]error{"provision": provisionErr, "async provision": asyncProvisionErr, "update": updateErr, "bind": bindErr, "bind with only rotate": rotateOnlyErr} {
+		if _, ok := err.(invalidParametersError); !ok {
+			t.Errorf("expected an invalidParametersError for the missing required parameter of %s, got %v", name, err)
+		}
+	}
+}
+
+func TestPlanBindingRoles(t *testing.T) {
+	roleSchema := config.ParameterSchema{Type: "string", Enum: []interface{}{"db_datareader", "db_datawriter"}}
+	useParametersConfig(t, &config.Config{
+		PlanBindingRoles: map[string][]string{"reader": {"db_datareader"}},
+		PlanParameters: map[string]config.PlanParametersSchema{
+			"reader": {
+				Bind: config.ParametersSchema{
+					Properties: map[string]config.ParameterSchema{
+						"role":  roleSchema,
+						"roles": {Type: "array", Items: &roleSchema},
+					},
+				},
+			},
+		},
+	})
+
+	cases := []struct {
+		name          string
+		planID        string
+		parameters    map[string]interface{}
+		expectedRoles []string
+		requested     bool
+	}{
+		{"plan without configured roles", "owner", nil, []string{"db_owner"}, false},
+		{"configured roles of the plan", "reader", nil, []string{"db_datareader"}, false},
+		{"configured roles with empty parameters", "reader", map[string]interface{}{}, []string{"db_datareader"}, false},
+		{"role parameter", "reader", map[string]interface{}{"role": "db_datawriter"}, []string{"db_datawriter"}, true},
+		{"roles parameter", "reader", map[string]interface{}{"roles": []interface{}{"db_datareader", "db_datawriter"}}, []string{"db_datareader", "db_datawriter"}, true},
+		{"role and roles parameters", "reader", map[string]interface{}{"role": "db_datawriter", "roles": []interface{}{"db_datareader"}}, []string{"db_datareader", "db_datawriter"}, true},
+		{"empty roles parameter", "reader", map[string]interface{}{"roles": []interface{}{}}, []string{"db_datareader"}, false},
+	}
+
+	for _, c := range cases {
+		// Act
+		roles, requested, err := planBindingRoles(c.planID, c.parameters)
+
+		// Assert
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(roles, c.expectedRoles) || requested != c.requested {
+			t.Errorf("%s: expected the roles %v (requested %v), got %v (requested %v)", c.name, c.expectedRoles, c.requested, roles, requested)
+		}
+	}
+}
+
+func TestPlanBindingRolesRejectsUnknownRoles(t *testing.T) {
+	roleSchema := config.ParameterSchema{Type: "string", Enum: []interface{}{"db_datareader"}}
+	useParametersConfig(t, &config.Config{
+		PlanParameters: map[string]config.PlanParametersSchema{
+			"reader": {
+				Bind: config.ParametersSchema{
+					Properties: map[string]config.ParameterSchema{
+						"role":  roleSchema,
+						"roles": {Type: "array", Items: &roleSchema},
+					},
+				},
+			},
+		},
+	})
+
+	cases := map[string]struct {
+		planID     string
+		parameters map[string]interface{}
+	}{
+		"role outside of the enum":        {"reader", map[string]interface{}{"role": "db_owner"}},
+		"roles outside of the enum":       {"reader", map[string]interface{}{"roles": []interface{}{"db_datareader", "db_owner"}}},
+		"role of a plan without a schema": {"owner", map[string]interface{}{"role": "db_datareader"}},
+		"role that is not a string":       {"reader", map[string]interface{}{"role": 1.0}},
+	}
+
+	for name, c := range cases {
+		// Act
+		roles, _, err := planBindingRoles(c.planID, c.parameters)
+
+		// Assert
+		if _, ok := err.(invalidParametersError); !ok {
+			t.Errorf("%s: expected an invalidParametersError, got %v", name, err)
+		}
+		if roles != nil {
+			t.Errorf("%s: expected no roles, got %v", name, roles)
+		}
+	}
+}
+
+func TestPlanUpdateSettings(t *testing.T) {
+	useParametersConfig(t, &config.Config{
+		PlanSettings: map[string]provisioner.DatabaseSettings{"plan1": {MaxDataSizeMB: 1024, Collation: "Latin1_General_CS_AS"}},
+		PlanParameters: map[string]config.PlanParametersSchema{
+			"plan1": {
+				Update: config.ParametersSchema{
+					Properties: map[string]config.ParameterSchema{
+						"collation":     {Type: "string"},
+						"maxDataSizeMB": {Type: "integer"},
+					},
+				},
+			},
+		},
+	})
+
+	// Act
+	settings, err := planUpdateSettings("plan1", map[string]interface{}{"maxDataSizeMB": 2048.0})
+	_, collationErr := planUpdateSettings("plan1", map[string]interface{}{"collation": "Latin1_General_CI_AS"})
+
+	// Assert
+	if err != nil || settings.MaxDataSizeMB != 2048 {
+		t.Errorf("expected the parameters to override the plan settings, got %+v, %v", settings, err)
+	}
+	if _, ok := collationErr.(invalidParametersError); !ok {
+		t.Errorf("expected an invalidParametersError for the collation of an existing database, got %v", collationErr)
+	}
+}
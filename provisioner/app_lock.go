@@ -0,0 +1,76 @@
+package provisioner
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pivotal-golang/lager"
+)
+
+// ErrAppLockTimeout is returned when the application lock is held by another session after the timeout
+var ErrAppLockTimeout = errors.New("the application lock is held by another operation")
+
+// The locks are owned by the session, so they are released if the broker process dies.
+// query parameters: resource name, timeout in milliseconds
+var getAppLockTemplate = "declare @result int;  exec @result = [master].sys.sp_getapplock @Resource = ?, @LockMode = 'Exclusive', @LockOwner = 'Session', @LockTimeout = ?;  select @result"
+
+// query parameters: resource name
+var releaseAppLockTemplate = "exec [master].sys.sp_releaseapplock @Resource = ?, @LockOwner = 'Session'"
+
+// AppLock is an exclusive SQL Server application lock, held by a dedicated connection
+type AppLock struct {
+	provisioner *MssqlProvisioner
+	conn        *sql.Conn
+	resource    string
+}
+
+// AcquireAppLock waits for the exclusive application lock of the resource.
+// Returns ErrAppLockTimeout if the lock is not granted before the timeout.
+func (provisioner *MssqlProvisioner) AcquireAppLock(resource string, timeout time.Duration) (*AppLock, error) {
+	start := time.Now()
+
+	conn, err := provisioner.dbClient.Conn(context.Background())
+	if err != nil {
+		provisioner.observe("getAppLock", start, err)
+		return nil, newProvisionerError(err)
+	}
+
+	var result int
+	err = conn.QueryRowContext(context.Background(), getAppLockTemplate, resource, int(timeout/time.Millisecond)).Scan(&result)
+	provisioner.observe("getAppLock", start, err)
+	if err != nil {
+		conn.Close()
+		provisioner.logger.Error("mssql-exec", err, lager.Data{"query": getAppLockTemplate})
+		return nil, newProvisionerError(err)
+	}
+
+	switch {
+	case result >= 0:
+		return &AppLock{provisioner: provisioner, conn: conn, resource: resource}, nil
+	case result == -1:
+		conn.Close()
+		return nil, ErrAppLockTimeout
+	default:
+		conn.Close()
+		return nil, &ProvisionerError{Class: TransientError, Err: fmt.Errorf("sp_getapplock failed with %d", result)}
+	}
+}
+
+// Release releases the lock and closes its connection. Closing the connection
+// releases the lock too, so the release error is only logged.
+func (lock *AppLock) Release() {
+	start := time.Now()
+	_, err := lock.conn.ExecContext(context.Background(), releaseAppLockTemplate, lock.resource)
+	lock.provisioner.observe("releaseAppLock", start, err)
+	if err != nil {
+		lock.provisioner.logger.Error("release-app-lock-failed", err, lager.Data{"resource": lock.resource})
+		// discard the connection instead of returning it to the pool with the lock
+		lock.conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+
+	lock.conn.Close()
+}
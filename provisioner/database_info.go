@@ -0,0 +1,67 @@
+package provisioner
+
+import (
+	"database/sql"
+	"time"
+)
+
+// DatabaseInfo is the state and the size of a database from sys.databases and sys.master_files
+type DatabaseInfo struct {
+	Name          string
+	State         string
+	UserAccess    string
+	RecoveryModel string
+	Collation     string
+	CreatedAt     time.Time
+	DataSizeMB    int64
+	LogSizeMB     int64
+}
+
+var databaseInfoSelect = "select d.name, d.state_desc, d.user_access_desc, d.recovery_model_desc, isnull(d.collation_name, ''), d.create_date,  isnull(sum(case when mf.type = 0 then cast(mf.size as bigint) end) / 128, 0),  isnull(sum(case when mf.type = 1 then cast(mf.size as bigint) end) / 128, 0)  from [master].sys.databases d  left join [master].sys.master_files mf on mf.database_id = d.database_id"
+
+var databaseInfoGroupBy = "  group by d.name, d.state_desc, d.user_access_desc, d.recovery_model_desc, d.collation_name, d.create_date"
+
+// query parameters: LIKE pattern of the database names
+var listDatabaseInfoTemplate = databaseInfoSelect + "  where d.name like ?" + databaseInfoGroupBy + "  order by d.name"
+
+// query parameters: databaseId
+var databaseInfoTemplate = databaseInfoSelect + "  where d.name = ?" + databaseInfoGroupBy
+
+func scanDatabaseInfo(rows *sql.Rows) (DatabaseInfo, error) {
+	info := DatabaseInfo{}
+	err := rows.Scan(&info.Name, &info.State, &info.UserAccess, &info.RecoveryModel, &info.Collation, &info.CreatedAt, &info.DataSizeMB, &info.LogSizeMB)
+	return info, err
+}
+
+// ListDatabaseInfo returns the databases whose names start with the prefix, without the soft deleted databases
+func (provisioner *MssqlProvisioner) ListDatabaseInfo(namePrefix string) ([]DatabaseInfo, error) {
+	databases := []DatabaseInfo{}
+
+	err := provisioner.queryRows("listDatabaseInfo", listDatabaseInfoTemplate, func(rows *sql.Rows) error {
+		info, err := scanDatabaseInfo(rows)
+		if err != nil {
+			return err
+		}
+		if _, ok := parseTombstoneName(info.Name); !ok {
+			databases = append(databases, info)
+		}
+		return nil
+	}, likePrefix(namePrefix)+"%")
+
+	return databases, err
+}
+
+// GetDatabaseInfo returns the info of a database, and false if it does not exist
+func (provisioner *MssqlProvisioner) GetDatabaseInfo(databaseId string) (DatabaseInfo, bool, error) {
+	info := DatabaseInfo{}
+	found := false
+
+	err := provisioner.queryRows("databaseInfo", databaseInfoTemplate, func(rows *sql.Rows) error {
+		var err error
+		info, err = scanDatabaseInfo(rows)
+		found = err == nil
+		return err
+	}, databaseId)
+
+	return info, found, err
+}
@@ -0,0 +1,191 @@
+package provisioner
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DatabaseSettings are the options applied to a new database.
+// Zero values keep the SQL Server defaults inherited from the model database.
+type DatabaseSettings struct {
+	InitialDataSizeMB int `json:"initialDataSizeMB"`
+	MaxDataSizeMB     int `json:"maxDataSizeMB"`
+	// e.g. "64MB" or "10%"
+	DataFileGrowth   string `json:"dataFileGrowth"`
+	InitialLogSizeMB int    `json:"initialLogSizeMB"`
+	MaxLogSizeMB     int    `json:"maxLogSizeMB"`
+	LogFileGrowth    string `json:"logFileGrowth"`
+	// SIMPLE, FULL or BULK_LOGGED
+	RecoveryModel      string `json:"recoveryModel"`
+	CompatibilityLevel int    `json:"compatibilityLevel"`
+	// e.g. "Latin1_General_CS_AS"
+	Collation              string `json:"collation"`
+	ReadCommittedSnapshot  *bool  `json:"readCommittedSnapshot"`
+	AllowSnapshotIsolation *bool  `json:"allowSnapshotIsolation"`
+}
+
+// DatabaseFileSizes is the allocated size of the database files
+type DatabaseFileSizes struct {
+	DataSizeMB int
+	LogSizeMB  int
+}
+
+// DatabaseTooLargeError is returned when the database does not fit in the new settings
+type DatabaseTooLargeError struct {
+	File      string
+	SizeMB    int
+	MaxSizeMB int
+}
+
+func (e *DatabaseTooLargeError) Error() string {
+	return fmt.Sprintf("the %s files of the database have %dMB, which is over the new max size of %dMB", e.File, e.SizeMB, e.MaxSizeMB)
+}
+
+var fileGrowthRegexp = regexp.MustCompile(`^[0-9]+(KB|MB|GB|TB|%)$`)
+var collationRegexp = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+var recoveryModels = map[string]bool{
+	"SIMPLE":      true,
+	"FULL":        true,
+	"BULK_LOGGED": true,
+}
+
+// Validate checks the settings that are compiled directly into the sql templates
+func (settings DatabaseSettings) Validate() error {
+	if settings.InitialDataSizeMB < 0 || settings.MaxDataSizeMB < 0 || settings.InitialLogSizeMB < 0 || settings.MaxLogSizeMB < 0 {
+		return fmt.Errorf("database file sizes can not be negative")
+	}
+	if settings.MaxDataSizeMB != 0 && settings.MaxDataSizeMB < settings.InitialDataSizeMB {
+		return fmt.Errorf("maxDataSizeMB %d is less than initialDataSizeMB %d", settings.MaxDataSizeMB, settings.InitialDataSizeMB)
+	}
+	if settings.MaxLogSizeMB != 0 && settings.MaxLogSizeMB < settings.InitialLogSizeMB {
+		return fmt.Errorf("maxLogSizeMB %d is less than initialLogSizeMB %d", settings.MaxLogSizeMB, settings.InitialLogSizeMB)
+	}
+	if settings.DataFileGrowth != "" && !fileGrowthRegexp.MatchString(strings.ToUpper(settings.DataFileGrowth)) {
+		return fmt.Errorf("invalid dataFileGrowth %q, expected e.g. \"64MB\" or \"10%%\"", settings.DataFileGrowth)
+	}
+	if settings.LogFileGrowth != "" && !fileGrowthRegexp.MatchString(strings.ToUpper(settings.LogFileGrowth)) {
+		return fmt.Errorf("invalid logFileGrowth %q, expected e.g. \"64MB\" or \"10%%\"", settings.LogFileGrowth)
+	}
+	if settings.RecoveryModel != "" && !recoveryModels[strings.ToUpper(settings.RecoveryModel)] {
+		return fmt.Errorf("invalid recoveryModel %q, expected SIMPLE, FULL or BULK_LOGGED", settings.RecoveryModel)
+	}
+	if settings.CompatibilityLevel < 0 {
+		return fmt.Errorf("invalid compatibilityLevel %d", settings.CompatibilityLevel)
+	}
+	if settings.Collation != "" && !collationRegexp.MatchString(settings.Collation) {
+		return fmt.Errorf("invalid collation %q", settings.Collation)
+	}
+	return nil
+}
+
+// The logical file names are the ones generated by SQL Server for a
+// "create database" without file specifications: <database> and <database>_log
+
+// fmt template parameters: 1.databaseId, 2.logical file name, 3.file options
+var modifyFileTemplate = "alter database [%[1]v] modify file (name = N'%[2]v', %[3]v)"
+
+// The open transactions are rolled back, a database can not be switched with active connections
+// fmt template parameters: 1.databaseId
+var setReadOnlyTemplate = []string{
+	"alter database [%[1]v] set read_only with rollback immediate",
+}
+
+// fmt template parameters: 1.databaseId
+var setReadWriteTemplate = []string{
+	"alter database [%[1]v] set read_write with rollback immediate",
+}
+
+// databaseSettingsTemplate compiles the settings into the fmt template lines
+// executed after the database is created. The template parameters left are
+// 1.databaseId (escaped as an identifier) and 2.databaseId (escaped as a literal).
+func databaseSettingsTemplate(settings DatabaseSettings) []string {
+	template := []string{}
+
+	dataFileOptions := fileOptions(settings.InitialDataSizeMB, settings.MaxDataSizeMB, settings.DataFileGrowth)
+	if dataFileOptions != "" {
+		template = append(template, fmt.Sprintf(modifyFileTemplate, "%[1]v", "%[2]v", dataFileOptions))
+	}
+
+	logFileOptions := fileOptions(settings.InitialLogSizeMB, settings.MaxLogSizeMB, settings.LogFileGrowth)
+	if logFileOptions != "" {
+		template = append(template, fmt.Sprintf(modifyFileTemplate, "%[1]v", "%[2]v_log", logFileOptions))
+	}
+
+	if settings.RecoveryModel != "" {
+		template = append(template, "alter database [%[1]v] set recovery "+strings.ToUpper(settings.RecoveryModel))
+	}
+
+	if settings.CompatibilityLevel != 0 {
+		template = append(template, fmt.Sprintf("alter database [%%[1]v] set compatibility_level = %d", settings.CompatibilityLevel))
+	}
+
+	if settings.ReadCommittedSnapshot != nil {
+		template = append(template, "alter database [%[1]v] set read_committed_snapshot "+onOff(*settings.ReadCommittedSnapshot)+" with rollback immediate")
+	}
+
+	if settings.AllowSnapshotIsolation != nil {
+		template = append(template, "alter database [%[1]v] set allow_snapshot_isolation "+onOff(*settings.AllowSnapshotIsolation))
+	}
+
+	return template
+}
+
+// unlimitedMaxSizesTemplate sets the max sizes that the settings leave unset to unlimited,
+// with the template parameters of databaseSettingsTemplate
+func unlimitedMaxSizesTemplate(settings DatabaseSettings) []string {
+	template := []string{}
+	if settings.MaxDataSizeMB == 0 {
+		template = append(template, fmt.Sprintf(modifyFileTemplate, "%[1]v", "%[2]v", "maxsize = unlimited"))
+	}
+	if settings.MaxLogSizeMB == 0 {
+		template = append(template, fmt.Sprintf(modifyFileTemplate, "%[1]v", "%[2]v_log", "maxsize = unlimited"))
+	}
+	return template
+}
+
+// A new database gets the recovery model of the model database
+var modelRecoveryModelTemplate = "select recovery_model_desc from sys.databases where name = N'model'"
+
+func (provisioner *MssqlProvisioner) defaultRecoveryModel() (string, error) {
+	recoveryModel := ""
+	err := provisioner.queryScalar("modelRecoveryModel", modelRecoveryModelTemplate, &recoveryModel)
+	if err != nil {
+		return "", err
+	}
+	if !recoveryModels[strings.ToUpper(recoveryModel)] {
+		return "", fmt.Errorf("unexpected recovery model %q of the model database", recoveryModel)
+	}
+	return recoveryModel, nil
+}
+
+func fileOptions(sizeMB, maxSizeMB int, growth string) string {
+	options := []string{}
+	if sizeMB != 0 {
+		options = append(options, fmt.Sprintf("size = %dMB", sizeMB))
+	}
+	if maxSizeMB != 0 {
+		options = append(options, fmt.Sprintf("maxsize = %dMB", maxSizeMB))
+	}
+	if growth != "" {
+		// escape the percent sign for the fmt template
+		options = append(options, "filegrowth = "+strings.Replace(strings.ToUpper(growth), "%", "%%", -1))
+	}
+	return strings.Join(options, ", ")
+}
+
+func onOff(value bool) string {
+	if value {
+		return "on"
+	}
+	return "off"
+}
+
+// SetDatabaseReadOnly switches the database to read-only, or back to read-write
+func (provisioner *MssqlProvisioner) SetDatabaseReadOnly(databaseId string, readOnly bool) error {
+	if readOnly {
+		return provisioner.executeTemplateWithoutTx("setReadOnly", setReadOnlyTemplate, escapeIdentifier(databaseId))
+	}
+	return provisioner.executeTemplateWithoutTx("setReadWrite", setReadWriteTemplate, escapeIdentifier(databaseId))
+}
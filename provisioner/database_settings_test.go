@@ -0,0 +1,85 @@
+package provisioner
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDatabaseSettingsTemplate(t *testing.T) {
+	rcsi := true
+	settings := DatabaseSettings{
+		InitialDataSizeMB:     100,
+		MaxDataSizeMB:         1024,
+		DataFileGrowth:        "10%",
+		MaxLogSizeMB:          512,
+		RecoveryModel:         "simple",
+		CompatibilityLevel:    110,
+		ReadCommittedSnapshot: &rcsi,
+	}
+
+	// Act
+	err := settings.Validate()
+	template := databaseSettingsTemplate(settings)
+	compiled := []string{}
+	for _, line := range template {
+		compiled = append(compiled, compileTemplate(line, escapeIdentifier("cf]db1"), escapeLiteral("cf]db1")))
+	}
+
+	// Assert
+	if err != nil {
+		t.Errorf("Validate error, %v", err)
+	}
+	expected := []string{
+		"alter database [cf]]db1] modify file (name = N'cf]db1', size = 100MB, maxsize = 1024MB, filegrowth = 10%)",
+		"alter database [cf]]db1] modify file (name = N'cf]db1_log', maxsize = 512MB)",
+		"alter database [cf]]db1] set recovery SIMPLE",
+		"alter database [cf]]db1] set compatibility_level = 110",
+		"alter database [cf]]db1] set read_committed_snapshot on with rollback immediate",
+	}
+	if !reflect.DeepEqual(compiled, expected) {
+		t.Errorf("Unexpected settings template %#v", compiled)
+	}
+}
+
+func TestDatabaseSettingsValidate(t *testing.T) {
+	invalid := []DatabaseSettings{
+		{InitialDataSizeMB: 200, MaxDataSizeMB: 100},
+		{DataFileGrowth: "10 percent"},
+		{RecoveryModel: "none"},
+		{Collation: "Latin1_General_CS_AS; drop database x"},
+		{MaxLogSizeMB: -1},
+	}
+
+	for _, settings := range invalid {
+		// Act
+		err := settings.Validate()
+
+		// Assert
+		if err == nil {
+			t.Errorf("Validate returned no error for %#v", settings)
+		}
+	}
+}
+
+func TestUnlimitedMaxSizesTemplate(t *testing.T) {
+	// Act
+	unset := unlimitedMaxSizesTemplate(DatabaseSettings{InitialDataSizeMB: 100})
+	logUnset := unlimitedMaxSizesTemplate(DatabaseSettings{MaxDataSizeMB: 1024})
+	set := unlimitedMaxSizesTemplate(DatabaseSettings{MaxDataSizeMB: 1024, MaxLogSizeMB: 512})
+
+	// Assert
+	compiled := []string{}
+	for _, line := range unset {
+		compiled = append(compiled, compileTemplate(line, escapeIdentifier("cf]db1"), escapeLiteral("cf]db1")))
+	}
+	expected := []string{
+		"alter database [cf]]db1] modify file (name = N'cf]db1', maxsize = unlimited)",
+		"alter database [cf]]db1] modify file (name = N'cf]db1_log', maxsize = unlimited)",
+	}
+	if !reflect.DeepEqual(compiled, expected) {
+		t.Errorf("Unexpected unlimited max sizes template %#v", compiled)
+	}
+	if len(logUnset) != 1 || len(set) != 0 {
+		t.Errorf("expected only the unset max sizes, got %#v and %#v", logUnset, set)
+	}
+}
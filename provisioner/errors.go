@@ -0,0 +1,170 @@
+package provisioner
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+)
+
+// ErrorClass groups the provisioner failures by the way the broker should react to them.
+type ErrorClass int
+
+const (
+	// The failure could not be classified. The operation failed, but it is safe to keep running.
+	UnknownError ErrorClass = iota
+	// Timeouts, deadlocks and connectivity problems. The operation can be retried.
+	TransientError
+	// The database or the user already exists.
+	ConflictError
+	// The database or the user does not exist.
+	NotFoundError
+	// The sql driver may be left in an unknown state. The process should not continue.
+	FatalError
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case TransientError:
+		return "transient"
+	case ConflictError:
+		return "conflict"
+	case NotFoundError:
+		return "not-found"
+	case FatalError:
+		return "fatal"
+	default:
+		return "unknown"
+	}
+}
+
+// ProvisionerError is returned by every MssqlProvisioner operation that fails
+type ProvisionerError struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *ProvisionerError) Error() string {
+	return e.Err.Error()
+}
+
+// sqlErrorInfo is the driver independent view of a SQL Server error
+type sqlErrorInfo struct {
+	// SQL Server error number (sys.messages)
+	Number int
+	// ODBC SQLSTATE, if available
+	State string
+}
+
+// Each go sql driver file registers an extractor for its own error type.
+// This keeps the build tags for the drivers in a single place.
+var sqlErrorExtractors []func(err error) (sqlErrorInfo, bool)
+
+func registerSqlErrorExtractor(extractor func(err error) (sqlErrorInfo, bool)) {
+	sqlErrorExtractors = append(sqlErrorExtractors, extractor)
+}
+
+// References:
+// https://msdn.microsoft.com/en-us/library/cc645603.aspx
+// https://azure.microsoft.com/en-us/documentation/articles/sql-database-develop-error-messages/
+var transientSqlErrors = map[int]bool{
+	-2:    true, // timeout expired
+	64:    true, // connection was successfully established, but an error occurred later
+	121:   true, // semaphore timeout
+	233:   true, // no process is on the other end of the pipe
+	701:   true, // insufficient system memory
+	802:   true, // insufficient memory available in the buffer pool
+	1204:  true, // cannot obtain a lock resource
+	1205:  true, // deadlock victim
+	1222:  true, // lock request time out period exceeded
+	3702:  true, // cannot drop database because it is currently in use
+	5061:  true, // alter database failed because a lock could not be placed
+	8645:  true, // timeout waiting for memory resources
+	8651:  true, // could not perform the operation because the requested memory grant was not available
+	10053: true, // transport-level error, connection aborted
+	10054: true, // transport-level error, connection reset by peer
+	10060: true, // network-related error, connection timed out
+	40197: true,
+	40501: true,
+	40613: true,
+}
+
+var conflictSqlErrors = map[int]bool{
+	1801:  true, // database already exists
+	15023: true, // user, group, or role already exists in the current database
+	15025: true, // the server principal already exists
+	15063: true, // the login already has an account under a different user name
+}
+
+var notFoundSqlErrors = map[int]bool{
+	911:   true, // database does not exist
+	3701:  true, // cannot drop the database because it does not exist
+	15151: true, // cannot drop the user because it does not exist
+}
+
+// ODBC SQLSTATEs that indicate the driver handles are no longer usable
+var fatalOdbcStates = map[string]bool{
+	"HY001": true, // memory allocation error
+	"HY010": true, // function sequence error
+	"HY013": true, // memory management error
+}
+
+var transientOdbcStates = map[string]bool{
+	"08001": true, // client unable to establish connection
+	"08S01": true, // communication link failure
+	"HYT00": true, // timeout expired
+	"HYT01": true, // connection timeout expired
+}
+
+// ClassifyError returns the ErrorClass of an error returned by a go sql driver
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return UnknownError
+	}
+
+	if provErr, ok := err.(*ProvisionerError); ok {
+		return provErr.Class
+	}
+
+	if err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return TransientError
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return TransientError
+	}
+
+	for _, extractor := range sqlErrorExtractors {
+		info, ok := extractor(err)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case fatalOdbcStates[info.State]:
+			return FatalError
+		case transientSqlErrors[info.Number], transientOdbcStates[info.State]:
+			return TransientError
+		case conflictSqlErrors[info.Number]:
+			return ConflictError
+		case notFoundSqlErrors[info.Number]:
+			return NotFoundError
+		}
+	}
+
+	return UnknownError
+}
+
+func newProvisionerError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*ProvisionerError); ok {
+		return err
+	}
+	return &ProvisionerError{Class: ClassifyError(err), Err: err}
+}
+
+func newFatalProvisionerError(format string, args ...interface{}) error {
+	return &ProvisionerError{Class: FatalError, Err: fmt.Errorf(format, args...)}
+}
@@ -0,0 +1,57 @@
+package provisioner
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+)
+
+type fakeSqlError struct {
+	number int
+	state  string
+}
+
+func (e fakeSqlError) Error() string {
+	return "fake sql error"
+}
+
+func init() {
+	registerSqlErrorExtractor(func(err error) (sqlErrorInfo, bool) {
+		fakeErr, ok := err.(fakeSqlError)
+		if !ok {
+			return sqlErrorInfo{}, false
+		}
+		return sqlErrorInfo{Number: fakeErr.number, State: fakeErr.state}, true
+	})
+}
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected ErrorClass
+	}{
+		{errors.New("something else"), UnknownError},
+		{driver.ErrBadConn, TransientError},
+		{fakeSqlError{number: 1205}, TransientError},
+		{fakeSqlError{number: 1222}, TransientError},
+		{fakeSqlError{state: "08S01"}, TransientError},
+		{fakeSqlError{number: 1801}, ConflictError},
+		{fakeSqlError{number: 15023}, ConflictError},
+		{fakeSqlError{number: 911}, NotFoundError},
+		{fakeSqlError{number: 15151}, NotFoundError},
+		{fakeSqlError{number: 15151, state: "HY010"}, FatalError},
+		{fakeSqlError{number: 102}, UnknownError},
+		{newFatalProvisionerError("rollback failed"), FatalError},
+		{newProvisionerError(fakeSqlError{number: 1205}), TransientError},
+	}
+
+	for _, c := range cases {
+		// Act
+		class := ClassifyError(c.err)
+
+		// Assert
+		if class != c.expected {
+			t.Errorf("ClassifyError(%#v) returned %v, expected %v", c.err, class, c.expected)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package provisioner
+
+import (
+	"strings"
+)
+
+// The names and values that can not be sent as query parameters (the ? placeholders),
+// e.g. the database name of "create database", are compiled into the sql templates.
+// Every fmt template parameter is used in a single context:
+// inside brackets, e.g. [%[1]v], escaped with escapeIdentifier,
+// or inside a string literal, e.g. N'%[2]v', escaped with escapeLiteral.
+// Only values validated by the provisioner (e.g. the collation) are compiled without escaping.
+
+// escapeIdentifier escapes a value used inside a [...] delimited identifier
+func escapeIdentifier(value string) string {
+	return strings.Replace(value, "]", "]]", -1)
+}
+
+// escapeLiteral escapes a value used inside a '...' or N'...' string literal
+func escapeLiteral(value string) string {
+	return strings.Replace(value, "'", "''", -1)
+}
+
+// likePrefix escapes the LIKE wildcards in the prefix
+func likePrefix(prefix string) string {
+	escaper := strings.NewReplacer("[", "[[]", "%", "[%]", "_", "[_]")
+	return escaper.Replace(prefix)
+}
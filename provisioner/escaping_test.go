@@ -0,0 +1,206 @@
+package provisioner
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// Fragments that break out of identifiers, literals, fmt templates or statements when not escaped
+var nastyFragments = []string{
+	"]", "]]", "[", "'", "''", "N'", "\"", ";", "--", "/*", "*/", "\\", "\n", "\r\n", "\t",
+	"%", "%%", "%[1]v", "%[2]v", "%s", "%!(EXTRA", "?", "_", "~deleted~",
+	"; drop database [master] --", "'; shutdown --", "] ; exec xp_cmdshell 'dir' --",
+	"é", "中", "’", "＇", "ʼ",
+}
+
+// fuzzValue generates strings made of nasty fragments and random runes
+type fuzzValue string
+
+func (fuzzValue) Generate(random *rand.Rand, size int) reflect.Value {
+	parts := []string{}
+	for i := random.Intn(size + 1); i >= 0; i-- {
+		if random.Intn(3) == 0 {
+			parts = append(parts, string(rune(0x20+random.Intn(0x2000))))
+		} else {
+			parts = append(parts, nastyFragments[random.Intn(len(nastyFragments))])
+		}
+	}
+	return reflect.ValueOf(fuzzValue(strings.Join(parts, "")))
+}
+
+type sqlToken struct {
+	kind  byte // '[' or '\''
+	value string
+}
+
+// tokenizeSql splits a statement into the delimited identifiers and string literals, unescaped,
+// and the skeleton of the statement with empty tokens.
+func tokenizeSql(statement string) (string, []sqlToken, error) {
+	skeleton := ""
+	tokens := []sqlToken{}
+
+	for i := 0; i < len(statement); i++ {
+		start := statement[i]
+		if start != '[' && start != '\'' {
+			skeleton += statement[i : i+1]
+			continue
+		}
+
+		end := byte(']')
+		if start == '\'' {
+			end = '\''
+		}
+
+		value := ""
+		i++
+		for ; i < len(statement); i++ {
+			if statement[i] == end {
+				if i+1 < len(statement) && statement[i+1] == end {
+					value += string(end)
+					i++
+					continue
+				}
+				break
+			}
+			value += statement[i : i+1]
+		}
+		if i == len(statement) {
+			return "", nil, fmt.Errorf("unterminated %c in %q", start, statement)
+		}
+
+		skeleton += string(start) + string(end)
+		tokens = append(tokens, sqlToken{kind: start, value: value})
+	}
+
+	return skeleton, tokens, nil
+}
+
+type escapedTemplate struct {
+	name     string
+	template []string
+	// escape function of each template parameter, nil for the values validated by the provisioner
+	escapes []func(string) string
+}
+
+var escapedTemplates = []escapedTemplate{
+	{"isUserCreatedTemplate", []string{isUserCreatedTemplate}, []func(string) string{escapeIdentifier}},
+	{"isRoleCreatedTemplate", []string{isRoleCreatedTemplate}, []func(string) string{escapeIdentifier}},
+	{"databaseFileSizesTemplate", []string{databaseFileSizesTemplate}, []func(string) string{escapeIdentifier}},
+	{"listUsersTemplate", []string{listUsersTemplate}, []func(string) string{escapeIdentifier}},
+	{"userRolesTemplate", []string{userRolesTemplate}, []func(string) string{escapeIdentifier}},
+	{"disableUserTemplate", disableUserTemplate, []func(string) string{escapeIdentifier, escapeIdentifier}},
+	{"softDeleteDatabaseTemplate", softDeleteDatabaseTemplate, []func(string) string{escapeIdentifier, escapeIdentifier}},
+	{"onlineTombstoneTemplate", onlineTombstoneTemplate, []func(string) string{escapeIdentifier}},
+	{"finalBackupTemplate", finalBackupTemplate, []func(string) string{escapeIdentifier, escapeLiteral}},
+	{"listBackupFilesTemplate", []string{listBackupFilesTemplate}, []func(string) string{escapeLiteral}},
+	{"deleteBackupFileTemplate", deleteBackupFileTemplate, []func(string) string{escapeLiteral}},
+	{"setDatabasePropertyTemplate", []string{setDatabasePropertyTemplate}, []func(string) string{escapeIdentifier}},
+	{"setUserPropertyTemplate", []string{setUserPropertyTemplate}, []func(string) string{escapeIdentifier}},
+	{"databasePropertiesTemplate", []string{databasePropertiesTemplate}, []func(string) string{escapeIdentifier}},
+	{"userPropertyTemplate", []string{userPropertyTemplate}, []func(string) string{escapeIdentifier}},
+	{"deleteDatabasePropertyTemplate", []string{deleteDatabasePropertyTemplate}, []func(string) string{escapeIdentifier}},
+	{"setReadOnlyTemplate", setReadOnlyTemplate, []func(string) string{escapeIdentifier}},
+	{"setReadWriteTemplate", setReadWriteTemplate, []func(string) string{escapeIdentifier}},
+	{"databaseSettingsTemplate", databaseSettingsTemplate(DatabaseSettings{InitialDataSizeMB: 10, MaxLogSizeMB: 20, DataFileGrowth: "10%", RecoveryModel: "full"}), []func(string) string{escapeIdentifier, escapeLiteral}},
+	{"unlimitedMaxSizesTemplate", unlimitedMaxSizesTemplate(DatabaseSettings{}), []func(string) string{escapeIdentifier, escapeLiteral}},
+}
+
+// checkTemplate compiles the template with the escaped values, and with placeholder values
+// that need no escaping. Both must have the same statements, with the values in the same tokens.
+func checkTemplate(t *testing.T, tmpl escapedTemplate, values []string) bool {
+	escapedArgs := []interface{}{}
+	placeholderArgs := []interface{}{}
+	placeholders := []string{}
+	for i, escape := range tmpl.escapes {
+		placeholder := fmt.Sprintf("VALUE%d", i+1)
+		if escape == nil {
+			// not escaped by the provisioner, use a valid value
+			escapedArgs = append(escapedArgs, placeholder)
+		} else {
+			escapedArgs = append(escapedArgs, escape(values[i]))
+			placeholders = append(placeholders, placeholder, values[i])
+		}
+		placeholderArgs = append(placeholderArgs, placeholder)
+	}
+	unescaper := strings.NewReplacer(placeholders...)
+
+	for _, line := range tmpl.template {
+		expectedSkeleton, expectedTokens, err := tokenizeSql(compileTemplate(line, placeholderArgs...))
+		if err != nil {
+			t.Errorf("%s: %v", tmpl.name, err)
+			return false
+		}
+
+		compiled := compileTemplate(line, escapedArgs...)
+		skeleton, tokens, err := tokenizeSql(compiled)
+		if err != nil {
+			t.Errorf("%s: %v", tmpl.name, err)
+			return false
+		}
+
+		if skeleton != expectedSkeleton {
+			t.Errorf("%s: the values changed the statement %q to %q", tmpl.name, expectedSkeleton, skeleton)
+			return false
+		}
+		for i := range tokens {
+			expected := sqlToken{kind: expectedTokens[i].kind, value: unescaper.Replace(expectedTokens[i].value)}
+			if tokens[i] != expected {
+				t.Errorf("%s: token %d of %q is %q, expected %q", tmpl.name, i, compiled, tokens[i].value, expected.value)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestEscapedTemplatesFuzz(t *testing.T) {
+	for _, tmpl := range escapedTemplates {
+		tmpl := tmpl
+		property := func(a, b, c, d, e fuzzValue) bool {
+			return checkTemplate(t, tmpl, []string{string(a), string(b), string(c), string(d), string(e)})
+		}
+
+		err := quick.Check(property, &quick.Config{MaxCount: 500})
+		if err != nil {
+			t.Errorf("%s: %v", tmpl.name, err)
+		}
+	}
+}
+
+func TestEscapedTemplatesNastyValues(t *testing.T) {
+	for _, tmpl := range escapedTemplates {
+		for _, fragment := range nastyFragments {
+			values := []string{fragment, "x" + fragment, fragment + "x", fragment + fragment, "a" + fragment + "b"}
+			checkTemplate(t, tmpl, values)
+		}
+	}
+}
+
+func TestCompileTemplateKeepsFmtLookalikes(t *testing.T) {
+	// Act
+	compiled := compileTemplate("drop database [%[1]v]", "cf-%!(EXTRA string=x)")
+	template := "use master"
+	unindexed := compileTemplate(template, "cf-db")
+
+	// Assert
+	if compiled != "drop database [cf-%!(EXTRA string=x)]" {
+		t.Errorf("unexpected compiled template %q", compiled)
+	}
+	if unindexed != "use master" {
+		t.Errorf("unexpected compiled template %q", unindexed)
+	}
+}
+
+func TestLikePrefix(t *testing.T) {
+	// Act
+	pattern := likePrefix("cf_[x]%")
+
+	// Assert
+	if pattern != "cf[_][[]x][%]" {
+		t.Errorf("unexpected LIKE pattern %q", pattern)
+	}
+}
@@ -0,0 +1,109 @@
+package provisioner
+
+import (
+	"database/sql"
+	"sort"
+)
+
+// ExtendedPropertyPrefix is the prefix of the extended properties set by the broker,
+// e.g. cf_organization_guid, so they do not collide with the properties of the applications
+const ExtendedPropertyPrefix = "cf_"
+
+// fmt template parameters: 1.databaseId
+// query parameters: property name, property value
+var setDatabasePropertyTemplate = "declare @name sysname = ?, @value sql_variant = ?;  if exists (select 1 from [%[1]v].sys.extended_properties where class = 0 and name = @name)  exec [%[1]v].sys.sp_updateextendedproperty @name = @name, @value = @value  else  exec [%[1]v].sys.sp_addextendedproperty @name = @name, @value = @value"
+
+// fmt template parameters: 1.databaseId
+// query parameters: userId, property name, property value
+var setUserPropertyTemplate = "declare @user sysname = ?, @name sysname = ?, @value sql_variant = ?;  if exists (select 1 from [%[1]v].sys.extended_properties p join [%[1]v].sys.database_principals u on u.principal_id = p.major_id where p.class = 4 and u.name = @user and p.name = @name)  exec [%[1]v].sys.sp_updateextendedproperty @name = @name, @value = @value, @level0type = N'USER', @level0name = @user  else  exec [%[1]v].sys.sp_addextendedproperty @name = @name, @value = @value, @level0type = N'USER', @level0name = @user"
+
+// fmt template parameters: 1.databaseId
+// query parameters: property name
+var deleteDatabasePropertyTemplate = "declare @name sysname = ?;  if exists (select 1 from [%[1]v].sys.extended_properties where class = 0 and name = @name)  exec [%[1]v].sys.sp_dropextendedproperty @name = @name"
+
+// fmt template parameters: 1.databaseId
+// query parameters: LIKE pattern of the property names
+var databasePropertiesTemplate = "select name, cast(value as nvarchar(4000))  from [%[1]v].sys.extended_properties  where class = 0 and name like ?"
+
+// fmt template parameters: 1.databaseId
+// query parameters: property name
+var userPropertyTemplate = "select u.name, cast(p.value as nvarchar(4000))  from [%[1]v].sys.extended_properties p  join [%[1]v].sys.database_principals u on u.principal_id = p.major_id  where p.class = 4 and p.name = ?"
+
+// SetDatabaseProperties adds or updates the extended properties of the database
+func (provisioner *MssqlProvisioner) SetDatabaseProperties(databaseId string, properties map[string]string) error {
+	sqlLine := compileTemplate(setDatabasePropertyTemplate, escapeIdentifier(databaseId))
+
+	for _, name := range sortedPropertyNames(properties) {
+		err := provisioner.execute("setDatabaseProperty", sqlLine, name, properties[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetUserProperties adds or updates the extended properties of a database user
+func (provisioner *MssqlProvisioner) SetUserProperties(databaseId, userId string, properties map[string]string) error {
+	sqlLine := compileTemplate(setUserPropertyTemplate, escapeIdentifier(databaseId))
+
+	for _, name := range sortedPropertyNames(properties) {
+		err := provisioner.execute("setUserProperty", sqlLine, userId, name, properties[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteDatabaseProperty removes an extended property of the database, if it exists
+func (provisioner *MssqlProvisioner) DeleteDatabaseProperty(databaseId string, name string) error {
+	return provisioner.execute("deleteDatabaseProperty", compileTemplate(deleteDatabasePropertyTemplate, escapeIdentifier(databaseId)), name)
+}
+
+// GetDatabaseProperties returns the extended properties of the database set by the broker
+func (provisioner *MssqlProvisioner) GetDatabaseProperties(databaseId string) (map[string]string, error) {
+	properties := map[string]string{}
+
+	err := provisioner.queryRows("databaseProperties", compileTemplate(databasePropertiesTemplate, escapeIdentifier(databaseId)), func(rows *sql.Rows) error {
+		var name string
+		var value sql.NullString
+		err := rows.Scan(&name, &value)
+		if err != nil {
+			return err
+		}
+		properties[name] = value.String
+		return nil
+	}, likePrefix(ExtendedPropertyPrefix)+"%")
+
+	return properties, err
+}
+
+// GetUserProperty returns the value of an extended property of the database users, keyed by user name.
+// The users without the property are not returned.
+func (provisioner *MssqlProvisioner) GetUserProperty(databaseId string, name string) (map[string]string, error) {
+	values := map[string]string{}
+
+	err := provisioner.queryRows("userProperty", compileTemplate(userPropertyTemplate, escapeIdentifier(databaseId)), func(rows *sql.Rows) error {
+		var username string
+		var value sql.NullString
+		err := rows.Scan(&username, &value)
+		if err != nil {
+			return err
+		}
+		values[username] = value.String
+		return nil
+	}, name)
+
+	return values, err
+}
+
+func sortedPropertyNames(properties map[string]string) []string {
+	names := []string{}
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
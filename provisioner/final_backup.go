@@ -0,0 +1,143 @@
+package provisioner
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pivotal-golang/lager"
+)
+
+// FinalBackupSettings configure the backup taken before a database is deleted
+type FinalBackupSettings struct {
+	Enabled bool `json:"enabled"`
+	// Directory on the SQL Server machine, or a UNC share, where the backup files are written
+	Directory string `json:"directory"`
+	// Final backups older than this are deleted after each final backup. 0 keeps all backups.
+	// Only the files named like the final backups of the databases with the NamePrefix are deleted.
+	RetentionDays int `json:"retentionDays"`
+	// Delete the database even if the final backup fails
+	IgnoreBackupFailure bool `json:"ignoreBackupFailure"`
+	// The prefix of the managed database names, set by the broker from its dbIdentifierPrefix
+	NamePrefix string `json:"-"`
+}
+
+// Validate checks the settings of an enabled final backup
+func (settings FinalBackupSettings) Validate() error {
+	if !settings.Enabled {
+		return nil
+	}
+	if settings.Directory == "" {
+		return fmt.Errorf("the final backup directory is required")
+	}
+	if settings.RetentionDays < 0 {
+		return fmt.Errorf("invalid retentionDays %d", settings.RetentionDays)
+	}
+	return nil
+}
+
+const finalBackupTimestampFormat = "20060102T150405Z"
+
+// fmt template parameters: 1.databaseId, 2.backup file path
+var finalBackupTemplate = []string{
+	"backup database [%[1]v] to disk = N'%[2]v' with init, checksum",
+}
+
+// Lists the files of the directory, with the columns subdirectory, depth and file
+// fmt template parameters: 1.directory
+var listBackupFilesTemplate = "execute master.sys.xp_dirtree N'%[1]v', 1, 1"
+
+// Deletes a backup file (only a file with a valid backup header)
+// fmt template parameters: 1.file path
+var deleteBackupFileTemplate = []string{
+	"execute master.dbo.xp_delete_file 0, N'%[1]v'",
+}
+
+// finalBackupFile returns the path of the backup file named with the database and the time of the backup
+func finalBackupFile(directory, databaseId string, now time.Time) string {
+	return backupFilePath(directory, databaseId+"_"+now.UTC().Format(finalBackupTimestampFormat)+".bak")
+}
+
+// backupFilePath joins the directory and the file name with the separator used by the directory
+func backupFilePath(directory, name string) string {
+	separator := `\`
+	if strings.Contains(directory, "/") && !strings.Contains(directory, `\`) {
+		separator = "/"
+	}
+	return strings.TrimRight(directory, separator) + separator + name
+}
+
+// expiredFinalBackups returns the files named <name prefix>..._<timestamp>.bak, like the final
+// backups of the managed databases, with a timestamp before the cutoff. The other files are kept.
+func expiredFinalBackups(files []string, namePrefix string, cutoff time.Time) []string {
+	expired := []string{}
+	for _, name := range files {
+		if !strings.HasPrefix(name, namePrefix) || !strings.HasSuffix(name, ".bak") {
+			continue
+		}
+		base := strings.TrimSuffix(name, ".bak")
+		separator := strings.LastIndex(base, "_")
+		if separator <= len(namePrefix) {
+			continue
+		}
+		backupTime, err := time.Parse(finalBackupTimestampFormat, base[separator+1:])
+		if err != nil || !backupTime.Before(cutoff) {
+			continue
+		}
+		expired = append(expired, name)
+	}
+	return expired
+}
+
+// deleteOldFinalBackups deletes the final backups older than the cutoff from the directory
+func (provisioner *MssqlProvisioner) deleteOldFinalBackups(settings FinalBackupSettings, cutoff time.Time) error {
+	files := []string{}
+	err := provisioner.queryRows("listBackupFiles", compileTemplate(listBackupFilesTemplate, escapeLiteral(settings.Directory)), func(rows *sql.Rows) error {
+		var name string
+		var depth, isFile int
+		err := rows.Scan(&name, &depth, &isFile)
+		if err == nil && isFile == 1 {
+			files = append(files, name)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range expiredFinalBackups(files, settings.NamePrefix, cutoff) {
+		file := backupFilePath(settings.Directory, name)
+		err = provisioner.executeTemplateWithoutTx("deleteBackupFile", deleteBackupFileTemplate, escapeLiteral(file))
+		if err != nil {
+			return err
+		}
+		provisioner.logger.Info("final-backup-deleted", lager.Data{"file": file})
+	}
+	return nil
+}
+
+// BackupDatabase writes a full backup of the database into the final backup directory,
+// and deletes the final backups older than the retention period.
+// Returns the path of the backup file.
+func (provisioner *MssqlProvisioner) BackupDatabase(databaseId string, settings FinalBackupSettings) (string, error) {
+	now := time.Now()
+	backupFile := finalBackupFile(settings.Directory, databaseId, now)
+
+	err := provisioner.executeTemplateWithoutTx("finalBackup", finalBackupTemplate, escapeIdentifier(databaseId), escapeLiteral(backupFile))
+	if err != nil {
+		return "", &ProvisionerError{Class: ClassifyError(err), Err: fmt.Errorf("final backup to %s failed: %v", backupFile, err)}
+	}
+
+	provisioner.logger.Info("final-backup-created", lager.Data{"databaseId": databaseId, "file": backupFile})
+
+	if settings.RetentionDays > 0 {
+		err = provisioner.deleteOldFinalBackups(settings, now.AddDate(0, 0, -settings.RetentionDays))
+		if err != nil {
+			// The backup is done, the cleanup will be retried with the next final backup
+			provisioner.logger.Error("final-backup-cleanup-failed", err, lager.Data{"directory": settings.Directory})
+		}
+	}
+
+	return backupFile, nil
+}
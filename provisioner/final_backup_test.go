@@ -0,0 +1,67 @@
+package provisioner
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFinalBackupFile(t *testing.T) {
+	now := time.Date(2016, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	cases := []struct {
+		directory string
+		expected  string
+	}{
+		{`D:\Backups`, `D:\Backups\cf-db_20160304T050607Z.bak`},
+		{`D:\Backups\`, `D:\Backups\cf-db_20160304T050607Z.bak`},
+		{`\\fileserver\final backups`, `\\fileserver\final backups\cf-db_20160304T050607Z.bak`},
+		{"/var/opt/mssql/backups/", "/var/opt/mssql/backups/cf-db_20160304T050607Z.bak"},
+	}
+
+	for _, c := range cases {
+		// Act
+		file := finalBackupFile(c.directory, "cf-db", now)
+
+		// Assert
+		if file != c.expected {
+			t.Errorf("finalBackupFile(%q) = %q, expected %q", c.directory, file, c.expected)
+		}
+	}
+}
+
+func TestFinalBackupSettingsValidate(t *testing.T) {
+	if err := (FinalBackupSettings{}).Validate(); err != nil {
+		t.Errorf("disabled final backup should be valid, got %v", err)
+	}
+	if err := (FinalBackupSettings{Enabled: true}).Validate(); err == nil {
+		t.Errorf("enabled final backup without directory should be invalid")
+	}
+	if err := (FinalBackupSettings{Enabled: true, Directory: `D:\Backups`, RetentionDays: -1}).Validate(); err == nil {
+		t.Errorf("negative retentionDays should be invalid")
+	}
+}
+
+func TestExpiredFinalBackups(t *testing.T) {
+	cutoff := time.Date(2016, 3, 4, 0, 0, 0, 0, time.UTC)
+	files := []string{
+		"cf-db1_20160301T050607Z.bak",
+		"cf-db_2_20160303T235959Z.bak",
+		"cf-db3_20160304T000000Z.bak",
+		"cf-db4_20160305T050607Z.bak",
+		"cf-db5_20160301T050607Z.trn",
+		"master_20160301T050607Z.bak",
+		"cf-db6_full.bak",
+		"cf-_20160301T050607Z.bak",
+		"nightly.bak",
+	}
+
+	// Act
+	expired := expiredFinalBackups(files, "cf-", cutoff)
+
+	// Assert
+	expected := []string{"cf-db1_20160301T050607Z.bak", "cf-db_2_20160303T235959Z.bak"}
+	if !reflect.DeepEqual(expired, expected) {
+		t.Errorf("expected only the old final backups of the managed databases %v, got %v", expected, expired)
+	}
+}
@@ -5,6 +5,16 @@
 package provisioner
 
 import (
-	_ "github.com/denisenkom/go-mssqldb"
+	mssql "github.com/denisenkom/go-mssqldb"
 	_ "golang.org/x/crypto/md4" // workaround. Godep will not save this package from go-mssqldb
 )
+
+func init() {
+	registerSqlErrorExtractor(func(err error) (sqlErrorInfo, bool) {
+		mssqlErr, ok := err.(mssql.Error)
+		if !ok {
+			return sqlErrorInfo{}, false
+		}
+		return sqlErrorInfo{Number: int(mssqlErr.Number)}, true
+	})
+}
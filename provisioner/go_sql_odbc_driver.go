@@ -14,5 +14,15 @@
 package provisioner
 
 import (
-	_ "code.google.com/p/odbc"
+	"code.google.com/p/odbc"
 )
+
+func init() {
+	registerSqlErrorExtractor(func(err error) (sqlErrorInfo, bool) {
+		odbcErr, ok := err.(*odbc.Error)
+		if !ok || len(odbcErr.Diag) == 0 {
+			return sqlErrorInfo{}, false
+		}
+		return sqlErrorInfo{Number: odbcErr.Diag[0].NativeError, State: odbcErr.Diag[0].State}, true
+	})
+}
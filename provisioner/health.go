@@ -0,0 +1,72 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Contained databases were added in SQL Server 2012
+const MinContainedDatabasesMajorVersion = 11
+
+var productVersionTemplate = "select cast(serverproperty('ProductVersion') as nvarchar(128))"
+
+var containedDatabaseAuthenticationTemplate = "select cast(value_in_use as int)  from [master].sys.configurations  where name = 'contained database authentication'"
+
+// The encryption of the connection of the query
+var connectionEncryptedTemplate = "select encrypt_option  from [master].sys.dm_exec_connections  where session_id = @@spid"
+
+// Ping checks the connection to the SQL Server
+func (provisioner *MssqlProvisioner) Ping() error {
+	if provisioner.dbClient == nil {
+		return errors.New("the provisioner is not initialized")
+	}
+
+	start := time.Now()
+	err := provisioner.dbClient.Ping()
+	provisioner.observe("ping", start, err)
+	if err != nil {
+		return newProvisionerError(err)
+	}
+	return nil
+}
+
+// ProductVersion returns the SQL Server version, e.g. 11.0.2100.60
+func (provisioner *MssqlProvisioner) ProductVersion() (string, error) {
+	var version string
+	err := provisioner.queryScalar("productVersion", productVersionTemplate, &version)
+	return version, err
+}
+
+// IsContainedDatabaseAuthenticationEnabled checks the server option required by the contained users of the bindings
+func (provisioner *MssqlProvisioner) IsContainedDatabaseAuthenticationEnabled() (bool, error) {
+	res := 0
+
+	err := provisioner.queryScalar("containedDatabaseAuthentication", containedDatabaseAuthenticationTemplate, &res)
+	if err != nil {
+		return false, err
+	}
+	return res == 1, nil
+}
+
+// ProductMajorVersion parses the major version of a SQL Server ProductVersion
+func ProductMajorVersion(version string) (int, error) {
+	major, err := strconv.Atoi(strings.SplitN(strings.TrimSpace(version), ".", 2)[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid SQL Server version %q", version)
+	}
+	return major, nil
+}
+
+// IsConnectionEncrypted checks whether the connections of the provisioner use tls
+func (provisioner *MssqlProvisioner) IsConnectionEncrypted() (bool, error) {
+	var encryptOption string
+
+	err := provisioner.queryScalar("connectionEncrypted", connectionEncryptedTemplate, &encryptOption)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(encryptOption, "TRUE"), nil
+}
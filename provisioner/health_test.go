@@ -0,0 +1,27 @@
+package provisioner
+
+import (
+	"testing"
+)
+
+func TestProductMajorVersion(t *testing.T) {
+	versions := map[string]int{
+		"11.0.2100.60": 11,
+		"10.50.1600.1": 10,
+		"15.0.2000.5":  15,
+	}
+
+	for version, expected := range versions {
+		// Act
+		major, err := ProductMajorVersion(version)
+
+		// Assert
+		if err != nil || major != expected {
+			t.Errorf("expected %d for %q, got %d, %v", expected, version, major, err)
+		}
+	}
+
+	if _, err := ProductMajorVersion(""); err == nil {
+		t.Errorf("expected an error for an empty version")
+	}
+}
@@ -5,50 +5,57 @@ import (
 	"fmt"
 	"github.com/pivotal-golang/lager"
 	"strings"
+	"time"
 )
 
-// Sql templates are executed as a trascation and on query per array element
-// The templates can be extracted to an external file (e.g. json or yaml)
+// The sql of the provisioner operations (create and delete of the databases and users)
+// is in the SqlTemplateSet of the provisioner (see sql_templates.go).
+// The queries and the other statements are fmt templates.
 
-// fmt template paramters: 1.databaseId
-var createDatabaseTemplate = []string{
-	"create database [%[1]v] containment = partial",
-}
+// query parameters: databaseId
+var isDatabaseCreatedTemplate = "select count(*)  from [master].sys.databases  where name = ?"
 
 // fmt template parameters: 1.databaseId
-var deleteDatabaseTemplate = []string{
-	"alter database [%[1]v] set single_user with rollback immediate",
-	"drop database [%[1]v]",
-}
+// query parameters: userId
+var isUserCreatedTemplate = "select count(*)  from [%[1]v].sys.database_principals  where name = ?"
 
-// fmt template parameters: 1.databaseId, 2.userId, 3.password
-var createUserTemplate = []string{
-	"use [%[1]v]",
-	"create user [%[2]v] with password='%[3]v'",
-	"alter role [db_owner] add member [%[2]v]",
-	"use master",
-}
-
-// fmt template parameters: 1.databaseId, 2.userId
-var deleteUserTemplate = []string{
-	"use [%[1]v]",
-	"drop user [%[2]v]",
-	"use master",
-}
+// fmt template parameters: 1.databaseId
+// query parameters: role
+var isRoleCreatedTemplate = "select count(*)  from [%[1]v].sys.database_principals  where type = 'R' and name = ?"
 
+// Returns the allocated size in MB of the data (type 0) and log (type 1) files
 // fmt template paramters: 1.databaseId
-var isDatabaseCreatedTemplate = "select count(*)  from [master].sys.databases  where name = '%[1]v'"
-
-// fmt template parameters: 1.databaseId, 2.userId
-var isUserCreatedTemplate = "select count(*)  from [%[1]v].sys.database_principals  where name = '%[2]v'"
+var databaseFileSizesTemplate = "select type, sum(size) / 128  from [%[1]v].sys.database_files  where type in (0, 1)  group by type"
+
+// Returns the number of databases and their total allocated size in MB
+// query parameters: LIKE pattern of the database names
+var managedDatabasesUsageTemplate = "select count(distinct d.database_id), isnull(sum(cast(mf.size as bigint)) / 128, 0)  from [master].sys.databases d  left join [master].sys.master_files mf on mf.database_id = d.database_id  where d.name like ?"
+
+// query parameters: databaseId
+var databaseStateTemplate = "select state_desc, user_access_desc  from [master].sys.databases  where name = ?"
+
+// DatabaseState is the state of a database as reported by sys.databases
+type DatabaseState struct {
+	Exists bool
+	// ONLINE, RESTORING, RECOVERING, RECOVERY_PENDING, SUSPECT, EMERGENCY, OFFLINE, ...
+	State string
+	// MULTI_USER, SINGLE_USER or RESTRICTED_USER
+	UserAccess string
+}
 
 type MssqlProvisioner struct {
 	dbClient         *sql.DB
 	goSqlDriver      string
 	connectionParams map[string]string
 	logger           lager.Logger
+	templates        *SqlTemplateSet
+	observer         SqlCallObserver
 }
 
+// SqlCallObserver is called after each sql call of the provisioner with the name of its template,
+// e.g. "isUserCreated", or of its template set operation, e.g. "createUser"
+type SqlCallObserver func(template string, duration time.Duration, err error)
+
 func buildConnectionString(connectionParams map[string]string) string {
 	var res string = ""
 	for k, v := range connectionParams {
@@ -63,9 +70,33 @@ func NewMssqlProvisioner(logger lager.Logger, goSqlDriver string, connectionPara
 		goSqlDriver:      goSqlDriver,
 		connectionParams: connectionParams,
 		logger:           logger,
+		templates:        DefaultSqlTemplates(),
 	}
 }
 
+// WithTemplates returns a provisioner that uses the template set and the connection of this provisioner
+func (provisioner *MssqlProvisioner) WithTemplates(templates *SqlTemplateSet) *MssqlProvisioner {
+	if templates == nil {
+		return provisioner
+	}
+	withTemplates := *provisioner
+	withTemplates.templates = templates
+	return &withTemplates
+}
+
+// ObserveSqlCalls sets the observer of the sql calls, e.g. to record metrics
+func (provisioner *MssqlProvisioner) ObserveSqlCalls(observer SqlCallObserver) {
+	provisioner.observer = observer
+}
+
+// DbStats returns the connection pool statistics of the provisioner
+func (provisioner *MssqlProvisioner) DbStats() sql.DBStats {
+	if provisioner.dbClient == nil {
+		return sql.DBStats{}
+	}
+	return provisioner.dbClient.Stats()
+}
+
 func (provisioner *MssqlProvisioner) Init() error {
 	var err error = nil
 	connString := buildConnectionString(provisioner.connectionParams)
@@ -92,26 +123,135 @@ func (provisioner *MssqlProvisioner) Close() error {
 	return err
 }
 
-func (provisioner *MssqlProvisioner) CreateDatabase(databaseId string) error {
-	return provisioner.executeTemplateWithoutTx(createDatabaseTemplate, databaseId)
+func (provisioner *MssqlProvisioner) CreateDatabase(databaseId string, settings DatabaseSettings) error {
+	err := settings.Validate()
+	if err != nil {
+		return err
+	}
+
+	tombstoned, err := provisioner.hasTombstones(databaseId)
+	if err != nil {
+		return err
+	}
+
+	data := SqlTemplateData{DatabaseName: databaseId, Collation: settings.Collation}
+	if tombstoned {
+		data.DataFile, data.LogFile, err = provisioner.besideTombstonesFiles(databaseId)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = provisioner.executeSteps(provisioner.templates.CreateDatabase, data)
+	if err != nil {
+		return err
+	}
+
+	err = provisioner.executeTemplateWithoutTx("databaseSettings", databaseSettingsTemplate(settings), escapeIdentifier(databaseId), escapeLiteral(databaseId))
+	if err != nil {
+		// Do not leave behind a database without the plan settings
+		dropErr := provisioner.executeSteps(provisioner.templates.DeleteDatabase, SqlTemplateData{DatabaseName: databaseId})
+		if dropErr != nil {
+			provisioner.logger.Error("mssql-cleanup-failed", dropErr, lager.Data{"databaseId": databaseId})
+		}
+		return err
+	}
+
+	return nil
+}
+
+// UpdateDatabase applies new settings to an existing database, e.g. after a plan change.
+// Zero values keep the current settings, unless resetUnset is set: then the unset max sizes are
+// set to unlimited and an unset recovery model to the one of a new database, e.g. for a plan change.
+// Initial sizes smaller than the current file sizes are ignored.
+// Returns a DatabaseTooLargeError if the current files are larger than the new max sizes.
+// The collation of an existing database is not changed.
+func (provisioner *MssqlProvisioner) UpdateDatabase(databaseId string, settings DatabaseSettings, resetUnset bool) error {
+	err := settings.Validate()
+	if err != nil {
+		return err
+	}
+
+	if resetUnset && settings.RecoveryModel == "" {
+		settings.RecoveryModel, err = provisioner.defaultRecoveryModel()
+		if err != nil {
+			return err
+		}
+	}
+
+	sizes, err := provisioner.GetDatabaseFileSizes(databaseId)
+	if err != nil {
+		return err
+	}
+
+	if settings.MaxDataSizeMB != 0 && sizes.DataSizeMB > settings.MaxDataSizeMB {
+		return &DatabaseTooLargeError{File: "data", SizeMB: sizes.DataSizeMB, MaxSizeMB: settings.MaxDataSizeMB}
+	}
+	if settings.MaxLogSizeMB != 0 && sizes.LogSizeMB > settings.MaxLogSizeMB {
+		return &DatabaseTooLargeError{File: "log", SizeMB: sizes.LogSizeMB, MaxSizeMB: settings.MaxLogSizeMB}
+	}
+
+	// MODIFY FILE can not shrink the files
+	if settings.InitialDataSizeMB <= sizes.DataSizeMB {
+		settings.InitialDataSizeMB = 0
+	}
+	if settings.InitialLogSizeMB <= sizes.LogSizeMB {
+		settings.InitialLogSizeMB = 0
+	}
+	settings.Collation = ""
+
+	template := databaseSettingsTemplate(settings)
+	if resetUnset {
+		template = append(template, unlimitedMaxSizesTemplate(settings)...)
+	}
+	return provisioner.executeTemplateWithoutTx("databaseSettings", template, escapeIdentifier(databaseId), escapeLiteral(databaseId))
+}
+
+// DeleteDatabase drops the database. If the final backup is enabled the database
+// is dropped only after a successful backup, unless IgnoreBackupFailure is set.
+func (provisioner *MssqlProvisioner) DeleteDatabase(databaseId string, backup FinalBackupSettings) error {
+	err := provisioner.finalBackup(databaseId, backup)
+	if err != nil {
+		return err
+	}
+
+	return provisioner.executeSteps(provisioner.templates.DeleteDatabase, SqlTemplateData{DatabaseName: databaseId})
 }
 
-func (provisioner *MssqlProvisioner) DeleteDatabase(databaseId string) error {
-	return provisioner.executeTemplateWithoutTx(deleteDatabaseTemplate, databaseId)
+func (provisioner *MssqlProvisioner) finalBackup(databaseId string, backup FinalBackupSettings) error {
+	if !backup.Enabled {
+		return nil
+	}
+
+	_, err := provisioner.BackupDatabase(databaseId, backup)
+	if err != nil {
+		if !backup.IgnoreBackupFailure {
+			return err
+		}
+		provisioner.logger.Error("final-backup-failure-ignored", err, lager.Data{"databaseId": databaseId})
+	}
+	return nil
 }
 
-func (provisioner *MssqlProvisioner) CreateUser(databaseId, userId, password string) error {
-	return provisioner.executeTemplateWithTx(createUserTemplate, databaseId, userId, password)
+// CreateUser creates a contained user that is a member of exactly the given database roles
+func (provisioner *MssqlProvisioner) CreateUser(databaseId, userId, password string, roles []string) error {
+	data := SqlTemplateData{DatabaseName: databaseId, Username: userId, Password: password, Roles: roles}
+	return provisioner.executeSteps(provisioner.templates.CreateUser, data)
 }
 
 func (provisioner *MssqlProvisioner) DeleteUser(databaseId, userId string) error {
-	return provisioner.executeTemplateWithTx(deleteUserTemplate, databaseId, userId)
+	return provisioner.executeSteps(provisioner.templates.DeleteUser, SqlTemplateData{DatabaseName: databaseId, Username: userId})
 }
 
+// IsDatabaseCreated ignores the soft deleted databases
 func (provisioner *MssqlProvisioner) IsDatabaseCreated(databaseId string) (bool, error) {
+	if _, ok := parseTombstoneName(databaseId); ok {
+		return false, nil
+	}
+
 	res := 0
 
-	err := provisioner.queryScalarTemplate(isDatabaseCreatedTemplate, &res, databaseId)
+	err := provisioner.queryScalar("isDatabaseCreated", isDatabaseCreatedTemplate, &res, databaseId)
 	if err != nil {
 		return false, err
 	}
@@ -124,7 +264,7 @@ func (provisioner *MssqlProvisioner) IsDatabaseCreated(databaseId string) (bool,
 func (provisioner *MssqlProvisioner) IsUserCreated(databaseId, userId string) (bool, error) {
 	res := 0
 
-	err := provisioner.queryScalarTemplate(isUserCreatedTemplate, &res, databaseId, userId)
+	err := provisioner.queryScalar("isUserCreated", compileTemplate(isUserCreatedTemplate, escapeIdentifier(databaseId)), &res, userId)
 	if err != nil {
 		return false, err
 	}
@@ -134,71 +274,239 @@ func (provisioner *MssqlProvisioner) IsUserCreated(databaseId, userId string) (b
 	return false, nil
 }
 
-func (provisioner *MssqlProvisioner) queryScalarTemplate(template string, output interface{}, targs ...interface{}) error {
-	sqlLine := compileTemplate(template, targs...)
+func (provisioner *MssqlProvisioner) IsRoleCreated(databaseId, role string) (bool, error) {
+	res := 0
 
-	provisioner.logger.Debug("mssql-exec", lager.Data{"query": sqlLine})
-	rowRes := provisioner.dbClient.QueryRow(sqlLine)
+	err := provisioner.queryScalar("isRoleCreated", compileTemplate(isRoleCreatedTemplate, escapeIdentifier(databaseId)), &res, role)
+	if err != nil {
+		return false, err
+	}
+	if res == 1 {
+		return true, nil
+	}
+	return false, nil
+}
 
-	err := rowRes.Scan(output)
+func (provisioner *MssqlProvisioner) GetDatabaseState(databaseId string) (DatabaseState, error) {
+	res := DatabaseState{}
+
+	err := provisioner.queryRow("databaseState", databaseStateTemplate, []interface{}{&res.State, &res.UserAccess}, databaseId)
+	if err == sql.ErrNoRows {
+		return res, nil
+	}
 	if err != nil {
-		provisioner.logger.Error("mssql-exec", err, lager.Data{"query": sqlLine})
+		return res, err
+	}
+
+	res.Exists = true
+	return res, nil
+}
+
+func (provisioner *MssqlProvisioner) GetDatabaseFileSizes(databaseId string) (DatabaseFileSizes, error) {
+	res := DatabaseFileSizes{}
+
+	err := provisioner.queryRows("databaseFileSizes", compileTemplate(databaseFileSizesTemplate, escapeIdentifier(databaseId)), func(rows *sql.Rows) error {
+		var fileType, sizeMB int
+		err := rows.Scan(&fileType, &sizeMB)
+		if err != nil {
+			return err
+		}
+		if fileType == 0 {
+			res.DataSizeMB = sizeMB
+		} else {
+			res.LogSizeMB = sizeMB
+		}
+		return nil
+	})
+
+	return res, err
+}
+
+// ManagedDatabasesUsage returns the number of databases whose names start with the prefix, and their total size
+func (provisioner *MssqlProvisioner) ManagedDatabasesUsage(namePrefix string) (count int, sizeMB int64, err error) {
+	err = provisioner.queryRow("managedDatabasesUsage", managedDatabasesUsageTemplate, []interface{}{&count, &sizeMB}, likePrefix(namePrefix)+"%")
+	return count, sizeMB, err
+}
+
+func (provisioner *MssqlProvisioner) observe(template string, start time.Time, err error) {
+	if provisioner.observer != nil {
+		provisioner.observer(template, time.Since(start), err)
+	}
+}
+
+func (provisioner *MssqlProvisioner) queryScalar(template string, sqlLine string, output interface{}, args ...interface{}) error {
+	return provisioner.queryRow(template, sqlLine, []interface{}{output}, args...)
+}
+
+// queryRow runs a compiled query with the query parameters.
+// Returns sql.ErrNoRows unwrapped if the query has no results.
+// Only the number of query parameters is logged, their values can be secrets, e.g. an operation error.
+func (provisioner *MssqlProvisioner) queryRow(template string, sqlLine string, outputs []interface{}, args ...interface{}) error {
+	provisioner.logger.Debug("mssql-exec", lager.Data{"query": sqlLine, "argCount": len(args)})
+	start := time.Now()
+	rowRes := provisioner.dbClient.QueryRow(sqlLine, args...)
+
+	err := rowRes.Scan(outputs...)
+	if err == sql.ErrNoRows {
+		provisioner.observe(template, start, nil)
 		return err
 	}
+	provisioner.observe(template, start, err)
+	if err != nil {
+		provisioner.logger.Error("mssql-exec", err, lager.Data{"query": sqlLine})
+		return newProvisionerError(err)
+	}
 
 	return nil
 }
 
-func (provisioner *MssqlProvisioner) executeTemplateWithTx(template []string, targs ...interface{}) error {
-	tx, err := provisioner.dbClient.Begin()
+// queryRows calls scan for each row returned by the compiled query
+func (provisioner *MssqlProvisioner) queryRows(template string, sqlLine string, scan func(rows *sql.Rows) error, args ...interface{}) (err error) {
+	provisioner.logger.Debug("mssql-exec", lager.Data{"query": sqlLine, "argCount": len(args)})
+	start := time.Now()
+	defer func() { provisioner.observe(template, start, err) }()
+	rows, err := provisioner.dbClient.Query(sqlLine, args...)
 	if err != nil {
-		return err
+		provisioner.logger.Error("mssql-exec", err, lager.Data{"query": sqlLine})
+		return newProvisionerError(err)
 	}
+	defer rows.Close()
 
-	for _, templateLine := range template {
-		sqlLine := compileTemplate(templateLine, targs...)
+	for rows.Next() {
+		err = scan(rows)
+		if err != nil {
+			provisioner.logger.Error("mssql-exec", err, lager.Data{"query": sqlLine})
+			return newProvisionerError(err)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		provisioner.logger.Error("mssql-exec", err, lager.Data{"query": sqlLine})
+		return newProvisionerError(err)
+	}
+
+	return nil
+}
 
+// execute runs a compiled statement with the query parameters
+func (provisioner *MssqlProvisioner) execute(template string, sqlLine string, args ...interface{}) error {
+	provisioner.logger.Debug("mssql-exec", lager.Data{"query": sqlLine, "argCount": len(args)})
+	start := time.Now()
+	_, err := provisioner.dbClient.Exec(sqlLine, args...)
+	provisioner.observe(template, start, err)
+	if err != nil {
+		provisioner.logger.Error("mssql-exec", err, lager.Data{"query": sqlLine})
+		return newProvisionerError(err)
+	}
+
+	return nil
+}
+
+// executeSteps runs the rendered steps, and the consecutive transaction steps in the same transaction
+func (provisioner *MssqlProvisioner) executeSteps(steps []SqlTemplateStep, data SqlTemplateData) (err error) {
+	if len(steps) != 0 {
+		start := time.Now()
+		defer func() { provisioner.observe(steps[0].operation, start, err) }()
+	}
+
+	for i := 0; i < len(steps); {
+		batch := []string{}
+		transaction := steps[i].Transaction
+		for ; i < len(steps) && steps[i].Transaction == transaction; i++ {
+			sqlLine, err := steps[i].render(data)
+			if err != nil {
+				return newFatalProvisionerError("sql template %s failed: %v", steps[i].template.Name(), err)
+			}
+			if sqlLine != "" {
+				batch = append(batch, sqlLine)
+			}
+		}
+
+		var err error
+		if transaction {
+			err = provisioner.executeWithTx(batch)
+		} else {
+			err = provisioner.executeWithoutTx(batch)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (provisioner *MssqlProvisioner) executeTemplateWithTx(name string, template []string, targs ...interface{}) error {
+	start := time.Now()
+	err := provisioner.executeWithTx(compileTemplateLines(template, targs...))
+	provisioner.observe(name, start, err)
+	return err
+}
+
+func (provisioner *MssqlProvisioner) executeTemplateWithoutTx(name string, template []string, targs ...interface{}) error {
+	start := time.Now()
+	err := provisioner.executeWithoutTx(compileTemplateLines(template, targs...))
+	provisioner.observe(name, start, err)
+	return err
+}
+
+func (provisioner *MssqlProvisioner) executeWithTx(sqlLines []string) error {
+	tx, err := provisioner.dbClient.Begin()
+	if err != nil {
+		return newProvisionerError(err)
+	}
+
+	for _, sqlLine := range sqlLines {
 		provisioner.logger.Debug("mssql-exec", lager.Data{"query": sqlLine})
 		_, err = tx.Exec(sqlLine)
 		if err != nil {
+			provisioner.logger.Error("mssql-exec", err, lager.Data{"query": sqlLine})
 			rollbackErr := tx.Rollback()
 			if rollbackErr != nil {
-				panic(rollbackErr.Error())
+				// The connection and the transaction are in an unknown state
+				return newFatalProvisionerError("rollback failed: %v, after exec error: %v", rollbackErr, err)
 			}
-			provisioner.logger.Error("mssql-exec", err, lager.Data{"query": sqlLine})
-			return err
+			return newProvisionerError(err)
 		}
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return err
+		return newProvisionerError(err)
 	}
 
 	return nil
 }
 
-func (provisioner *MssqlProvisioner) executeTemplateWithoutTx(template []string, targs ...interface{}) error {
-	for _, templateLine := range template {
-		sqlLine := compileTemplate(templateLine, targs...)
-
+func (provisioner *MssqlProvisioner) executeWithoutTx(sqlLines []string) error {
+	for _, sqlLine := range sqlLines {
 		provisioner.logger.Debug("mssql-exec", lager.Data{"query": sqlLine})
 		_, err := provisioner.dbClient.Exec(sqlLine)
 		if err != nil {
 			provisioner.logger.Error("mssql-exec", err, lager.Data{"query": sqlLine})
-			return err
+			return newProvisionerError(err)
 		}
 	}
 
 	return nil
 }
 
+func compileTemplateLines(template []string, targs ...interface{}) []string {
+	sqlLines := make([]string, len(template))
+	for i, templateLine := range template {
+		sqlLines[i] = compileTemplate(templateLine, targs...)
+	}
+	return sqlLines
+}
+
+// compileTemplate requires explicit argument indexes (e.g. %[1]v) in the template,
+// so that fmt does not report the unused arguments. The arguments must be escaped
+// for their context in the template (see escapeIdentifier and escapeLiteral).
 func compileTemplate(template string, targs ...interface{}) string {
-	compiled := fmt.Sprintf(template, targs...)
-	extraErrorStart := strings.LastIndex(compiled, "%!(EXTRA")
-	if extraErrorStart != -1 {
-		// trim the extra args errs from sprintf
-		compiled = compiled[0:extraErrorStart]
+	if !strings.Contains(template, "%[") {
+		// e.g. "use master", fmt would append an EXTRA error for the unused arguments
+		return strings.Replace(template, "%%", "%", -1)
 	}
-	return compiled
+	return fmt.Sprintf(template, targs...)
 }
@@ -41,7 +41,7 @@ func TestCreateDatabaseOdbcDriver(t *testing.T) {
 	defer mssqlProv.Close()
 
 	// Act
-	err = mssqlProv.CreateDatabase(dbName)
+	err = mssqlProv.CreateDatabase(dbName, DatabaseSettings{})
 
 	// Assert
 	if err != nil {
@@ -73,11 +73,11 @@ func TestDeleteDatabaseOdbcDriver(t *testing.T) {
 	}
 	defer mssqlProv.Close()
 
-	err = mssqlProv.CreateDatabase(dbName)
+	err = mssqlProv.CreateDatabase(dbName, DatabaseSettings{})
 
 	// Act
 
-	err = mssqlProv.DeleteDatabase(dbName)
+	err = mssqlProv.DeleteDatabase(dbName, FinalBackupSettings{})
 
 	// Assert
 	if err != nil {
@@ -109,13 +109,13 @@ func TestCreateUserOdbcDriver(t *testing.T) {
 		t.Errorf("Provisioner init error, %v", err)
 	}
 
-	err = mssqlProv.CreateDatabase(dbName)
+	err = mssqlProv.CreateDatabase(dbName, DatabaseSettings{})
 	if err != nil {
 		t.Errorf("Database create error, %v", err)
 	}
 
 	// Act
-	err = mssqlProv.CreateUser(dbName, userNanme, "passwordAa_0")
+	err = mssqlProv.CreateUser(dbName, userNanme, "passwordAa_0", []string{"db_owner"})
 
 	// Assert
 	if err != nil {
@@ -149,11 +149,11 @@ func TestDeleteUserOdbcDriver(t *testing.T) {
 	}
 	defer mssqlProv.Close()
 
-	err = mssqlProv.CreateDatabase(dbName)
+	err = mssqlProv.CreateDatabase(dbName, DatabaseSettings{})
 	if err != nil {
 		t.Errorf("Database create error, %v", err)
 	}
-	err = mssqlProv.CreateUser(dbName, userNanme, "passwordAa_0")
+	err = mssqlProv.CreateUser(dbName, userNanme, "passwordAa_0", []string{"db_owner"})
 	if err != nil {
 		t.Errorf("User create error, %v", err)
 	}
@@ -234,7 +234,7 @@ func TestIsDatabaseCreatedOdbcDriver2(t *testing.T) {
 	if err != nil {
 		t.Errorf("Provisioner init error, %v", err)
 	}
-	err = mssqlProv.CreateDatabase(dbName)
+	err = mssqlProv.CreateDatabase(dbName, DatabaseSettings{})
 	if err != nil {
 		t.Errorf("Database create error, %v", err)
 	}
@@ -273,12 +273,12 @@ func TestStressOdbcDriver(t *testing.T) {
 		t.Errorf("Provisioner init error, %v", err)
 	}
 
-	err = mssqlProv.CreateDatabase(dbName)
+	err = mssqlProv.CreateDatabase(dbName, DatabaseSettings{})
 	if err != nil {
 		t.Errorf("Database create error, %v", err)
 	}
 
-	err = mssqlProv.CreateDatabase(dbNameA)
+	err = mssqlProv.CreateDatabase(dbNameA, DatabaseSettings{})
 	if err != nil {
 		t.Errorf("Database create error, %v", err)
 	}
@@ -288,13 +288,13 @@ func TestStressOdbcDriver(t *testing.T) {
 	go func() {
 		for i := 1; i < 8; i++ {
 
-			err := mssqlProv.CreateDatabase(dbName2)
+			err := mssqlProv.CreateDatabase(dbName2, DatabaseSettings{})
 			if err != nil {
 				t.Errorf("Database create error, %v", err)
 				break
 			}
 
-			err = mssqlProv.DeleteDatabase(dbName2)
+			err = mssqlProv.DeleteDatabase(dbName2, FinalBackupSettings{})
 			if err != nil {
 				t.Errorf("Database delete error, %v", err)
 				break
@@ -306,7 +306,7 @@ func TestStressOdbcDriver(t *testing.T) {
 
 	go func() {
 		for i := 1; i < 32; i++ {
-			err = mssqlProv.CreateUser(dbName, userNanme, "passwordAa_0")
+			err = mssqlProv.CreateUser(dbName, userNanme, "passwordAa_0", []string{"db_owner"})
 			if err != nil {
 				t.Errorf("User create error, %v", err)
 				break
@@ -325,7 +325,7 @@ func TestStressOdbcDriver(t *testing.T) {
 
 	go func() {
 		for i := 1; i < 32; i++ {
-			err = mssqlProv.CreateUser(dbNameA, userNanme, "passwordAa_0")
+			err = mssqlProv.CreateUser(dbNameA, userNanme, "passwordAa_0", []string{"db_owner"})
 			if err != nil {
 				t.Errorf("User create error, %v", err)
 				break
@@ -373,7 +373,7 @@ func TestCreateDatabaseMssqlDriver(t *testing.T) {
 	}
 
 	// Act
-	err = mssqlProv.CreateDatabase(dbName)
+	err = mssqlProv.CreateDatabase(dbName, DatabaseSettings{})
 
 	// Assert
 	if err != nil {
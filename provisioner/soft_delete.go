@@ -0,0 +1,137 @@
+package provisioner
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pivotal-golang/lager"
+)
+
+// A soft deleted database is renamed to <databaseId><TombstoneMarker><deletion time>
+// and taken offline. It is dropped by PurgeTombstone after the grace period.
+const TombstoneMarker = "~deleted~"
+
+const tombstoneTimestampFormat = "20060102T150405Z"
+
+// Tombstone is a soft deleted database
+type Tombstone struct {
+	Name       string
+	DatabaseId string
+	DeletedAt  time.Time
+}
+
+// The database is renamed in single user mode, so no other connection sees the new name before it is offline
+// fmt template parameters: 1.databaseId, 2.tombstone name
+var softDeleteDatabaseTemplate = []string{
+	"alter database [%[1]v] set single_user with rollback immediate",
+	"alter database [%[1]v] modify name = [%[2]v]",
+	"alter database [%[2]v] set multi_user",
+	"alter database [%[2]v] set offline with rollback immediate",
+}
+
+// A database must be online to delete its files when it is dropped
+// fmt template parameters: 1.tombstone name
+var onlineTombstoneTemplate = []string{
+	"alter database [%[1]v] set online",
+}
+
+// query parameters: LIKE pattern of the tombstone names
+var listTombstonesTemplate = "select name  from [master].sys.databases  where name like ?"
+
+// query parameters: LIKE pattern of the tombstone names
+var hasTombstonesTemplate = "select count(*)  from [master].sys.databases  where name like ?"
+
+var defaultFilePathsTemplate = "select cast(serverproperty('InstanceDefaultDataPath') as nvarchar(260)), cast(serverproperty('InstanceDefaultLogPath') as nvarchar(260))"
+
+func tombstoneName(databaseId string, deletedAt time.Time) string {
+	return databaseId + TombstoneMarker + deletedAt.UTC().Format(tombstoneTimestampFormat)
+}
+
+// parseTombstoneName returns false if the name is not a tombstone name
+func parseTombstoneName(name string) (Tombstone, bool) {
+	markerStart := strings.LastIndex(name, TombstoneMarker)
+	if markerStart == -1 {
+		return Tombstone{}, false
+	}
+
+	deletedAt, err := time.Parse(tombstoneTimestampFormat, name[markerStart+len(TombstoneMarker):])
+	if err != nil {
+		return Tombstone{}, false
+	}
+
+	return Tombstone{Name: name, DatabaseId: name[:markerStart], DeletedAt: deletedAt}, true
+}
+
+// SoftDeleteDatabase takes the final backup like DeleteDatabase, then renames
+// the database to a tombstone name and takes it offline.
+func (provisioner *MssqlProvisioner) SoftDeleteDatabase(databaseId string, backup FinalBackupSettings) error {
+	err := provisioner.finalBackup(databaseId, backup)
+	if err != nil {
+		return err
+	}
+
+	name := tombstoneName(databaseId, time.Now())
+	err = provisioner.executeTemplateWithoutTx("softDeleteDatabase", softDeleteDatabaseTemplate, escapeIdentifier(databaseId), escapeIdentifier(name))
+	if err != nil {
+		return err
+	}
+
+	provisioner.logger.Info("database-soft-deleted", lager.Data{"databaseId": databaseId, "tombstone": name})
+	return nil
+}
+
+// ListTombstones returns the soft deleted databases whose names start with the prefix
+func (provisioner *MssqlProvisioner) ListTombstones(namePrefix string) ([]Tombstone, error) {
+	tombstones := []Tombstone{}
+
+	err := provisioner.queryRows("listTombstones", listTombstonesTemplate, func(rows *sql.Rows) error {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return err
+		}
+		if tombstone, ok := parseTombstoneName(name); ok {
+			tombstones = append(tombstones, tombstone)
+		}
+		return nil
+	}, likePrefix(namePrefix)+"%"+TombstoneMarker+"%")
+
+	return tombstones, err
+}
+
+// PurgeTombstone drops a soft deleted database
+func (provisioner *MssqlProvisioner) PurgeTombstone(name string) error {
+	if _, ok := parseTombstoneName(name); !ok {
+		return fmt.Errorf("%s is not a soft deleted database", name)
+	}
+
+	err := provisioner.executeTemplateWithoutTx("onlineTombstone", onlineTombstoneTemplate, escapeIdentifier(name))
+	if err != nil {
+		// Drop it anyway, the files of an offline database are left on disk
+		provisioner.logger.Error("tombstone-online-failed", err, lager.Data{"tombstone": name})
+	}
+
+	return provisioner.executeSteps(DefaultSqlTemplates().DeleteDatabase, SqlTemplateData{DatabaseName: name})
+}
+
+func (provisioner *MssqlProvisioner) hasTombstones(databaseId string) (bool, error) {
+	res := 0
+	err := provisioner.queryScalar("hasTombstones", hasTombstonesTemplate, &res, likePrefix(databaseId)+TombstoneMarker+"%")
+	return res > 0, err
+}
+
+// besideTombstonesFiles returns the file names of a new database that do not
+// collide with the files of the tombstones of the same database, which are still
+// on disk with the default names of their original database
+func (provisioner *MssqlProvisioner) besideTombstonesFiles(databaseId string) (dataFile string, logFile string, err error) {
+	var dataPath, logPath string
+	err = provisioner.queryRow("defaultFilePaths", defaultFilePathsTemplate, []interface{}{&dataPath, &logPath})
+	if err != nil {
+		return "", "", err
+	}
+
+	suffix := "_" + time.Now().UTC().Format(tombstoneTimestampFormat)
+	return dataPath + databaseId + suffix + ".mdf", logPath + databaseId + suffix + "_log.ldf", nil
+}
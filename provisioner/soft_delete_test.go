@@ -0,0 +1,30 @@
+package provisioner
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTombstoneName(t *testing.T) {
+	deletedAt := time.Date(2016, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	// Act
+	name := tombstoneName("cf-db", deletedAt)
+	tombstone, ok := parseTombstoneName(name)
+
+	// Assert
+	if name != "cf-db~deleted~20160304T050607Z" {
+		t.Errorf("unexpected tombstone name %q", name)
+	}
+	if !ok || tombstone.DatabaseId != "cf-db" || !tombstone.DeletedAt.Equal(deletedAt) || tombstone.Name != name {
+		t.Errorf("parseTombstoneName(%q) = %+v, %v", name, tombstone, ok)
+	}
+}
+
+func TestParseTombstoneNameRejectsOtherNames(t *testing.T) {
+	for _, name := range []string{"cf-db", "cf-db~deleted~", "cf-db~deleted~yesterday", "cf-db~deleted~20160304T050607Z-copy"} {
+		if _, ok := parseTombstoneName(name); ok {
+			t.Errorf("%q should not be a tombstone name", name)
+		}
+	}
+}
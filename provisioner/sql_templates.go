@@ -0,0 +1,284 @@
+package provisioner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// SqlTemplateStep is a text/template of one sql batch of an operation
+type SqlTemplateStep struct {
+	Sql string `json:"sql"`
+	// Consecutive steps with Transaction set run in the same transaction
+	Transaction bool `json:"transaction"`
+
+	operation string
+	template  *template.Template
+}
+
+// SqlTemplateSet has the steps of the provisioner operations
+type SqlTemplateSet struct {
+	CreateDatabase []SqlTemplateStep `json:"createDatabase"`
+	DeleteDatabase []SqlTemplateStep `json:"deleteDatabase"`
+	CreateUser     []SqlTemplateStep `json:"createUser"`
+	DeleteUser     []SqlTemplateStep `json:"deleteUser"`
+	RotatePassword []SqlTemplateStep `json:"rotatePassword"`
+}
+
+// SqlTemplateData has the named placeholders of the templates, e.g. {{identifier .DatabaseName}}
+type SqlTemplateData struct {
+	DatabaseName string
+	Username     string
+	Password     string
+	// The database roles of the user
+	Roles []string
+	// Empty for the server default collation, validated by the provisioner
+	Collation string
+	// Set when the default file names are used by a soft deleted database with the same name
+	DataFile string
+	LogFile  string
+}
+
+// The values are printed only by these functions, which quote and escape them:
+// identifier as [...] and literal as N'...'
+var sqlTemplateFuncs = template.FuncMap{
+	"identifier": func(value string) string { return "[" + escapeIdentifier(value) + "]" },
+	"literal":    func(value string) string { return "N'" + escapeLiteral(value) + "'" },
+}
+
+// The fields validated by the provisioner can be printed without the escaping functions
+var unescapedTemplateFields = map[string]bool{
+	"Collation": true,
+}
+
+var builtinSqlTemplates = SqlTemplateSet{
+	CreateDatabase: []SqlTemplateStep{
+		{Sql: "create database {{identifier .DatabaseName}} containment = partial" +
+			"{{if .DataFile}} on (name = {{literal .DatabaseName}}, filename = {{literal .DataFile}})" +
+			" log on (name = {{literal (print .DatabaseName \"_log\")}}, filename = {{literal .LogFile}}){{end}}" +
+			"{{if .Collation}} collate {{.Collation}}{{end}}"},
+	},
+	DeleteDatabase: []SqlTemplateStep{
+		{Sql: "alter database {{identifier .DatabaseName}} set single_user with rollback immediate"},
+		{Sql: "drop database {{identifier .DatabaseName}}"},
+	},
+	CreateUser: []SqlTemplateStep{
+		{Sql: "use {{identifier .DatabaseName}}", Transaction: true},
+		{Sql: "create user {{identifier .Username}} with password = {{literal .Password}}", Transaction: true},
+		{Sql: "{{range .Roles}}alter role {{identifier .}} add member {{identifier $.Username}}; {{end}}", Transaction: true},
+		{Sql: "use master", Transaction: true},
+	},
+	DeleteUser: []SqlTemplateStep{
+		{Sql: "use {{identifier .DatabaseName}}", Transaction: true},
+		{Sql: "drop user {{identifier .Username}}", Transaction: true},
+		{Sql: "use master", Transaction: true},
+	},
+	RotatePassword: []SqlTemplateStep{
+		{Sql: "use {{identifier .DatabaseName}}", Transaction: true},
+		{Sql: "alter user {{identifier .Username}} with password = {{literal .Password}}", Transaction: true},
+		{Sql: "use master", Transaction: true},
+	},
+}
+
+var defaultSqlTemplates = mustCompileSqlTemplateSet(builtinSqlTemplates)
+
+// DefaultSqlTemplates returns the built-in templates
+func DefaultSqlTemplates() *SqlTemplateSet {
+	return defaultSqlTemplates
+}
+
+// LoadSqlTemplates reads the template sets from a json file, e.g.
+// {"audited": {"createUser": [{"sql": "...", "transaction": true}]}}.
+// The operations missing from a set use the built-in templates.
+func LoadSqlTemplates(path string) (map[string]*SqlTemplateSet, error) {
+	jsonSets, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSqlTemplates(jsonSets)
+}
+
+// ParseSqlTemplates compiles and validates the json template sets
+func ParseSqlTemplates(jsonSets []byte) (map[string]*SqlTemplateSet, error) {
+	sets := map[string]SqlTemplateSet{}
+	decoder := json.NewDecoder(bytes.NewReader(jsonSets))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&sets)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sql templates: %v", err)
+	}
+
+	compiled := map[string]*SqlTemplateSet{}
+	for name, set := range sets {
+		if set.CreateDatabase == nil {
+			set.CreateDatabase = builtinSqlTemplates.CreateDatabase
+		}
+		if set.DeleteDatabase == nil {
+			set.DeleteDatabase = builtinSqlTemplates.DeleteDatabase
+		}
+		if set.CreateUser == nil {
+			set.CreateUser = builtinSqlTemplates.CreateUser
+		}
+		if set.DeleteUser == nil {
+			set.DeleteUser = builtinSqlTemplates.DeleteUser
+		}
+		if set.RotatePassword == nil {
+			set.RotatePassword = builtinSqlTemplates.RotatePassword
+		}
+
+		compiled[name], err = compileSqlTemplateSet(set)
+		if err != nil {
+			return nil, fmt.Errorf("sql template set %s: %v", name, err)
+		}
+	}
+
+	return compiled, nil
+}
+
+func mustCompileSqlTemplateSet(set SqlTemplateSet) *SqlTemplateSet {
+	compiled, err := compileSqlTemplateSet(set)
+	if err != nil {
+		panic(err)
+	}
+	return compiled
+}
+
+func compileSqlTemplateSet(set SqlTemplateSet) (*SqlTemplateSet, error) {
+	var err error
+	operations := []struct {
+		name  string
+		steps *[]SqlTemplateStep
+	}{
+		{"createDatabase", &set.CreateDatabase},
+		{"deleteDatabase", &set.DeleteDatabase},
+		{"createUser", &set.CreateUser},
+		{"deleteUser", &set.DeleteUser},
+		{"rotatePassword", &set.RotatePassword},
+	}
+
+	for _, operation := range operations {
+		*operation.steps, err = compileSqlTemplateSteps(operation.name, *operation.steps)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &set, nil
+}
+
+// sampleTemplateData is used to check the templates when they are loaded
+var sampleTemplateData = SqlTemplateData{
+	DatabaseName: "cf-database",
+	Username:     "cf-user",
+	Password:     "password",
+	Roles:        []string{"db_datareader", "db_datawriter"},
+	Collation:    "Latin1_General_CS_AS",
+	DataFile:     "C:\\data\\cf-database.mdf",
+	LogFile:      "C:\\data\\cf-database_log.ldf",
+}
+
+func compileSqlTemplateSteps(operation string, steps []SqlTemplateStep) ([]SqlTemplateStep, error) {
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%s has no steps", operation)
+	}
+
+	compiled := make([]SqlTemplateStep, len(steps))
+	for i, step := range steps {
+		parsed, err := template.New(fmt.Sprintf("%s step %d", operation, i+1)).Funcs(sqlTemplateFuncs).Parse(step.Sql)
+		if err != nil {
+			return nil, err
+		}
+
+		err = checkEscapedTemplate(parsed.Tree.Root)
+		if err != nil {
+			return nil, fmt.Errorf("%s step %d: %v", operation, i+1, err)
+		}
+
+		step.operation = operation
+		step.template = parsed
+		_, err = step.render(sampleTemplateData)
+		if err != nil {
+			return nil, err
+		}
+
+		compiled[i] = step
+	}
+
+	return compiled, nil
+}
+
+// checkEscapedTemplate rejects the actions that print values without the escaping functions
+func checkEscapedTemplate(node parse.Node) error {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return nil
+		}
+		for _, child := range node.Nodes {
+			err := checkEscapedTemplate(child)
+			if err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		if node.Pipe == nil || len(node.Pipe.Decl) != 0 {
+			// variable declarations do not print
+			return nil
+		}
+		if !isEscapedPipe(node.Pipe) {
+			return fmt.Errorf("%s prints a value without the identifier or literal function", node)
+		}
+	case *parse.IfNode:
+		return checkEscapedBranch(&node.BranchNode)
+	case *parse.RangeNode:
+		return checkEscapedBranch(&node.BranchNode)
+	case *parse.WithNode:
+		return checkEscapedBranch(&node.BranchNode)
+	case *parse.TemplateNode:
+		return fmt.Errorf("%s is not supported", node)
+	}
+	return nil
+}
+
+func checkEscapedBranch(branch *parse.BranchNode) error {
+	err := checkEscapedTemplate(branch.List)
+	if err != nil {
+		return err
+	}
+	if branch.ElseList != nil {
+		return checkEscapedTemplate(branch.ElseList)
+	}
+	return nil
+}
+
+// isEscapedPipe checks the last command of the pipe, which prints the value
+func isEscapedPipe(pipe *parse.PipeNode) bool {
+	if len(pipe.Cmds) == 0 {
+		return false
+	}
+	last := pipe.Cmds[len(pipe.Cmds)-1]
+
+	switch first := last.Args[0].(type) {
+	case *parse.IdentifierNode:
+		return first.Ident == "identifier" || first.Ident == "literal"
+	case *parse.FieldNode:
+		return len(last.Args) == 1 && len(first.Ident) == 1 && unescapedTemplateFields[first.Ident[0]]
+	case *parse.StringNode, *parse.NumberNode:
+		return true
+	}
+	return false
+}
+
+func (step SqlTemplateStep) render(data SqlTemplateData) (string, error) {
+	var sql bytes.Buffer
+	err := step.template.Execute(&sql, data)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(sql.String()), nil
+}
@@ -0,0 +1,167 @@
+package provisioner
+
+import (
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func allSteps(set *SqlTemplateSet) []SqlTemplateStep {
+	steps := append([]SqlTemplateStep{}, set.CreateDatabase...)
+	steps = append(steps, set.DeleteDatabase...)
+	steps = append(steps, set.CreateUser...)
+	steps = append(steps, set.DeleteUser...)
+	return append(steps, set.RotatePassword...)
+}
+
+// checkRenderedSteps renders the steps with the data, and with placeholder values
+// that need no escaping. Both must have the same statements, with the values in the same tokens.
+func checkRenderedSteps(t *testing.T, steps []SqlTemplateStep, data SqlTemplateData) bool {
+	placeholderData := SqlTemplateData{
+		DatabaseName: "DATABASE",
+		Username:     "USER",
+		Password:     "PASSWORD",
+		Roles:        []string{"ROLE1", "ROLE2"},
+		DataFile:     "DATAFILE",
+		LogFile:      "LOGFILE",
+	}
+	unescaper := strings.NewReplacer(
+		"DATABASE", data.DatabaseName,
+		"USER", data.Username,
+		"PASSWORD", data.Password,
+		"ROLE1", data.Roles[0],
+		"ROLE2", data.Roles[1],
+		"DATAFILE", data.DataFile,
+		"LOGFILE", data.LogFile,
+	)
+
+	for _, step := range steps {
+		expected, err := step.render(placeholderData)
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		rendered, err := step.render(data)
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+
+		expectedSkeleton, expectedTokens, err := tokenizeSql(expected)
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		skeleton, tokens, err := tokenizeSql(rendered)
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+
+		if skeleton != expectedSkeleton {
+			t.Errorf("the values changed the statement %q to %q", expectedSkeleton, skeleton)
+			return false
+		}
+		for i := range tokens {
+			if tokens[i].value != unescaper.Replace(expectedTokens[i].value) {
+				t.Errorf("token %d of %q is %q, expected %q", i, rendered, tokens[i].value, unescaper.Replace(expectedTokens[i].value))
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestBuiltinSqlTemplatesFuzz(t *testing.T) {
+	steps := allSteps(DefaultSqlTemplates())
+
+	property := func(database, user, password, role1, role2, dataFile, logFile fuzzValue) bool {
+		return checkRenderedSteps(t, steps, SqlTemplateData{
+			DatabaseName: string(database),
+			Username:     string(user),
+			Password:     string(password),
+			Roles:        []string{string(role1), string(role2)},
+			DataFile:     string(dataFile),
+			LogFile:      string(logFile),
+		})
+	}
+
+	err := quick.Check(property, &quick.Config{MaxCount: 500})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBuiltinSqlTemplates(t *testing.T) {
+	templates := DefaultSqlTemplates()
+	data := SqlTemplateData{DatabaseName: "cf-db", Username: "cf-user", Password: "pass'word", Roles: []string{"db_owner"}, Collation: "Latin1_General_CS_AS"}
+
+	// Act
+	createDatabase, _ := templates.CreateDatabase[0].render(data)
+	addRoles, _ := templates.CreateUser[2].render(data)
+	createUser, _ := templates.CreateUser[1].render(data)
+	noRoles, _ := templates.CreateUser[2].render(SqlTemplateData{Username: "cf-user"})
+
+	// Assert
+	if createDatabase != "create database [cf-db] containment = partial collate Latin1_General_CS_AS" {
+		t.Errorf("unexpected createDatabase %q", createDatabase)
+	}
+	if createUser != "create user [cf-user] with password = N'pass''word'" {
+		t.Errorf("unexpected createUser %q", createUser)
+	}
+	if addRoles != "alter role [db_owner] add member [cf-user];" {
+		t.Errorf("unexpected roles %q", addRoles)
+	}
+	if noRoles != "" {
+		t.Errorf("expected an empty step without roles, got %q", noRoles)
+	}
+}
+
+func TestParseSqlTemplates(t *testing.T) {
+	jsonSets := `{
+		"audited": {
+			"createUser": [
+				{"sql": "use {{identifier .DatabaseName}}", "transaction": true},
+				{"sql": "create user {{identifier .Username}} with password = {{literal .Password}}", "transaction": true},
+				{"sql": "{{range .Roles}}alter role {{identifier .}} add member {{identifier $.Username}}; {{end}}", "transaction": true},
+				{"sql": "insert into [audit].dbo.users (name) values ({{literal .Username}})", "transaction": true}
+			]
+		}
+	}`
+
+	// Act
+	sets, err := ParseSqlTemplates([]byte(jsonSets))
+
+	// Assert
+	if err != nil {
+		t.Fatalf("ParseSqlTemplates error, %v", err)
+	}
+	if len(sets["audited"].CreateUser) != 4 {
+		t.Errorf("expected the 4 createUser steps, got %d", len(sets["audited"].CreateUser))
+	}
+	if len(sets["audited"].DeleteDatabase) != len(DefaultSqlTemplates().DeleteDatabase) {
+		t.Errorf("expected the built-in deleteDatabase steps")
+	}
+}
+
+func TestParseSqlTemplatesRejectsUnescapedValues(t *testing.T) {
+	invalid := []string{
+		`{"s": {"createUser": [{"sql": "create user [{{.Username}}] with password = '{{.Password}}'"}]}}`,
+		`{"s": {"deleteUser": [{"sql": "drop user {{.Username | printf \"%s\"}}"}]}}`,
+		`{"s": {"deleteUser": [{"sql": "{{range .Roles}}{{.}}{{end}}"}]}}`,
+		`{"s": {"deleteUser": [{"sql": "drop user {{identifier .Unknown}}"}]}}`,
+		`{"s": {"deleteUser": [{"sql": "drop user {{identifier .Username"}]}}`,
+		`{"s": {"deleteUser": []}}`,
+		`{"s": {"dropEverything": [{"sql": "drop database master"}]}}`,
+	}
+
+	for _, jsonSets := range invalid {
+		// Act
+		_, err := ParseSqlTemplates([]byte(jsonSets))
+
+		// Assert
+		if err == nil {
+			t.Errorf("expected an error for %s", jsonSets)
+		}
+	}
+}
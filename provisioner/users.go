@@ -0,0 +1,73 @@
+package provisioner
+
+import (
+	"database/sql"
+	"time"
+)
+
+// DatabaseUser is a contained user with a password
+type DatabaseUser struct {
+	Name      string
+	CreatedAt time.Time
+	// Changed by any ALTER USER, e.g. when the password is rotated or the default schema is changed
+	ModifiedAt time.Time
+}
+
+// fmt template parameters: 1.databaseId
+var listUsersTemplate = "select name, create_date, modify_date  from [%[1]v].sys.database_principals  where type = 'S' and authentication_type = 2"
+
+// fmt template parameters: 1.databaseId
+// query parameters: userId
+var userRolesTemplate = "select r.name  from [%[1]v].sys.database_role_members m  join [%[1]v].sys.database_principals r on r.principal_id = m.role_principal_id  join [%[1]v].sys.database_principals u on u.principal_id = m.member_principal_id  where u.name = ?"
+
+// fmt template parameters: 1.databaseId, 2.userId
+var disableUserTemplate = []string{
+	"use [%[1]v]",
+	"revoke connect from [%[2]v]",
+	"use master",
+}
+
+// RotatePassword changes the password of an existing user
+func (provisioner *MssqlProvisioner) RotatePassword(databaseId, userId, password string) error {
+	return provisioner.executeSteps(provisioner.templates.RotatePassword, SqlTemplateData{DatabaseName: databaseId, Username: userId, Password: password})
+}
+
+// DisableUser revokes the connect permission of the user, the user and its permissions are kept.
+// The user can be enabled again with "grant connect to [user]".
+func (provisioner *MssqlProvisioner) DisableUser(databaseId, userId string) error {
+	return provisioner.executeTemplateWithTx("disableUser", disableUserTemplate, escapeIdentifier(databaseId), escapeIdentifier(userId))
+}
+
+// ListUsers returns the contained users with a password of the database
+func (provisioner *MssqlProvisioner) ListUsers(databaseId string) ([]DatabaseUser, error) {
+	users := []DatabaseUser{}
+
+	err := provisioner.queryRows("listUsers", compileTemplate(listUsersTemplate, escapeIdentifier(databaseId)), func(rows *sql.Rows) error {
+		user := DatabaseUser{}
+		err := rows.Scan(&user.Name, &user.CreatedAt, &user.ModifiedAt)
+		if err != nil {
+			return err
+		}
+		users = append(users, user)
+		return nil
+	})
+
+	return users, err
+}
+
+// GetUserRoles returns the database roles of the user
+func (provisioner *MssqlProvisioner) GetUserRoles(databaseId, userId string) ([]string, error) {
+	roles := []string{}
+
+	err := provisioner.queryRows("userRoles", compileTemplate(userRolesTemplate, escapeIdentifier(databaseId)), func(rows *sql.Rows) error {
+		var role string
+		err := rows.Scan(&role)
+		if err != nil {
+			return err
+		}
+		roles = append(roles, role)
+		return nil
+	}, userId)
+
+	return roles, err
+}
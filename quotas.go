@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-golang/lager"
+)
+
+// Actions of the quota scanner for the databases over the planMaxDataSizeMB of their plan
+const (
+	quotaScanReport = "report"
+	// switch the databases to read-only, and back to read-write when they fit in their plan again
+	quotaScanReadOnly = "read-only"
+)
+
+const defaultQuotaScanIntervalMinutes = 60
+
+// Set on the databases switched to read-only by the quota scanner, so only those are switched back
+const quotaRestrictedAtProperty = "cf_quota_restricted_at"
+
+// QuotaViolation is a managed database larger than the planMaxDataSizeMB of its plan
+type QuotaViolation struct {
+	Server        string `json:"server"`
+	Database      string `json:"database"`
+	InstanceID    string `json:"instanceId"`
+	PlanID        string `json:"planId"`
+	DataSizeMB    int64  `json:"dataSizeMB"`
+	MaxDataSizeMB int    `json:"maxDataSizeMB"`
+	ReadOnly      bool   `json:"readOnly"`
+	Error         string `json:"error,omitempty"`
+}
+
+// capDataSize limits the max data size of the settings to maxSizeMB, 0 for no limit.
+// An unlimited max data size is set to the limit.
+func capDataSize(settings provisioner.DatabaseSettings, maxSizeMB int) (provisioner.DatabaseSettings, error) {
+	if maxSizeMB == 0 {
+		return settings, nil
+	}
+
+	if settings.MaxDataSizeMB > maxSizeMB {
+		return settings, invalidParametersError{fmt.Errorf("maxDataSizeMB %d is over the %dMB limit of the plan", settings.MaxDataSizeMB, maxSizeMB)}
+	}
+	if settings.InitialDataSizeMB > maxSizeMB {
+		return settings, invalidParametersError{fmt.Errorf("initialDataSizeMB %d is over the %dMB limit of the plan", settings.InitialDataSizeMB, maxSizeMB)}
+	}
+
+	if settings.MaxDataSizeMB == 0 {
+		settings.MaxDataSizeMB = maxSizeMB
+	}
+	return settings, nil
+}
+
+// instanceLimitMet checks a new database against the limits, 0 for no limit
+func instanceLimitMet(instances, planInstances, maxInstances, planMaxInstances int) bool {
+	return (maxInstances != 0 && instances >= maxInstances) || (planMaxInstances != 0 && planInstances >= planMaxInstances)
+}
+
+// instanceLimitsLocks serializes the provisions counted against the instance limits in this broker process
+var instanceLimitsLocks = newInstanceLocks()
+
+const instanceLimitsLockResource = "cf-mssql-broker:instance-limits"
+
+// lockInstanceLimits serializes the provisions of all the broker processes while the instance limits are
+// checked and the database is created: it takes a process lock, then an application lock on every server.
+// Counting the databases already needs all the servers, so the lock does not add a point of failure.
+func lockInstanceLimits() (func(), error) {
+	start := time.Now()
+	timeout := lockTimeout()
+
+	if !instanceLimitsLocks.lock(instanceLimitsLockResource, timeout) {
+		return nil, concurrencyError{fmt.Errorf("Another provision is checking the instance limits")}
+	}
+
+	releases := []func(){}
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+		instanceLimitsLocks.unlock(instanceLimitsLockResource)
+	}
+
+	for _, server := range mssqlServers.servers {
+		remaining := timeout - time.Since(start)
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		releaseAppLock, err := acquireServerAppLock(server, instanceLimitsLockResource, remaining)
+		if err != nil {
+			release()
+			if err == provisioner.ErrAppLockTimeout {
+				return nil, concurrencyError{fmt.Errorf("Another broker is checking the instance limits")}
+			}
+			return nil, brokerError(err, nil, nil)
+		}
+		releases = append(releases, releaseAppLock)
+	}
+
+	return release, nil
+}
+
+// checkInstanceLimits returns brokerapi.ErrInstanceLimitMet if there is no room for a new database of the plan.
+// The databases of a plan are counted with their cf_plan_id property. When there are limits, the provisions
+// are serialized by lockInstanceLimits: the returned function releases the lock, after the database is created.
+func checkInstanceLimits(planID string) (func(), error) {
+	maxInstances := brokerConfig.Quotas.MaxInstances
+	planMaxInstances := brokerConfig.Quotas.PlanMaxInstances[planID]
+	if maxInstances == 0 && planMaxInstances == 0 {
+		return func() {}, nil
+	}
+
+	unlock, err := lockInstanceLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	instances, planInstances, err := countInstances(planID, planMaxInstances != 0)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	if instanceLimitMet(instances, planInstances, maxInstances, planMaxInstances) {
+		unlock()
+		logger.Info("instance-limit-met", lager.Data{"planId": planID, "instances": instances, "planInstances": planInstances})
+		return nil, brokerapi.ErrInstanceLimitMet
+	}
+	return unlock, nil
+}
+
+// countInstances counts the managed databases, and with countPlan the databases of the plan
+func countInstances(planID string, countPlan bool) (int, int, error) {
+	instances := 0
+	planInstances := 0
+	for _, server := range mssqlServers.servers {
+		databases, err := server.provisioner.ListDatabaseInfo(brokerConfig.DbIdentifierPrefix)
+		if err != nil {
+			return 0, 0, brokerError(err, nil, nil)
+		}
+		instances += len(databases)
+
+		if !countPlan {
+			continue
+		}
+
+		for _, info := range databases {
+			if info.State != "ONLINE" {
+				continue
+			}
+
+			properties, err := server.provisioner.GetDatabaseProperties(info.Name)
+			if err != nil {
+				return 0, 0, brokerError(err, nil, nil)
+			}
+			if properties[planIdProperty] == planID {
+				planInstances++
+			}
+		}
+	}
+	return instances, planInstances, nil
+}
+
+// quotaExceededError is returned to the Cloud Controller as 422 Unprocessable Entity
+type quotaExceededError struct {
+	err error
+}
+
+func (e quotaExceededError) Error() string {
+	return e.err.Error()
+}
+
+// quotaRestriction returns a quotaExceededError if the properties mark the database as switched
+// to read-only by the quota scanner. The users and the settings of a read-only database can not be changed.
+func quotaRestriction(databaseName string, properties map[string]string) error {
+	restrictedAt := properties[quotaRestrictedAtProperty]
+	if restrictedAt == "" {
+		return nil
+	}
+	return quotaExceededError{fmt.Errorf("The database %s is read-only since %s, its data is over the %dMB quota of its plan. Update the instance to a plan with a larger quota.", databaseName, restrictedAt, brokerConfig.Quotas.PlanMaxDataSizeMB[properties[planIdProperty]])}
+}
+
+// checkQuotaRestriction returns a quotaExceededError if the quota scanner switched the database to read-only
+func checkQuotaRestriction(server *mssqlServer, databaseName string) error {
+	properties, err := server.provisioner.GetDatabaseProperties(databaseName)
+	if err != nil {
+		return brokerError(err, nil, brokerapi.ErrInstanceDoesNotExist)
+	}
+	return quotaRestriction(databaseName, properties)
+}
+
+// startQuotaScanner checks the size of the managed databases with the quotas.scanAction
+func startQuotaScanner(pool *mssqlServerPool, settings config.QuotaSettings, logger lager.Logger) {
+	interval := time.Duration(settings.ScanIntervalMinutes) * time.Minute
+	if interval == 0 {
+		interval = defaultQuotaScanIntervalMinutes * time.Minute
+	}
+
+	logger = logger.Session("quota-scanner")
+
+	go func() {
+		for {
+			_, err := pool.scanQuotas(settings.ScanAction == quotaScanReadOnly, logger)
+			if err != nil {
+				logger.Error("quota-scan-failed", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// scanQuotas reports the managed databases larger than the planMaxDataSizeMB of their plan.
+// With restrict, they are switched to read-only, and the databases switched by a previous
+// scan are switched back to read-write when they are under the limit again.
+func (pool *mssqlServerPool) scanQuotas(restrict bool, logger lager.Logger) ([]QuotaViolation, error) {
+	violations := []QuotaViolation{}
+
+	for _, server := range pool.servers {
+		databases, err := server.provisioner.ListDatabaseInfo(brokerConfig.DbIdentifierPrefix)
+		if err != nil {
+			return violations, fmt.Errorf("server %s: %v", server.Name, err)
+		}
+
+		for _, info := range databases {
+			if info.State != "ONLINE" {
+				continue
+			}
+
+			properties, err := server.provisioner.GetDatabaseProperties(info.Name)
+			if err != nil {
+				logger.Error("get-database-properties-failed", err, lager.Data{"server": server.Name, "database": info.Name})
+				continue
+			}
+
+			instanceID := strings.TrimPrefix(info.Name, brokerConfig.DbIdentifierPrefix)
+			planID := properties[planIdProperty]
+			maxSizeMB := brokerConfig.Quotas.PlanMaxDataSizeMB[planID]
+			restricted := properties[quotaRestrictedAtProperty] != ""
+			overQuota := maxSizeMB != 0 && info.DataSizeMB > int64(maxSizeMB)
+
+			if !overQuota {
+				if restrict && restricted {
+					err = restoreDatabase(server, info.Name, instanceID)
+					if err != nil {
+						logger.Error("restore-database-failed", err, lager.Data{"server": server.Name, "database": info.Name})
+					} else {
+						logger.Info("database-restored", lager.Data{"server": server.Name, "database": info.Name})
+					}
+				}
+				continue
+			}
+
+			violation := QuotaViolation{
+				Server:        server.Name,
+				Database:      info.Name,
+				InstanceID:    instanceID,
+				PlanID:        planID,
+				DataSizeMB:    info.DataSizeMB,
+				MaxDataSizeMB: maxSizeMB,
+				ReadOnly:      restricted,
+			}
+			logger.Info("database-over-quota", lager.Data{"server": server.Name, "database": info.Name, "planId": planID, "dataSizeMB": info.DataSizeMB, "maxDataSizeMB": maxSizeMB})
+
+			if restrict && !restricted {
+				err = restrictDatabase(server, info.Name, instanceID)
+				if err != nil {
+					logger.Error("restrict-database-failed", err, lager.Data{"server": server.Name, "database": info.Name})
+					violation.Error = err.Error()
+				} else {
+					logger.Info("database-restricted", lager.Data{"server": server.Name, "database": info.Name})
+					violation.ReadOnly = true
+				}
+			}
+
+			violations = append(violations, violation)
+		}
+	}
+
+	return violations, nil
+}
+
+// restrictDatabase marks the database as restricted by the scanner, then switches it to read-only.
+// The extended properties of a read-only database can not be changed.
+func restrictDatabase(server *mssqlServer, databaseName, instanceID string) error {
+	_, unlock, err := lockInstance(instanceID, "quota-scan", onServer(server))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = server.provisioner.SetDatabaseProperties(databaseName, map[string]string{quotaRestrictedAtProperty: time.Now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		return err
+	}
+	return server.provisioner.SetDatabaseReadOnly(databaseName, true)
+}
+
+// restoreDatabase switches a database restricted by the scanner back to read-write
+func restoreDatabase(server *mssqlServer, databaseName, instanceID string) error {
+	_, unlock, err := lockInstance(instanceID, "quota-scan", onServer(server))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return unrestrictDatabase(server, databaseName)
+}
+
+// unrestrictDatabase switches the database back to read-write, then removes the mark of the scanner.
+// The caller holds the lock of the instance.
+func unrestrictDatabase(server *mssqlServer, databaseName string) error {
+	err := server.provisioner.SetDatabaseReadOnly(databaseName, false)
+	if err != nil {
+		return err
+	}
+	return server.provisioner.DeleteDatabaseProperty(databaseName, quotaRestrictedAtProperty)
+}
+
+// unrestrictForPlan switches a database restricted by the scanner back to read-write before
+// its plan is changed, if its data fits in the quota of the new plan
+func unrestrictForPlan(server *mssqlServer, databaseName, planID string) error {
+	info, found, err := server.provisioner.GetDatabaseInfo(databaseName)
+	if err != nil {
+		return brokerError(err, nil, nil)
+	}
+	if !found {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+
+	maxSizeMB := brokerConfig.Quotas.PlanMaxDataSizeMB[planID]
+	if maxSizeMB != 0 && info.DataSizeMB > int64(maxSizeMB) {
+		return quotaExceededError{fmt.Errorf("The database %s is read-only, its %dMB of data are over the %dMB quota of the new plan.", databaseName, info.DataSizeMB, maxSizeMB)}
+	}
+
+	err = unrestrictDatabase(server, databaseName)
+	if err != nil {
+		return brokerError(err, nil, nil)
+	}
+	logger.Info("database-restored", lager.Data{"server": server.Name, "database": databaseName, "planId": planID})
+	return nil
+}
+
+// QuotaViolations reports the databases over their plan size, without changing them
+func (*mssqlServiceBroker) QuotaViolations() ([]QuotaViolation, error) {
+	logger.Info("quota-violations-called")
+
+	violations, err := mssqlServers.scanQuotas(false, logger)
+	if err != nil {
+		return nil, err
+	}
+	return violations, nil
+}
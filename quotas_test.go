@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+)
+
+func TestCapDataSize(t *testing.T) {
+	// Act
+	unlimited, err := capDataSize(provisioner.DatabaseSettings{}, 1024)
+	smaller, smallerErr := capDataSize(provisioner.DatabaseSettings{MaxDataSizeMB: 512}, 1024)
+	_, tooLargeErr := capDataSize(provisioner.DatabaseSettings{MaxDataSizeMB: 2048}, 1024)
+	_, initialErr := capDataSize(provisioner.DatabaseSettings{InitialDataSizeMB: 2048}, 1024)
+	uncapped, uncappedErr := capDataSize(provisioner.DatabaseSettings{}, 0)
+
+	// Assert
+	if err != nil || unlimited.MaxDataSizeMB != 1024 {
+		t.Errorf("expected the limit for an unlimited size, got %d, %v", unlimited.MaxDataSizeMB, err)
+	}
+	if smallerErr != nil || smaller.MaxDataSizeMB != 512 {
+		t.Errorf("expected the smaller size to be kept, got %d, %v", smaller.MaxDataSizeMB, smallerErr)
+	}
+	if _, ok := tooLargeErr.(invalidParametersError); !ok {
+		t.Errorf("expected an invalidParametersError for a size over the limit, got %v", tooLargeErr)
+	}
+	if _, ok := initialErr.(invalidParametersError); !ok {
+		t.Errorf("expected an invalidParametersError for an initial size over the limit, got %v", initialErr)
+	}
+	if uncappedErr != nil || uncapped.MaxDataSizeMB != 0 {
+		t.Errorf("expected no limit, got %d, %v", uncapped.MaxDataSizeMB, uncappedErr)
+	}
+}
+
+func TestInstanceLimitMet(t *testing.T) {
+	cases := []struct {
+		instances, planInstances, maxInstances, planMaxInstances int
+		expected                                                 bool
+	}{
+		{10, 5, 0, 0, false},
+		{9, 5, 10, 0, false},
+		{10, 5, 10, 0, true},
+		{9, 4, 10, 5, false},
+		{9, 5, 10, 5, true},
+		{100, 5, 0, 6, false},
+	}
+
+	for _, c := range cases {
+		// Act
+		met := instanceLimitMet(c.instances, c.planInstances, c.maxInstances, c.planMaxInstances)
+
+		// Assert
+		if met != c.expected {
+			t.Errorf("expected %v for %+v", c.expected, c)
+		}
+	}
+}
+
+func TestLockInstanceLimits(t *testing.T) {
+	fake := useFakeAppLocks(t)
+	previousServers := mssqlServers
+	defer func() { mssqlServers = previousServers }()
+	mssqlServers = &mssqlServerPool{servers: []*mssqlServer{{MssqlServer: config.MssqlServer{Name: "sql1"}}, {MssqlServer: config.MssqlServer{Name: "sql2"}}}}
+
+	// Act
+	unlock, err := lockInstanceLimits()
+	heldOnAllServers := fake.held["sql1/"+instanceLimitsLockResource] && fake.held["sql2/"+instanceLimitsLockResource]
+	_, lockedErr := lockInstanceLimits()
+	unlock()
+	fake.held["sql2/"+instanceLimitsLockResource] = true
+	_, otherBrokerErr := lockInstanceLimits()
+	releasedAfterTimeout := !fake.held["sql1/"+instanceLimitsLockResource]
+
+	// Assert
+	if err != nil || !heldOnAllServers {
+		t.Fatalf("expected the application lock on all the servers, got %v, %v", fake.held, err)
+	}
+	if _, ok := lockedErr.(concurrencyError); !ok {
+		t.Errorf("expected a concurrencyError while the limits are locked, got %v", lockedErr)
+	}
+	if _, ok := otherBrokerErr.(concurrencyError); !ok {
+		t.Errorf("expected a concurrencyError while another broker holds the lock, got %v", otherBrokerErr)
+	}
+	if !releasedAfterTimeout {
+		t.Errorf("expected the locks taken before the timeout to be released, got %v", fake.held)
+	}
+}
+
+func TestQuotaRestriction(t *testing.T) {
+	previousConfig := brokerConfig
+	defer func() { brokerConfig = previousConfig }()
+	brokerConfig = &config.Config{Quotas: config.QuotaSettings{PlanMaxDataSizeMB: map[string]int{"plan1": 1024}}}
+
+	// Act
+	err := quotaRestriction("cf-instance1", map[string]string{planIdProperty: "plan1", quotaRestrictedAtProperty: "2020-01-02T03:04:05Z"})
+	unrestrictedErr := quotaRestriction("cf-instance2", map[string]string{planIdProperty: "plan1"})
+
+	// Assert
+	if _, ok := err.(quotaExceededError); !ok {
+		t.Fatalf("expected a quotaExceededError for a read-only database, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "1024MB") || !strings.Contains(err.Error(), "2020-01-02T03:04:05Z") {
+		t.Errorf("expected the quota and the restriction time in the error, got %v", err)
+	}
+	if unrestrictedErr != nil {
+		t.Errorf("expected no error for a read-write database, got %v", unrestrictedErr)
+	}
+}
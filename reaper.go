@@ -0,0 +1,53 @@
+package main
+
+import (
+	"time"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+	"github.com/pivotal-golang/lager"
+)
+
+const defaultReaperIntervalMinutes = 60
+
+// startTombstoneReaper drops the soft deleted databases after the grace period.
+// Every broker process runs a reaper, a database dropped by another one is just not found again.
+func startTombstoneReaper(pool *mssqlServerPool, settings config.SoftDeleteSettings, logger lager.Logger) {
+	interval := time.Duration(settings.ReaperIntervalMinutes) * time.Minute
+	if interval == 0 {
+		interval = defaultReaperIntervalMinutes * time.Minute
+	}
+	gracePeriod := time.Duration(settings.GracePeriodHours) * time.Hour
+
+	logger = logger.Session("tombstone-reaper")
+
+	go func() {
+		for {
+			pool.reapTombstones(time.Now().Add(-gracePeriod), logger)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// reapTombstones drops the managed databases soft deleted before the cutoff time
+func (pool *mssqlServerPool) reapTombstones(cutoff time.Time, logger lager.Logger) {
+	for _, server := range pool.servers {
+		tombstones, err := server.provisioner.ListTombstones(brokerConfig.DbIdentifierPrefix)
+		if err != nil {
+			logger.Error("list-tombstones-failed", err, lager.Data{"server": server.Name})
+			continue
+		}
+
+		for _, tombstone := range tombstones {
+			if tombstone.DeletedAt.After(cutoff) {
+				continue
+			}
+
+			err = server.provisioner.PurgeTombstone(tombstone.Name)
+			if err != nil {
+				logger.Error("purge-tombstone-failed", err, lager.Data{"server": server.Name, "tombstone": tombstone.Name})
+				continue
+			}
+			logger.Info("tombstone-purged", lager.Data{"server": server.Name, "tombstone": tombstone.Name, "deletedAt": tombstone.DeletedAt})
+		}
+	}
+}
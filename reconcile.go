@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+	"github.com/pivotal-golang/lager"
+)
+
+// Actions of the reconciliation for the orphaned databases and users
+const (
+	reconcileReport = "report"
+	// drop the databases and the users
+	reconcileDelete = "delete"
+	// soft delete the databases and revoke the connect permission of the users
+	reconcileSoftDelete = "soft-delete"
+)
+
+const (
+	defaultReconcileMinAgeMinutes    = 60
+	defaultReconcileMaxOrphanPercent = 25
+)
+
+type ReconcileOptions struct {
+	Action string
+	// Report the action for each orphan without changing anything
+	DryRun bool
+	// Checks again that an orphan is not known, after its instance is locked. Optional.
+	Recheck knownResourceChecker
+}
+
+// OrphanDatabase is a managed database whose instance is not known by the Cloud Controller
+type OrphanDatabase struct {
+	Server     string    `json:"server"`
+	Database   string    `json:"database"`
+	InstanceID string    `json:"instanceId"`
+	PlanID     string    `json:"planId,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Action     string    `json:"action"`
+	// Why a delete was skipped
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// OrphanUser is a binding user whose binding is not known by the Cloud Controller
+type OrphanUser struct {
+	Server     string    `json:"server"`
+	Database   string    `json:"database"`
+	InstanceID string    `json:"instanceId"`
+	BindingID  string    `json:"bindingId"`
+	User       string    `json:"user"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Action     string    `json:"action"`
+	Reason     string    `json:"reason,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type ReconcileReport struct {
+	Action         string           `json:"action"`
+	DryRun         bool             `json:"dryRun"`
+	KnownInstances int              `json:"knownInstances"`
+	KnownBindings  int              `json:"knownBindings"`
+	Databases      []OrphanDatabase `json:"databases"`
+	Users          []OrphanUser     `json:"users"`
+}
+
+func guidSet(guids []string) map[string]bool {
+	set := map[string]bool{}
+	for _, guid := range guids {
+		set[strings.ToLower(guid)] = true
+	}
+	return set
+}
+
+// reconcileActionResult names what was done, or would be done in a dry run, with an orphan
+func reconcileActionResult(options ReconcileOptions, isDatabase bool) string {
+	var result string
+	switch {
+	case options.Action == reconcileDelete:
+		result = "deleted"
+	case options.Action == reconcileSoftDelete && isDatabase:
+		result = "soft-deleted"
+	case options.Action == reconcileSoftDelete:
+		result = "disabled"
+	default:
+		return "none"
+	}
+
+	if options.DryRun {
+		return "would be " + result
+	}
+	return result
+}
+
+// orphanRatioExceeded checks whether the orphans are more than maxPercent of all the resources
+func orphanRatioExceeded(orphans, total, maxPercent int) bool {
+	if total == 0 {
+		return false
+	}
+	return orphans*100 > total*maxPercent
+}
+
+// Reconcile finds the managed databases and the binding users that are not known by the Cloud Controller,
+// and deletes them with the delete and soft-delete actions. The databases and users created in the
+// last reconcile.minAgeMinutes are ignored, their provision or bind request may still be in progress.
+// The delete actions are refused when the orphans are more than reconcile.maxOrphanPercent of the managed
+// databases or of the binding users, the list of known resources is then more likely wrong than the servers.
+func (*mssqlServiceBroker) Reconcile(known KnownResources, options ReconcileOptions) (ReconcileReport, error) {
+	logger.Info("reconcile-called", lager.Data{"action": options.Action, "dryRun": options.DryRun, "knownInstances": len(known.Instances), "knownBindings": len(known.Bindings)})
+
+	report := ReconcileReport{
+		Action:         options.Action,
+		DryRun:         options.DryRun,
+		KnownInstances: len(known.Instances),
+		KnownBindings:  len(known.Bindings),
+		Databases:      []OrphanDatabase{},
+		Users:          []OrphanUser{},
+	}
+
+	switch options.Action {
+	case reconcileReport:
+	case reconcileDelete, reconcileSoftDelete:
+		if len(known.Instances) == 0 && !options.DryRun {
+			return report, invalidParametersError{fmt.Errorf("the list of known instances is empty, refusing to %s all the managed databases", options.Action)}
+		}
+	default:
+		return report, invalidParametersError{fmt.Errorf("invalid reconcile action %q", options.Action)}
+	}
+
+	minAge := time.Duration(brokerConfig.Reconcile.MinAgeMinutes) * time.Minute
+	if minAge == 0 {
+		minAge = defaultReconcileMinAgeMinutes * time.Minute
+	}
+	cutoff := time.Now().Add(-minAge)
+
+	knownInstances := guidSet(known.Instances)
+	knownBindings := guidSet(known.Bindings)
+
+	type orphanDatabase struct {
+		server *mssqlServer
+		info   provisioner.DatabaseInfo
+	}
+	type orphanUser struct {
+		server       *mssqlServer
+		databaseName string
+		bindingID    string
+		user         provisioner.DatabaseUser
+	}
+	orphanDatabases := []orphanDatabase{}
+	orphanUsers := []orphanUser{}
+	totalDatabases, totalUsers := 0, 0
+
+	for _, server := range mssqlServers.servers {
+		databases, err := server.provisioner.ListDatabaseInfo(brokerConfig.DbIdentifierPrefix)
+		if err != nil {
+			return report, brokerError(err, nil, nil)
+		}
+		totalDatabases += len(databases)
+
+		for _, info := range databases {
+			instanceID := strings.TrimPrefix(info.Name, brokerConfig.DbIdentifierPrefix)
+
+			if !knownInstances[strings.ToLower(instanceID)] {
+				if !info.CreatedAt.After(cutoff) {
+					orphanDatabases = append(orphanDatabases, orphanDatabase{server, info})
+				}
+				continue
+			}
+
+			if info.State != "ONLINE" {
+				continue
+			}
+
+			users, err := server.provisioner.ListUsers(info.Name)
+			if err != nil {
+				return report, brokerError(err, nil, nil)
+			}
+
+			for _, user := range users {
+				bindingID, ok := isBindingUser(info.Name, user.Name)
+				if !ok {
+					continue
+				}
+				totalUsers++
+				if knownBindings[strings.ToLower(bindingID)] || user.CreatedAt.After(cutoff) {
+					continue
+				}
+				orphanUsers = append(orphanUsers, orphanUser{server, info.Name, bindingID, user})
+			}
+		}
+	}
+
+	if options.Action != reconcileReport && !options.DryRun {
+		maxPercent := brokerConfig.Reconcile.MaxOrphanPercent
+		if maxPercent == 0 {
+			maxPercent = defaultReconcileMaxOrphanPercent
+		}
+		if orphanRatioExceeded(len(orphanDatabases), totalDatabases, maxPercent) {
+			return report, invalidParametersError{fmt.Errorf("%d of the %d managed databases are not known, more than reconcile.maxOrphanPercent %d%%, refusing to %s them: check the list of known instances with a dry run", len(orphanDatabases), totalDatabases, maxPercent, options.Action)}
+		}
+		if orphanRatioExceeded(len(orphanUsers), totalUsers, maxPercent) {
+			return report, invalidParametersError{fmt.Errorf("%d of the %d binding users are not known, more than reconcile.maxOrphanPercent %d%%, refusing to %s them: check the list of known bindings with a dry run", len(orphanUsers), totalUsers, maxPercent, options.Action)}
+		}
+	}
+
+	for _, orphan := range orphanDatabases {
+		instanceID := strings.TrimPrefix(orphan.info.Name, brokerConfig.DbIdentifierPrefix)
+		report.Databases = append(report.Databases, reconcileDatabase(orphan.server, orphan.info.Name, instanceID, orphan.info.CreatedAt, options))
+	}
+	for _, orphan := range orphanUsers {
+		instanceID := strings.TrimPrefix(orphan.databaseName, brokerConfig.DbIdentifierPrefix)
+		report.Users = append(report.Users, reconcileUser(orphan.server, orphan.databaseName, instanceID, orphan.bindingID, orphan.user.Name, orphan.user.CreatedAt, options))
+	}
+
+	logger.Info("reconcile-finished", lager.Data{"orphanDatabases": len(report.Databases), "orphanUsers": len(report.Users)})
+	return report, nil
+}
+
+func reconcileDatabase(server *mssqlServer, databaseName, instanceID string, createdAt time.Time, options ReconcileOptions) OrphanDatabase {
+	orphan := OrphanDatabase{
+		Server:     server.Name,
+		Database:   databaseName,
+		InstanceID: instanceID,
+		CreatedAt:  createdAt,
+		Action:     reconcileActionResult(options, true),
+	}
+
+	properties, err := server.provisioner.GetDatabaseProperties(databaseName)
+	if err == nil {
+		orphan.PlanID = properties[planIdProperty]
+	}
+
+	if options.Action == reconcileReport || options.DryRun {
+		return orphan
+	}
+
+	_, unlock, err := lockInstance(instanceID, "reconcile", onServer(server))
+	if err != nil {
+		orphan.Action, orphan.Error = "failed", err.Error()
+		return orphan
+	}
+	defer unlock()
+
+	orphan.Reason, err = recheckOrphanDatabase(server, databaseName, instanceID, createdAt, options.Recheck)
+	if err != nil {
+		orphan.Action, orphan.Error = "failed", brokerError(err, nil, nil).Error()
+		return orphan
+	}
+	if orphan.Reason != "" {
+		orphan.Action = "skipped"
+		logger.Info("orphan-database-skipped", lager.Data{"server": server.Name, "database": databaseName, "reason": orphan.Reason})
+		return orphan
+	}
+
+	err = deleteDatabase(server, databaseName, orphan.PlanID, options.Action == reconcileSoftDelete)
+	if err != nil {
+		orphan.Action, orphan.Error = "failed", err.Error()
+		return orphan
+	}
+
+	logger.Info("orphan-database-"+orphan.Action, lager.Data{"server": server.Name, "database": databaseName})
+	return orphan
+}
+
+func reconcileUser(server *mssqlServer, databaseName, instanceID, bindingID, username string, createdAt time.Time, options ReconcileOptions) OrphanUser {
+	orphan := OrphanUser{
+		Server:     server.Name,
+		Database:   databaseName,
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		User:       username,
+		CreatedAt:  createdAt,
+		Action:     reconcileActionResult(options, false),
+	}
+
+	if options.Action == reconcileReport || options.DryRun {
+		return orphan
+	}
+
+	_, unlock, err := lockInstance(instanceID, "reconcile", onServer(server))
+	if err != nil {
+		orphan.Action, orphan.Error = "failed", err.Error()
+		return orphan
+	}
+	defer unlock()
+
+	orphan.Reason, err = recheckOrphanUser(server, databaseName, bindingID, username, createdAt, options.Recheck)
+	if err != nil {
+		orphan.Action, orphan.Error = "failed", brokerError(err, nil, nil).Error()
+		return orphan
+	}
+	if orphan.Reason != "" {
+		orphan.Action = "skipped"
+		logger.Info("orphan-user-skipped", lager.Data{"server": server.Name, "database": databaseName, "user": username, "reason": orphan.Reason})
+		return orphan
+	}
+
+	if options.Action == reconcileSoftDelete {
+		err = server.provisioner.DisableUser(databaseName, username)
+	} else {
+		planID := ""
+		properties, propertiesErr := server.provisioner.GetDatabaseProperties(databaseName)
+		if propertiesErr == nil {
+			planID = properties[planIdProperty]
+		}
+		err = server.provisioner.WithTemplates(planSqlTemplates(planID)).DeleteUser(databaseName, username)
+	}
+	if err != nil {
+		orphan.Action, orphan.Error = "failed", brokerError(err, nil, nil).Error()
+		return orphan
+	}
+
+	logger.Info("orphan-user-"+orphan.Action, lager.Data{"server": server.Name, "database": databaseName, "user": username})
+	return orphan
+}
+
+// recheckOrphanDatabase checks, with the instance locked, that the database was not deleted or recreated
+// and that its instance is still not known. Returns why the database must be skipped, or "".
+func recheckOrphanDatabase(server *mssqlServer, databaseName, instanceID string, createdAt time.Time, recheck knownResourceChecker) (string, error) {
+	info, found, err := server.provisioner.GetDatabaseInfo(databaseName)
+	if err != nil {
+		return "", err
+	}
+	if !found || !info.CreatedAt.Equal(createdAt) {
+		return "the database was deleted or created again during the reconciliation", nil
+	}
+
+	if recheck != nil {
+		known, err := recheck.IsKnownInstance(instanceID)
+		if err != nil {
+			return "", err
+		}
+		if known {
+			return "the instance is now known by the Cloud Controller", nil
+		}
+	}
+	return "", nil
+}
+
+// recheckOrphanUser checks, with the instance locked, that the user was not deleted or recreated
+// and that its binding is still not known. Returns why the user must be skipped, or "".
+func recheckOrphanUser(server *mssqlServer, databaseName, bindingID, username string, createdAt time.Time, recheck knownResourceChecker) (string, error) {
+	users, err := server.provisioner.ListUsers(databaseName)
+	if err != nil {
+		return "", err
+	}
+	found := false
+	for _, user := range users {
+		if user.Name == username && user.CreatedAt.Equal(createdAt) {
+			found = true
+		}
+	}
+	if !found {
+		return "the user was deleted or created again during the reconciliation", nil
+	}
+
+	if recheck != nil {
+		known, err := recheck.IsKnownBinding(bindingID)
+		if err != nil {
+			return "", err
+		}
+		if known {
+			return "the binding is now known by the Cloud Controller", nil
+		}
+	}
+	return "", nil
+}
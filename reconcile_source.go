@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+)
+
+// KnownResources are the service instance and binding GUIDs known by the Cloud Controller.
+// The service keys are bindings too.
+type KnownResources struct {
+	Instances []string `json:"instances"`
+	Bindings  []string `json:"bindings"`
+}
+
+// knownResourcesSource lists the instances and bindings known by the Cloud Controller
+type knownResourcesSource interface {
+	KnownResources() (KnownResources, error)
+}
+
+// knownResourceChecker checks a single instance or binding, e.g. again just before it is deleted
+type knownResourceChecker interface {
+	IsKnownInstance(instanceID string) (bool, error)
+	IsKnownBinding(bindingID string) (bool, error)
+}
+
+// newKnownResourcesSource returns the configured source, or nil if there is none
+func newKnownResourcesSource(settings config.ReconcileSettings) knownResourcesSource {
+	if settings.KnownResourcesFile != "" {
+		return knownResourcesFile(settings.KnownResourcesFile)
+	}
+	if settings.CloudControllerUrl != "" {
+		return newCloudControllerClient(settings)
+	}
+	return nil
+}
+
+// knownResourcesFile is a json file with the KnownResources, e.g. exported with the cf cli
+type knownResourcesFile string
+
+func (path knownResourcesFile) KnownResources() (KnownResources, error) {
+	known := KnownResources{}
+
+	content, err := ioutil.ReadFile(string(path))
+	if err != nil {
+		return known, err
+	}
+
+	err = json.Unmarshal(content, &known)
+	if err != nil {
+		return known, fmt.Errorf("invalid known resources file %s: %v", path, err)
+	}
+	return known, nil
+}
+
+func (path knownResourcesFile) IsKnownInstance(instanceID string) (bool, error) {
+	known, err := path.KnownResources()
+	if err != nil {
+		return false, err
+	}
+	return guidSet(known.Instances)[strings.ToLower(instanceID)], nil
+}
+
+func (path knownResourcesFile) IsKnownBinding(bindingID string) (bool, error) {
+	known, err := path.KnownResources()
+	if err != nil {
+		return false, err
+	}
+	return guidSet(known.Bindings)[strings.ToLower(bindingID)], nil
+}
+
+// cloudControllerClient lists the GUIDs with the Cloud Controller v2 API,
+// with a client credentials token from UAA
+type cloudControllerClient struct {
+	apiUrl       string
+	uaaUrl       string
+	clientId     string
+	clientSecret string
+	httpClient   *http.Client
+}
+
+func newCloudControllerClient(settings config.ReconcileSettings) *cloudControllerClient {
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: settings.SkipSslValidation},
+	}
+
+	return &cloudControllerClient{
+		apiUrl:       strings.TrimRight(settings.CloudControllerUrl, "/"),
+		uaaUrl:       strings.TrimRight(settings.UaaUrl, "/"),
+		clientId:     settings.ClientId,
+		clientSecret: settings.ClientSecret,
+		httpClient:   &http.Client{Transport: transport, Timeout: 60 * time.Second},
+	}
+}
+
+func (client *cloudControllerClient) KnownResources() (KnownResources, error) {
+	known := KnownResources{}
+
+	token, err := client.token()
+	if err != nil {
+		return known, err
+	}
+
+	known.Instances, err = client.listGuids("/v2/service_instances", token)
+	if err != nil {
+		return known, err
+	}
+
+	bindings, err := client.listGuids("/v2/service_bindings", token)
+	if err != nil {
+		return known, err
+	}
+	keys, err := client.listGuids("/v2/service_keys", token)
+	if err != nil {
+		return known, err
+	}
+	known.Bindings = append(bindings, keys...)
+
+	return known, nil
+}
+
+// IsKnownInstance looks for the service instance with the GUID
+func (client *cloudControllerClient) IsKnownInstance(instanceID string) (bool, error) {
+	token, err := client.token()
+	if err != nil {
+		return false, err
+	}
+	return client.exists("/v2/service_instances/"+url.PathEscape(instanceID), token)
+}
+
+// IsKnownBinding looks for a service binding or a service key with the GUID
+func (client *cloudControllerClient) IsKnownBinding(bindingID string) (bool, error) {
+	token, err := client.token()
+	if err != nil {
+		return false, err
+	}
+	known, err := client.exists("/v2/service_bindings/"+url.PathEscape(bindingID), token)
+	if err != nil || known {
+		return known, err
+	}
+	return client.exists("/v2/service_keys/"+url.PathEscape(bindingID), token)
+}
+
+// token gets a client credentials token. The UAA url is discovered from /v2/info if it is not configured.
+func (client *cloudControllerClient) token() (string, error) {
+	uaaUrl := client.uaaUrl
+	if uaaUrl == "" {
+		info := struct {
+			TokenEndpoint string `json:"token_endpoint"`
+		}{}
+		err := client.getJson(client.apiUrl+"/v2/info", "", &info)
+		if err != nil {
+			return "", err
+		}
+		uaaUrl = strings.TrimRight(info.TokenEndpoint, "/")
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequest("POST", uaaUrl+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(client.clientId, client.clientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	token := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	err = client.doJson(req, &token)
+	if err != nil {
+		return "", fmt.Errorf("UAA token request failed: %v", err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("UAA token request failed: no access token")
+	}
+
+	return token.AccessToken, nil
+}
+
+// listGuids follows the next_url of the pages of a v2 list. The list is rejected when the number
+// of GUIDs is not the total_results of the first page, e.g. when resources were added or deleted
+// between the pages, a missing GUID would make its resource an orphan.
+func (client *cloudControllerClient) listGuids(path string, token string) ([]string, error) {
+	guids := []string{}
+	next := path + "?results-per-page=100"
+	total := -1
+
+	for next != "" {
+		page := struct {
+			TotalResults int    `json:"total_results"`
+			NextUrl      string `json:"next_url"`
+			Resources    []struct {
+				Metadata struct {
+					Guid string `json:"guid"`
+				} `json:"metadata"`
+			} `json:"resources"`
+		}{}
+
+		err := client.getJson(client.apiUrl+next, token, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		if total == -1 {
+			total = page.TotalResults
+		}
+		for _, resource := range page.Resources {
+			guids = append(guids, resource.Metadata.Guid)
+		}
+		next = page.NextUrl
+	}
+
+	if len(guids) != total {
+		return nil, fmt.Errorf("%s listed %d resources instead of its total_results %d, the list changed while it was read, try again", path, len(guids), total)
+	}
+	return guids, nil
+}
+
+// exists gets a resource, and returns false if the Cloud Controller does not find it
+func (client *cloudControllerClient) exists(path string, token string) (bool, error) {
+	req, err := http.NewRequest("GET", client.apiUrl+path, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("%s %s returned %d: %s", req.Method, req.URL.Path, resp.StatusCode, body)
+}
+
+func (client *cloudControllerClient) getJson(url string, token string, output interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	return client.doJson(req, output)
+}
+
+func (client *cloudControllerClient) doJson(req *http.Request, output interface{}) error {
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %d: %s", req.Method, req.URL.Path, resp.StatusCode, body)
+	}
+
+	return json.Unmarshal(body, output)
+}
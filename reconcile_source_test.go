@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+)
+
+// newCloudControllerStub serves /v2/info, the UAA token and two pages of service instances
+func newCloudControllerStub(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	var server *httptest.Server
+
+	mux.HandleFunc("/v2/info", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"token_endpoint": "%s/uaa"}`, server.URL)
+	})
+	mux.HandleFunc("/uaa/oauth/token", func(w http.ResponseWriter, req *http.Request) {
+		user, password, ok := req.BasicAuth()
+		if !ok || user != "reconciler" || password != "secret" || req.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "token1", "token_type": "bearer"}`)
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "bearer token1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path + "?" + req.URL.RawQuery {
+		case "/v2/service_instances?results-per-page=100":
+			fmt.Fprint(w, `{"total_results": 2, "next_url": "/v2/service_instances?page=2&results-per-page=100", "resources": [{"metadata": {"guid": "instance1"}}]}`)
+		case "/v2/service_instances?page=2&results-per-page=100":
+			fmt.Fprint(w, `{"total_results": 2, "next_url": null, "resources": [{"metadata": {"guid": "instance2"}}]}`)
+		case "/v2/service_bindings?results-per-page=100":
+			fmt.Fprint(w, `{"total_results": 1, "next_url": null, "resources": [{"metadata": {"guid": "binding1"}}]}`)
+		case "/v2/service_keys?results-per-page=100":
+			fmt.Fprint(w, `{"total_results": 1, "next_url": null, "resources": [{"metadata": {"guid": "key1"}}]}`)
+		case "/v2/changing_list?results-per-page=100":
+			fmt.Fprint(w, `{"total_results": 3, "next_url": null, "resources": [{"metadata": {"guid": "instance1"}}, {"metadata": {"guid": "instance2"}}]}`)
+		case "/v2/service_instances/instance1?", "/v2/service_keys/key1?":
+			fmt.Fprint(w, `{"metadata": {"guid": "found"}}`)
+		case "/v2/service_instances/instance3?", "/v2/service_bindings/key1?", "/v2/service_bindings/binding3?", "/v2/service_keys/binding3?":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error_code": "CF-NotFound"}`)
+		default:
+			t.Errorf("unexpected request %s", req.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	server = httptest.NewServer(mux)
+	return server
+}
+
+func TestCloudControllerKnownResources(t *testing.T) {
+	stub := newCloudControllerStub(t)
+	defer stub.Close()
+
+	source := newKnownResourcesSource(config.ReconcileSettings{CloudControllerUrl: stub.URL, ClientId: "reconciler", ClientSecret: "secret"})
+
+	// Act
+	known, err := source.KnownResources()
+
+	// Assert
+	if err != nil {
+		t.Fatalf("KnownResources error, %v", err)
+	}
+	expected := KnownResources{Instances: []string{"instance1", "instance2"}, Bindings: []string{"binding1", "key1"}}
+	if !reflect.DeepEqual(known, expected) {
+		t.Errorf("unexpected known resources %v", known)
+	}
+}
+
+func TestCloudControllerKnownResourcesUnauthorized(t *testing.T) {
+	stub := newCloudControllerStub(t)
+	defer stub.Close()
+
+	source := newKnownResourcesSource(config.ReconcileSettings{CloudControllerUrl: stub.URL, ClientId: "reconciler", ClientSecret: "wrong"})
+
+	// Act
+	_, err := source.KnownResources()
+
+	// Assert
+	if err == nil {
+		t.Errorf("expected an error with invalid client credentials")
+	}
+}
+
+func TestCloudControllerListChangedBetweenPages(t *testing.T) {
+	stub := newCloudControllerStub(t)
+	defer stub.Close()
+
+	client := newCloudControllerClient(config.ReconcileSettings{CloudControllerUrl: stub.URL})
+
+	// Act
+	guids, err := client.listGuids("/v2/changing_list", "token1")
+
+	// Assert
+	if err == nil {
+		t.Errorf("expected an error when the list does not have its total_results, got %v", guids)
+	}
+}
+
+func TestCloudControllerIsKnown(t *testing.T) {
+	stub := newCloudControllerStub(t)
+	defer stub.Close()
+
+	client := newCloudControllerClient(config.ReconcileSettings{CloudControllerUrl: stub.URL, ClientId: "reconciler", ClientSecret: "secret"})
+
+	// Act
+	knownInstance, instanceErr := client.IsKnownInstance("instance1")
+	unknownInstance, unknownInstanceErr := client.IsKnownInstance("instance3")
+	knownKey, keyErr := client.IsKnownBinding("key1")
+	unknownBinding, unknownBindingErr := client.IsKnownBinding("binding3")
+
+	// Assert
+	if instanceErr != nil || unknownInstanceErr != nil || keyErr != nil || unknownBindingErr != nil {
+		t.Fatalf("unexpected errors %v, %v, %v, %v", instanceErr, unknownInstanceErr, keyErr, unknownBindingErr)
+	}
+	if !knownInstance || unknownInstance {
+		t.Errorf("expected only instance1 to be known, got %v and %v", knownInstance, unknownInstance)
+	}
+	if !knownKey || unknownBinding {
+		t.Errorf("expected the service key to be a known binding and binding3 to be unknown, got %v and %v", knownKey, unknownBinding)
+	}
+}
+
+func TestKnownResourcesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known-resources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "known.json")
+	ioutil.WriteFile(path, []byte(`{"instances": ["instance1"], "bindings": ["binding1", "binding2"]}`), 0600)
+
+	// Act
+	known, err := newKnownResourcesSource(config.ReconcileSettings{KnownResourcesFile: path}).KnownResources()
+
+	// Assert
+	if err != nil || len(known.Instances) != 1 || len(known.Bindings) != 2 {
+		t.Errorf("unexpected known resources %v, %v", known, err)
+	}
+
+	checker := knownResourcesFile(path)
+	if ok, err := checker.IsKnownInstance("INSTANCE1"); !ok || err != nil {
+		t.Errorf("expected instance1 to be known, got %v, %v", ok, err)
+	}
+	if ok, err := checker.IsKnownBinding("binding3"); ok || err != nil {
+		t.Errorf("expected binding3 to be unknown, got %v, %v", ok, err)
+	}
+}
+
+func TestOrphanRatioExceeded(t *testing.T) {
+	cases := []struct {
+		orphans, total, maxPercent int
+		expected                   bool
+	}{
+		{0, 0, 25, false},
+		{1, 4, 25, false},
+		{2, 4, 25, true},
+		{1, 1, 25, true},
+		{3, 3, 100, false},
+		{1, 200, 0, true},
+	}
+
+	for _, c := range cases {
+		// Act
+		exceeded := orphanRatioExceeded(c.orphans, c.total, c.maxPercent)
+
+		// Assert
+		if exceeded != c.expected {
+			t.Errorf("expected %v for %d orphans of %d with %d%%, got %v", c.expected, c.orphans, c.total, c.maxPercent, exceeded)
+		}
+	}
+}
+
+func TestReconcileActionResult(t *testing.T) {
+	cases := []struct {
+		options  ReconcileOptions
+		database string
+		user     string
+	}{
+		{ReconcileOptions{Action: reconcileReport}, "none", "none"},
+		{ReconcileOptions{Action: reconcileDelete}, "deleted", "deleted"},
+		{ReconcileOptions{Action: reconcileSoftDelete}, "soft-deleted", "disabled"},
+		{ReconcileOptions{Action: reconcileSoftDelete, DryRun: true}, "would be soft-deleted", "would be disabled"},
+	}
+
+	for _, c := range cases {
+		if result := reconcileActionResult(c.options, true); result != c.database {
+			t.Errorf("expected %q for the databases with %v, got %q", c.database, c.options, result)
+		}
+		if result := reconcileActionResult(c.options, false); result != c.user {
+			t.Errorf("expected %q for the users with %v, got %q", c.user, c.options, result)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-golang/lager"
+)
+
+func newRedactedTestLogger() (lager.Logger, *bytes.Buffer) {
+	buffer := &bytes.Buffer{}
+	testLogger := lager.NewLogger("redaction-test")
+	testLogger.RegisterSink(newRedactingSink(lager.NewWriterSink(buffer, lager.DEBUG)))
+	return testLogger, buffer
+}
+
+// assertNotLogged checks the password and its json encoding
+func assertNotLogged(t *testing.T, output []byte, password string) {
+	jsonPassword, _ := json.Marshal(password)
+	jsonPassword = jsonPassword[1 : len(jsonPassword)-1]
+
+	if bytes.Contains(output, []byte(password)) || bytes.Contains(output, jsonPassword) {
+		t.Errorf("password %q found in the log: %s", password, output)
+	}
+}
+
+// Passwords with the characters that need escaping in sql, connection strings and json
+func nastyPassword(random *rand.Rand) string {
+	chars := []rune(`abcXYZ019'";{}=\%_[]@:/ ` + "\té中")
+	password := make([]rune, 8+random.Intn(24))
+	for i := range password {
+		password[i] = chars[random.Intn(len(chars))]
+	}
+	// start with a letter, so that the secret is not a substring of the surrounding text
+	return "p" + string(password)
+}
+
+func TestRedactGeneratedPasswords(t *testing.T) {
+	for i := 0; i < 500; i++ {
+		testLogger, buffer := newRedactedTestLogger()
+		password := secureRandomString(32) + happySqlPasswordPolicySuffix
+
+		// Act
+		testLogger.Debug("mssql-exec", lager.Data{"query": fmt.Sprintf("create user [cf-binding] with password='%s'", password)})
+		testLogger.Info("bind", lager.Data{"credentials": map[string]interface{}{"username": "cf-binding", "password": password}})
+
+		// Assert
+		assertNotLogged(t, buffer.Bytes(), password)
+	}
+}
+
+func TestRedactNastyPasswords(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 500; i++ {
+		testLogger, buffer := newRedactedTestLogger()
+		password := nastyPassword(random)
+		sqlPassword := strings.Replace(password, "'", "''", -1)
+		odbcPassword := "{" + strings.Replace(password, "}", "}}", -1) + "}"
+
+		// Act
+		testLogger.Debug("mssql-exec", lager.Data{"query": fmt.Sprintf("create user [cf-binding] with password='%s'", sqlPassword)})
+		testLogger.Debug("mssql-exec", lager.Data{"query": fmt.Sprintf("alter user [cf-binding] with password = N'%s'", sqlPassword)})
+		testLogger.Debug("connect", lager.Data{"connection": "driver=freetds;server=10.0.0.93;uid=sa;pwd=" + odbcPassword + ";database=master;"})
+		testLogger.Error("mssql-exec", fmt.Errorf("login failed"), lager.Data{"query": "create user [u] with PASSWORD='" + sqlPassword + "'"})
+
+		// Assert
+		assertNotLogged(t, buffer.Bytes(), password)
+		assertNotLogged(t, buffer.Bytes(), sqlPassword)
+	}
+}
+
+func TestRedactConnectionStringPasswords(t *testing.T) {
+	password := "s3cr3t-Aa_0"
+	cases := []string{
+		"server=10.0.0.93;user id=sa;password=" + password + ";database=master",
+		"server=10.0.0.93;user id=sa;Password = " + password,
+		"sqlserver://sa:" + password + "@10.0.0.93:1433?database=master",
+	}
+
+	for _, connection := range cases {
+		testLogger, buffer := newRedactedTestLogger()
+
+		// Act
+		testLogger.Info("connect", lager.Data{"connection": connection})
+
+		// Assert
+		assertNotLogged(t, buffer.Bytes(), password)
+		if !bytes.Contains(buffer.Bytes(), []byte("10.0.0.93")) {
+			t.Errorf("expected the rest of the connection string in the log: %s", buffer.Bytes())
+		}
+	}
+}
+
+func TestRedactConfig(t *testing.T) {
+	testLogger, buffer := newRedactedTestLogger()
+	brokerPassword := "broker-Secret_1"
+	sqlPassword := "sql-Secret_2"
+	poolPassword := "pool\"Secret'3"
+
+	testConfig := config.Config{
+		DbIdentifierPrefix:    "cf",
+		Crednetials:           brokerapi.BrokerCredentials{Username: "username", Password: brokerPassword},
+		BrokerMssqlConnection: map[string]string{"server": "10.0.0.93", "uid": "sa", "pwd": sqlPassword},
+		MssqlServers: []config.MssqlServer{
+			{Name: "sql1", BrokerMssqlConnection: map[string]string{"server": "10.0.0.94", "user id": "sa", "password": poolPassword}},
+		},
+	}
+
+	// Act
+	testLogger.Debug("config-load-success", lager.Data{"config": testConfig})
+
+	// Assert
+	for _, password := range []string{brokerPassword, sqlPassword, poolPassword} {
+		assertNotLogged(t, buffer.Bytes(), password)
+	}
+	if !bytes.Contains(buffer.Bytes(), []byte("10.0.0.94")) {
+		t.Errorf("expected the rest of the config in the log: %s", buffer.Bytes())
+	}
+}
+
+// execOnlyDriver accepts every statement without running it
+type execOnlyDriver struct{}
+type execOnlyConn struct{}
+type execOnlyStmt struct{}
+
+func (execOnlyDriver) Open(name string) (driver.Conn, error)         { return execOnlyConn{}, nil }
+func (execOnlyConn) Prepare(query string) (driver.Stmt, error)       { return execOnlyStmt{}, nil }
+func (execOnlyConn) Close() error                                    { return nil }
+func (execOnlyConn) Begin() (driver.Tx, error)                       { return nil, errors.New("not supported") }
+func (execOnlyStmt) Close() error                                    { return nil }
+func (execOnlyStmt) NumInput() int                                   { return -1 }
+func (execOnlyStmt) Exec(args []driver.Value) (driver.Result, error) { return driver.ResultNoRows, nil }
+func (execOnlyStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+func init() {
+	sql.Register("redaction-test-exec-only", execOnlyDriver{})
+}
+
+func TestQueryParametersNotLogged(t *testing.T) {
+	testLogger, buffer := newRedactedTestLogger()
+	sqlProvisioner := provisioner.NewMssqlProvisioner(testLogger, "redaction-test-exec-only", map[string]string{"server": "10.0.0.93"})
+	err := sqlProvisioner.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlProvisioner.Close()
+	// not a password field, so only the provisioner can keep it out of the log
+	secret := "Login failed, the token is argument-Secret_4"
+
+	// Act
+	err = sqlProvisioner.SetDatabaseProperties("cf-instance1", map[string]string{"cf_operation_error": secret})
+
+	// Assert
+	if err != nil {
+		t.Fatalf("SetDatabaseProperties error, %v", err)
+	}
+	assertNotLogged(t, buffer.Bytes(), "argument-Secret_4")
+	if !bytes.Contains(buffer.Bytes(), []byte(`"argCount":2`)) {
+		t.Errorf("expected the number of query parameters in the log: %s", buffer.Bytes())
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/config"
+	"github.com/cloudfoundry-incubator/cf-mssql-broker/provisioner"
+	"github.com/pivotal-golang/lager"
+)
+
+const (
+	leastDatabasesPlacement = "least-databases"
+	leastSizePlacement      = "least-size"
+	planPinnedPlacement     = "plan-pinned"
+)
+
+type mssqlServer struct {
+	config.MssqlServer
+	provisioner *provisioner.MssqlProvisioner
+	// PEM of the Tls.CaCertificateFile, sent in the binding credentials
+	caCertificate string
+}
+
+// mssqlServerPool places new databases on one of the configured SQL Servers,
+// and finds the server of an existing database. The broker stays stateless:
+// the index is only a cache and it is rebuilt by probing the servers.
+type mssqlServerPool struct {
+	servers     []*mssqlServer
+	strategy    string
+	planServers map[string][]string
+	logger      lager.Logger
+
+	indexMutex sync.Mutex
+	index      map[string]*mssqlServer
+}
+
+func newMssqlServerPool(logger lager.Logger, servers []config.MssqlServer, strategy string, planServers map[string][]string) (*mssqlServerPool, error) {
+	// the strategy and the servers of the plans are checked by Config.Validate
+	if strategy == "" {
+		strategy = leastDatabasesPlacement
+	}
+
+	pool := &mssqlServerPool{
+		strategy:    strategy,
+		planServers: planServers,
+		logger:      logger,
+		index:       map[string]*mssqlServer{},
+	}
+
+	for _, serverConfig := range servers {
+		mssqlPars := serverConfig.BrokerMssqlConnection
+
+		// set default sql driver if it is not set based on the OS
+		if _, ok := mssqlPars["driver"]; !ok && serverConfig.BrokerGoSqlDriver == "odbc" {
+			if runtime.GOOS != "windows" {
+				mssqlPars["driver"] = "freetds"
+			} else {
+				mssqlPars["driver"] = "sql server"
+			}
+		}
+
+		mssqlPars = withTlsConnectionParams(serverConfig.BrokerGoSqlDriver, mssqlPars, serverConfig.Tls)
+
+		caCertificate := ""
+		if serverConfig.Tls.CaCertificateFile != "" {
+			pem, err := ioutil.ReadFile(serverConfig.Tls.CaCertificateFile)
+			if err != nil {
+				return nil, fmt.Errorf("server %s: %v", serverConfig.Name, err)
+			}
+			caCertificate = string(pem)
+		}
+
+		pool.servers = append(pool.servers, &mssqlServer{
+			MssqlServer:   serverConfig,
+			provisioner:   provisioner.NewMssqlProvisioner(logger.Session("provisioner", lager.Data{"server": serverConfig.Name}), serverConfig.BrokerGoSqlDriver, mssqlPars),
+			caCertificate: caCertificate,
+		})
+	}
+
+	return pool, nil
+}
+
+// withTlsConnectionParams adds the connection parameters of the tls settings for the sql driver
+// of the broker. The parameters set in brokerMssqlConnection are kept.
+func withTlsConnectionParams(goSqlDriver string, connectionParams map[string]string, settings config.TlsSettings) map[string]string {
+	tlsParams := map[string]string{}
+	switch goSqlDriver {
+	case "mssql":
+		if settings.Encrypt {
+			tlsParams["encrypt"] = "true"
+		}
+		if settings.TrustServerCertificate {
+			tlsParams["trustservercertificate"] = "true"
+		}
+		if settings.CaCertificateFile != "" {
+			tlsParams["certificate"] = settings.CaCertificateFile
+		}
+		if settings.HostNameInCertificate != "" {
+			tlsParams["hostnameincertificate"] = settings.HostNameInCertificate
+		}
+	case "odbc":
+		// FreeTDS validates the certificate only with the "ca file" of freetds.conf
+		if strings.EqualFold(connectionParams["driver"], "freetds") {
+			if settings.Encrypt {
+				tlsParams["encryption"] = "require"
+			}
+			break
+		}
+		if settings.Encrypt {
+			tlsParams["encrypt"] = "yes"
+		}
+		if settings.TrustServerCertificate {
+			tlsParams["trustservercertificate"] = "yes"
+		}
+		if settings.HostNameInCertificate != "" {
+			tlsParams["hostnameincertificate"] = settings.HostNameInCertificate
+		}
+	}
+
+	params := map[string]string{}
+	for name, value := range tlsParams {
+		params[name] = value
+	}
+	for name, value := range connectionParams {
+		// the connection string keys are case insensitive
+		delete(params, strings.ToLower(name))
+		params[name] = value
+	}
+	return params
+}
+
+func (pool *mssqlServerPool) Init() error {
+	for _, server := range pool.servers {
+		err := server.provisioner.Init()
+		if err != nil {
+			return fmt.Errorf("server %s: %v", server.Name, err)
+		}
+	}
+	return nil
+}
+
+func (pool *mssqlServerPool) server(name string) *mssqlServer {
+	for _, server := range pool.servers {
+		if server.Name == name {
+			return server
+		}
+	}
+	return nil
+}
+
+// Locate returns the server with the database, or nil if no server has it
+func (pool *mssqlServerPool) Locate(databaseName string) (*mssqlServer, error) {
+	pool.indexMutex.Lock()
+	cached := pool.index[databaseName]
+	pool.indexMutex.Unlock()
+
+	if cached != nil {
+		exist, err := cached.provisioner.IsDatabaseCreated(databaseName)
+		if err != nil {
+			return nil, err
+		}
+		if exist {
+			return cached, nil
+		}
+		pool.forget(databaseName)
+	}
+
+	var probeErr error
+	for _, server := range pool.servers {
+		if server == cached {
+			continue
+		}
+
+		exist, err := server.provisioner.IsDatabaseCreated(databaseName)
+		if err != nil {
+			pool.logger.Error("locate-probe-failed", err, lager.Data{"server": server.Name, "databaseName": databaseName})
+			probeErr = err
+			continue
+		}
+		if exist {
+			pool.remember(databaseName, server)
+			return server, nil
+		}
+	}
+
+	// Not found, but a server that could have it did not answer
+	if probeErr != nil {
+		return nil, probeErr
+	}
+
+	return nil, nil
+}
+
+// Place picks the server for a new database of the plan
+func (pool *mssqlServerPool) Place(planID string) (*mssqlServer, error) {
+	candidates := pool.servers
+	if pool.strategy == planPinnedPlacement {
+		candidates = []*mssqlServer{}
+		for _, name := range pool.planServers[planID] {
+			candidates = append(candidates, pool.server(name))
+		}
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("no servers are pinned for plan %s", planID)
+		}
+	}
+
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+
+	var best *mssqlServer
+	var bestUsage int64
+	var lastErr error
+	for _, server := range candidates {
+		count, sizeMB, err := server.provisioner.ManagedDatabasesUsage(brokerConfig.DbIdentifierPrefix)
+		if err != nil {
+			pool.logger.Error("placement-usage-failed", err, lager.Data{"server": server.Name})
+			lastErr = err
+			continue
+		}
+
+		usage := int64(count)
+		if pool.strategy == leastSizePlacement {
+			usage = sizeMB
+		}
+
+		if best == nil || usage < bestUsage {
+			best = server
+			bestUsage = usage
+		}
+	}
+
+	if best == nil {
+		return nil, lastErr
+	}
+
+	pool.logger.Info("placement", lager.Data{"server": best.Name, "strategy": pool.strategy, "usage": bestUsage})
+	return best, nil
+}
+
+func (pool *mssqlServerPool) remember(databaseName string, server *mssqlServer) {
+	pool.indexMutex.Lock()
+	defer pool.indexMutex.Unlock()
+	pool.index[databaseName] = server
+}
+
+func (pool *mssqlServerPool) forget(databaseName string) {
+	pool.indexMutex.Lock()
+	defer pool.indexMutex.Unlock()
+	delete(pool.index, databaseName)
+}